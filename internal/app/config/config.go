@@ -0,0 +1,542 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/multiformats/go-multiaddr"
+	"go.yaml.in/yaml/v2"
+)
+
+const (
+	envPrefix        = "PEERCHAT_"
+	envConfig        = envPrefix + "CONFIG"
+	appDirName       = ".peerchat"
+	osLinux          = "linux"
+	secretMask       = "********"
+	socketName       = "daemon.sock"
+	downloadsDirName = "downloads"
+)
+
+var configNames = []string{"config.yaml", "config.yml"}
+
+type Config struct {
+	User    string `yaml:"user"`
+	Room    string `yaml:"room"`
+	RoomKey string `yaml:"room_key"`
+	Log     string `yaml:"log"`
+	Profile string `yaml:"profile"`
+	KeyType string `yaml:"key_type"`
+	DataDir string `yaml:"data_dir"`
+	Storage string `yaml:"storage"`
+	// Downloads is where accepted files are saved, <data_dir>/downloads when empty.
+	Downloads string  `yaml:"downloads"`
+	Network   Network `yaml:"network"`
+	History   History `yaml:"history"`
+	Daemon    Daemon  `yaml:"daemon"`
+	UI        UI      `yaml:"ui"`
+
+	// File is the config file the values were read from, if any.
+	File string `yaml:"-"`
+}
+
+type Network struct {
+	ListenAddrs       []string `yaml:"listen_addrs"`
+	ConnLow           int      `yaml:"conn_low"`
+	ConnHigh          int      `yaml:"conn_high"`
+	Discovery         string   `yaml:"discovery"`
+	ServiceName       string   `yaml:"service_name"`
+	Bootstrap         []string `yaml:"bootstrap"`
+	NoPublicBootstrap bool     `yaml:"no_public_bootstrap"`
+	SwarmKey          string   `yaml:"swarm_key"`
+	BlockIgnored      bool     `yaml:"block_ignored"`
+}
+
+// History controls syncing room history with other peers.
+type History struct {
+	// Share answers history requests of peers joining a room.
+	Share         bool          `yaml:"share"`
+	Limit         int           `yaml:"limit"`
+	MaxAge        time.Duration `yaml:"max_age"`
+	RatePerMinute int           `yaml:"rate_per_minute"`
+}
+
+type Daemon struct {
+	// Socket is the Unix socket of the daemon API, <data_dir>/daemon.sock when empty.
+	Socket string `yaml:"socket"`
+	// Attach makes the terminal UI use a running daemon instead of its own node.
+	Attach bool `yaml:"attach"`
+}
+
+type UI struct {
+	Keys   Keys   `yaml:"keys"`
+	Theme  Theme  `yaml:"theme"`
+	Notify Notify `yaml:"notify"`
+}
+
+// Keys lists the key combinations of every action, for example "alt+enter" or "ctrl+s".
+type Keys struct {
+	Send     []string `yaml:"send"`
+	Focus    []string `yaml:"focus"`
+	NextRoom []string `yaml:"next_room"`
+	PrevRoom []string `yaml:"prev_room"`
+	// SelectPrev and SelectNext select messages in the message box for Reply, Thread, Edit and React.
+	SelectPrev []string `yaml:"select_prev"`
+	SelectNext []string `yaml:"select_next"`
+	Reply      []string `yaml:"reply"`
+	Thread     []string `yaml:"thread"`
+	Edit       []string `yaml:"edit"`
+	React      []string `yaml:"react"`
+	// Peers moves the focus to the peer list, Enter there opens the peer details.
+	Peers []string `yaml:"peers"`
+}
+
+// Theme holds color names as understood by tcell, for example "green" or "#00ff00".
+type Theme struct {
+	Border    string `yaml:"border"`
+	Title     string `yaml:"title"`
+	Own       string `yaml:"own"`
+	Peer      string `yaml:"peer"`
+	System    string `yaml:"system"`
+	Timestamp string `yaml:"timestamp"`
+	// Mention highlights @mentions of the own name and rooms they arrived in.
+	Mention string `yaml:"mention"`
+}
+
+// Notify controls how mentions of the own name are announced.
+type Notify struct {
+	// Bell rings the terminal bell.
+	Bell bool `yaml:"bell"`
+	// Command is run without a shell with the title and the text of the
+	// message appended as arguments, for example ["notify-send"].
+	Command []string `yaml:"command"`
+}
+
+// Default returns the built-in configuration.
+func Default() *Config {
+	send := []string{"alt+enter", "ctrl+s"}
+	if runtime.GOOS != osLinux {
+		send = []string{"ctrl+s", "alt+enter"}
+	}
+	return &Config{
+		Room:    "lobby",
+		User:    "incognito",
+		Log:     "info",
+		Profile: "default",
+		KeyType: "ed25519",
+		DataDir: filepath.Join("~", appDirName),
+		Storage: "file",
+		Network: Network{
+			ListenAddrs: []string{"/ip4/0.0.0.0/tcp/0"},
+			ConnLow:     100,
+			ConnHigh:    400,
+			Discovery:   "dht",
+			ServiceName: "peerchat",
+		},
+		History: History{
+			Share:         true,
+			Limit:         500,
+			MaxAge:        7 * 24 * time.Hour,
+			RatePerMinute: 6,
+		},
+		UI: UI{
+			Keys: Keys{
+				Send:       send,
+				Focus:      []string{"tab"},
+				NextRoom:   []string{"ctrl+n"},
+				PrevRoom:   []string{"ctrl+p"},
+				SelectPrev: []string{"shift+up", "k"},
+				SelectNext: []string{"shift+down", "j"},
+				Reply:      []string{"r"},
+				Thread:     []string{"t"},
+				Edit:       []string{"e"},
+				React:      []string{"a"},
+				Peers:      []string{"ctrl+o"},
+			},
+			Theme: Theme{
+				Border:    "green",
+				Title:     "white",
+				Own:       "green",
+				Peer:      "blue",
+				System:    "yellow",
+				Timestamp: "lightslategrey",
+				Mention:   "orange",
+			},
+			Notify: Notify{
+				Bell: true,
+			},
+		},
+	}
+}
+
+// Load builds the effective configuration from the defaults, the config
+// file, PEERCHAT_* environment variables and the command line flags, each
+// overriding the previous one, and validates the result.
+func Load(name string, args []string) (*Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags := newFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	cfg := Default()
+
+	path, explicit := flags.configPath, flags.configPath != ""
+	if !explicit {
+		path, explicit = os.LookupEnv(envConfig)
+	}
+	if err := cfg.readFile(path, explicit); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := flags.apply(fs, cfg); err != nil {
+		return nil, err
+	}
+
+	cfg.DataDir = expandHome(cfg.DataDir)
+	cfg.Network.SwarmKey = expandHome(cfg.Network.SwarmKey)
+	cfg.Daemon.Socket = expandHome(cfg.Daemon.Socket)
+	if cfg.Daemon.Socket == "" {
+		cfg.Daemon.Socket = filepath.Join(cfg.DataDir, socketName)
+	}
+	cfg.Downloads = expandHome(cfg.Downloads)
+	if cfg.Downloads == "" {
+		cfg.Downloads = filepath.Join(cfg.DataDir, downloadsDirName)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate reports every invalid value at once.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch strings.ToLower(c.Log) {
+	case "panic", "fatal", "error", "warn", "info", "debug", "trace":
+	default:
+		add("log: unknown level %q", c.Log)
+	}
+	switch strings.ToLower(c.KeyType) {
+	case "ed25519", "rsa":
+	default:
+		add("key_type: unsupported key type %q, use ed25519 or rsa", c.KeyType)
+	}
+	if c.Profile == "" || strings.ContainsAny(c.Profile, `/\`) || c.Profile == "." || c.Profile == ".." {
+		add("profile: invalid name %q", c.Profile)
+	}
+	if c.DataDir == "" {
+		add("data_dir: must not be empty")
+	}
+	switch c.Storage {
+	case "file", "bolt":
+	default:
+		add("storage: unknown backend %q, use file or bolt", c.Storage)
+	}
+
+	n := c.Network
+	if len(n.ListenAddrs) == 0 {
+		add("network.listen_addrs: at least one address is required")
+	}
+	for _, addr := range n.ListenAddrs {
+		if _, err := multiaddr.NewMultiaddr(addr); err != nil {
+			add("network.listen_addrs: %q: %v", addr, err)
+		}
+	}
+	for _, addr := range n.Bootstrap {
+		if _, err := multiaddr.NewMultiaddr(addr); err != nil {
+			add("network.bootstrap: %q: %v", addr, err)
+		}
+	}
+	if n.ConnLow <= 0 || n.ConnHigh < n.ConnLow {
+		add("network: conn_low (%d) must be positive and not above conn_high (%d)", n.ConnLow, n.ConnHigh)
+	}
+	switch n.Discovery {
+	case "dht", "mdns", "both":
+	default:
+		add("network.discovery: unknown value %q, use dht, mdns or both", n.Discovery)
+	}
+	if strings.TrimSpace(n.ServiceName) == "" {
+		add("network.service_name: must not be empty")
+	}
+
+	h := c.History
+	if h.Limit <= 0 {
+		add("history.limit: must be positive")
+	}
+	if h.MaxAge <= 0 {
+		add("history.max_age: must be positive")
+	}
+	if h.RatePerMinute <= 0 {
+		add("history.rate_per_minute: must be positive")
+	}
+
+	keys := []struct {
+		action string
+		specs  []string
+	}{
+		{"send", c.UI.Keys.Send},
+		{"focus", c.UI.Keys.Focus},
+		{"next_room", c.UI.Keys.NextRoom},
+		{"prev_room", c.UI.Keys.PrevRoom},
+		{"select_prev", c.UI.Keys.SelectPrev},
+		{"select_next", c.UI.Keys.SelectNext},
+		{"reply", c.UI.Keys.Reply},
+		{"thread", c.UI.Keys.Thread},
+		{"edit", c.UI.Keys.Edit},
+		{"react", c.UI.Keys.React},
+		{"peers", c.UI.Keys.Peers},
+	}
+	for _, k := range keys {
+		if len(k.specs) == 0 {
+			add("ui.keys.%s: at least one key is required", k.action)
+		}
+		for _, spec := range k.specs {
+			if _, err := ParseKey(spec); err != nil {
+				add("ui.keys.%s: %v", k.action, err)
+			}
+		}
+	}
+	colors := []struct {
+		name  string
+		color string
+	}{
+		{"border", c.UI.Theme.Border},
+		{"title", c.UI.Theme.Title},
+		{"own", c.UI.Theme.Own},
+		{"peer", c.UI.Theme.Peer},
+		{"system", c.UI.Theme.System},
+		{"timestamp", c.UI.Theme.Timestamp},
+		{"mention", c.UI.Theme.Mention},
+	}
+	for _, c := range colors {
+		if tcell.GetColor(c.color) == tcell.ColorDefault {
+			add("ui.theme.%s: unknown color %q", c.name, c.color)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Print writes the effective configuration as YAML with secrets masked.
+func (c *Config) Print(w io.Writer) error {
+	masked := *c
+	if masked.RoomKey != "" {
+		masked.RoomKey = secretMask
+	}
+	if c.File != "" {
+		if _, err := fmt.Fprintf(w, "# loaded from %s\n", c.File); err != nil {
+			return err
+		}
+	}
+	data, err := yaml.Marshal(masked)
+	if err != nil {
+		return fmt.Errorf("marshal config: %w", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (c *Config) readFile(path string, explicit bool) error {
+	if !explicit {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		for _, name := range configNames {
+			candidate := filepath.Join(homeDir, appDirName, name)
+			if _, err = os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+		if path == "" {
+			return nil
+		}
+	}
+
+	path = expandHome(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	if err = yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+	c.File = path
+	return nil
+}
+
+func (c *Config) applyEnv() error {
+	for _, v := range c.settings() {
+		value, ok := os.LookupEnv(envPrefix + v.env)
+		if !ok {
+			continue
+		}
+		if err := v.set(value); err != nil {
+			return fmt.Errorf("%s%s: %w", envPrefix, v.env, err)
+		}
+	}
+	return nil
+}
+
+// setting binds a config value to its environment variable and flag.
+type setting struct {
+	env     string
+	flag    string
+	usage   string
+	set     func(string) error
+	boolean bool
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"USER", "user", "username to use in the chatroom.", setString(&c.User), false},
+		{"ROOM", "room", "chatroom to join.", setString(&c.Room), false},
+		{"ROOM_KEY", "room-key", "passphrase of an end-to-end encrypted chatroom.", setString(&c.RoomKey), false},
+		{"LOG", "log", "level of logs to print.", setString(&c.Log), false},
+		{"PROFILE", "profile", "identity profile to use.", setString(&c.Profile), false},
+		{"KEY_TYPE", "keytype", "type of a newly generated identity key (ed25519 or rsa).", setString(&c.KeyType), false},
+		{"DATA_DIR", "data-dir", "directory for keys and chat history.", setString(&c.DataDir), false},
+		{"STORAGE", "storage", "chat history backend (file or bolt).", setString(&c.Storage), false},
+		{"DOWNLOADS", "downloads", "directory accepted files are saved in (default <data-dir>/downloads).", setString(&c.Downloads), false},
+		{"LISTEN_ADDRS", "listen", "comma-separated listen multiaddrs.", setList(&c.Network.ListenAddrs), false},
+		{"CONN_LOW", "conn-low", "connection manager low water mark.", setInt(&c.Network.ConnLow), false},
+		{"CONN_HIGH", "conn-high", "connection manager high water mark.", setInt(&c.Network.ConnHigh), false},
+		{"DISCOVERY", "discovery", "peer discovery to use (dht, mdns or both).", setString(&c.Network.Discovery), false},
+		{"SERVICE_NAME", "service-name", "service name peers advertise and look for.", setString(&c.Network.ServiceName), false},
+		{"BOOTSTRAP", "bootstrap", "comma-separated bootstrap peer multiaddrs.", setList(&c.Network.Bootstrap), false},
+		{"NO_PUBLIC_BOOTSTRAP", "no-public-bootstrap", "do not connect to the public IPFS bootstrap peers.", setBool(&c.Network.NoPublicBootstrap), true},
+		{"SWARM_KEY", "swarm-key", "path to a swarm key file to join a private network.", setString(&c.Network.SwarmKey), false},
+		{"BLOCK_IGNORED", "block-ignored", "refuse connections with ignored peers.", setBool(&c.Network.BlockIgnored), true},
+		{"HISTORY_SHARE", "history-share", "answer history requests of peers joining a room.", setBool(&c.History.Share), true},
+		{"HISTORY_LIMIT", "history-limit", "most messages synced from or served to a peer at once.", setInt(&c.History.Limit), false},
+		{"HISTORY_MAX_AGE", "history-max-age", "how far back to sync history when joining a room, e.g. 168h.", setDuration(&c.History.MaxAge), false},
+		{"HISTORY_RATE", "history-rate", "history requests a peer may make per minute.", setInt(&c.History.RatePerMinute), false},
+		{"SOCKET", "socket", "unix socket of the daemon API (default <data-dir>/daemon.sock).", setString(&c.Daemon.Socket), false},
+		{"ATTACH", "attach", "attach the terminal UI to a running daemon.", setBool(&c.Daemon.Attach), true},
+		{"NOTIFY_COMMAND", "notify-command", "comma-separated command run on mentions, e.g. notify-send.", setList(&c.UI.Notify.Command), false},
+	}
+}
+
+type flags struct {
+	configPath string
+}
+
+func newFlags(fs *flag.FlagSet) *flags {
+	f := &flags{}
+	fs.StringVar(&f.configPath, "config", "", "path to the config file (default ~/.peerchat/config.yaml).")
+	for _, v := range Default().settings() {
+		if v.boolean {
+			fs.Bool(v.flag, false, v.usage)
+		} else {
+			fs.String(v.flag, "", v.usage)
+		}
+	}
+	return f
+}
+
+// apply sets only the flags given on the command line, so unset flags
+// do not override the config file or environment.
+func (f *flags) apply(fs *flag.FlagSet, cfg *Config) error {
+	byFlag := make(map[string]setting)
+	for _, v := range cfg.settings() {
+		byFlag[v.flag] = v
+	}
+	var err error
+	fs.Visit(func(fl *flag.Flag) {
+		v, ok := byFlag[fl.Name]
+		if !ok || err != nil {
+			return
+		}
+		if setErr := v.set(fl.Value.String()); setErr != nil {
+			err = fmt.Errorf("-%s: %w", fl.Name, setErr)
+		}
+	})
+	return err
+}
+
+func setString(dst *string) func(string) error {
+	return func(s string) error {
+		*dst = s
+		return nil
+	}
+}
+
+func setList(dst *[]string) func(string) error {
+	return func(s string) error {
+		*dst = nil
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*dst = append(*dst, item)
+			}
+		}
+		return nil
+	}
+}
+
+func setInt(dst *int) func(string) error {
+	return func(s string) error {
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", s)
+		}
+		*dst = v
+		return nil
+	}
+}
+
+func setDuration(dst *time.Duration) func(string) error {
+	return func(s string) error {
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("not a duration: %q", s)
+		}
+		*dst = v
+		return nil
+	}
+}
+
+func setBool(dst *bool) func(string) error {
+	return func(s string) error {
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("not a boolean: %q", s)
+		}
+		*dst = v
+		return nil
+	}
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(homeDir, strings.TrimPrefix(path, "~"))
+}
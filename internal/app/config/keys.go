@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Key is a parsed key combination such as "alt+enter", "ctrl+s" or "tab".
+type Key struct {
+	Key  tcell.Key
+	Rune rune
+	Mod  tcell.ModMask
+}
+
+func ParseKey(spec string) (Key, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(spec)), "+")
+	name := parts[len(parts)-1]
+	if name == "" {
+		return Key{}, fmt.Errorf("empty key in %q", spec)
+	}
+
+	var mod tcell.ModMask
+	for _, m := range parts[:len(parts)-1] {
+		switch m {
+		case "alt":
+			mod |= tcell.ModAlt
+		case "ctrl":
+			mod |= tcell.ModCtrl
+		case "shift":
+			mod |= tcell.ModShift
+		default:
+			return Key{}, fmt.Errorf("unknown modifier %q in %q", m, spec)
+		}
+	}
+
+	// terminals report ctrl+letter as a dedicated control key
+	if mod&tcell.ModCtrl != 0 && len(name) == 1 && name[0] >= 'a' && name[0] <= 'z' {
+		return Key{Key: tcell.KeyCtrlA + tcell.Key(name[0]-'a'), Mod: mod &^ tcell.ModCtrl}, nil
+	}
+	for k, n := range tcell.KeyNames {
+		if strings.ToLower(n) == name {
+			return Key{Key: k, Mod: mod}, nil
+		}
+	}
+	if utf8.RuneCountInString(name) == 1 {
+		r, _ := utf8.DecodeRuneInString(name)
+		return Key{Key: tcell.KeyRune, Rune: r, Mod: mod}, nil
+	}
+	return Key{}, fmt.Errorf("unknown key %q", spec)
+}
+
+// Match reports whether the event is this key combination.
+func (k Key) Match(event *tcell.EventKey) bool {
+	if event.Key() != k.Key {
+		return false
+	}
+	if k.Key == tcell.KeyRune && event.Rune() != k.Rune {
+		return false
+	}
+	if k.Key >= tcell.KeyCtrlA && k.Key <= tcell.KeyCtrlZ {
+		return event.Modifiers()&^tcell.ModCtrl == k.Mod
+	}
+	return event.Modifiers() == k.Mod
+}
+
+// KeyLabel formats a key spec for display, "alt+enter" becomes "Alt+Enter".
+func KeyLabel(spec string) string {
+	parts := strings.Split(strings.TrimSpace(spec), "+")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "+")
+}
@@ -0,0 +1,130 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ProtocolVersion is the envelope version written by this client. Newer
+// versions must stay readable by older clients: fields are only added, and
+// new behaviour is introduced through new message kinds.
+const ProtocolVersion = 1
+
+type Kind string
+
+const (
+	KindChat   Kind = "chat"
+	KindDirect Kind = "dm"
+	KindAck    Kind = "ack"
+	KindEdit   Kind = "edit"
+	KindDelete Kind = "delete"
+	KindReact  Kind = "react"
+
+	KindPresence Kind = "presence"
+	KindTyping   Kind = "typing"
+	KindPolicy   Kind = "policy"
+
+	KindHistoryRequest Kind = "history-req"
+	KindHistory        Kind = "history"
+	KindFileRequest    Kind = "file-req"
+	KindFile           Kind = "file"
+)
+
+var (
+	ErrUnknownKind = errors.New("unknown message kind")
+	ErrMalformed   = errors.New("malformed envelope")
+	knownKinds     = map[Kind]struct{}{
+		KindChat:           {},
+		KindDirect:         {},
+		KindAck:            {},
+		KindEdit:           {},
+		KindDelete:         {},
+		KindReact:          {},
+		KindPresence:       {},
+		KindTyping:         {},
+		KindPolicy:         {},
+		KindHistoryRequest: {},
+		KindHistory:        {},
+		KindFileRequest:    {},
+		KindFile:           {},
+	}
+	messageIDByteSize = 16
+)
+
+// Envelope is the wire and storage frame wrapping every message kind.
+type Envelope struct {
+	Version int             `json:"v"`
+	Kind    Kind            `json:"kind"`
+	ID      string          `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// NewMessageID returns a random, globally unique message ID.
+func NewMessageID() string {
+	b := make([]byte, messageIDByteSize)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// IsMessageID reports whether the ID has the form NewMessageID returns.
+func IsMessageID(id string) bool {
+	return len(id) == 2*messageIDByteSize && strings.Trim(id, "0123456789abcdef") == ""
+}
+
+// Wrap encodes the payload into an envelope of the given kind.
+func Wrap(kind Kind, id string, payload any) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("marshal payload: %w", err)
+	}
+	return json.Marshal(Envelope{
+		Version: ProtocolVersion,
+		Kind:    kind,
+		ID:      id,
+		Payload: data,
+	})
+}
+
+// Unwrap parses an envelope. Bare chat messages written before envelopes
+// existed are accepted as chat envelopes. ErrUnknownKind is returned for
+// kinds this client does not understand so callers can skip them.
+func Unwrap(data []byte) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Envelope{}, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if env.Version == 0 && env.Kind == "" {
+		return Envelope{Kind: KindChat, Payload: data}, nil
+	}
+	if _, ok := knownKinds[env.Kind]; !ok {
+		return env, fmt.Errorf("%w: %q", ErrUnknownKind, env.Kind)
+	}
+	if env.ID == "" || len(env.Payload) == 0 {
+		return env, ErrMalformed
+	}
+	return env, nil
+}
+
+// Decode unmarshals the envelope payload into v.
+func (e Envelope) Decode(v any) error {
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return nil
+}
+
+// DecodeChat unmarshals a chat payload, taking the message ID from the envelope.
+func (e Envelope) DecodeChat() (ChatMessage, error) {
+	var msg ChatMessage
+	if err := e.Decode(&msg); err != nil {
+		return ChatMessage{}, err
+	}
+	if e.ID != "" {
+		msg.ID = e.ID
+	}
+	return msg, nil
+}
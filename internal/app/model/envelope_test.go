@@ -0,0 +1,60 @@
+package model
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUnwrap(t *testing.T) {
+	msg := ChatMessage{Message: "hi", SenderID: "peer", SenderName: "hero", CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	chat, err := Wrap(KindChat, "id", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future, err := Wrap(Kind("future"), "id", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc string
+		data string
+		kind Kind
+		id   string
+		err  error
+	}{
+		{"chat envelope", string(chat), KindChat, "id", nil},
+		{"bare message", `{"message":"hi","senderId":"peer","senderName":"hero"}`, KindChat, "", nil},
+		{"unknown kind", string(future), Kind("future"), "id", ErrUnknownKind},
+		{"missing ID", `{"v":1,"kind":"chat","payload":{"message":"hi"}}`, KindChat, "", ErrMalformed},
+		{"missing payload", `{"v":1,"kind":"chat","id":"id"}`, KindChat, "id", ErrMalformed},
+		{"not JSON", "hello", "", "", ErrMalformed},
+	}
+	for _, tt := range tests {
+		env, err := Unwrap([]byte(tt.data))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: Unwrap error = %v, want %v", tt.desc, err, tt.err)
+			continue
+		}
+		if env.Kind != tt.kind || env.ID != tt.id {
+			t.Errorf("%s: Unwrap = %q %q, want %q %q", tt.desc, env.Kind, env.ID, tt.kind, tt.id)
+		}
+	}
+
+	t.Run("chat message", func(t *testing.T) {
+		env, err := Unwrap(chat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := env.DecodeChat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := msg
+		want.ID = "id"
+		if got.ID != want.ID || got.Message != want.Message || got.SenderID != want.SenderID || !got.CreatedAt.Equal(want.CreatedAt) {
+			t.Fatalf("DecodeChat = %+v, want %+v", got, want)
+		}
+	})
+}
@@ -3,13 +3,96 @@ package model
 import "time"
 
 type ChatMessage struct {
+	ID         string    `json:"id,omitempty"`
 	Message    string    `json:"message"`
 	SenderID   string    `json:"senderId"`
 	SenderName string    `json:"senderName"`
 	CreatedAt  time.Time `json:"createdAt"`
+	// ReplyTo is set when the message answers an earlier one.
+	ReplyTo *Reply `json:"replyTo,omitempty"`
+	// EditedAt is set once the author has changed the message. A deleted
+	// message is kept without its text so that it is not synced back.
+	EditedAt time.Time `json:"editedAt,omitzero"`
+	Deleted  bool      `json:"deleted,omitempty"`
+	// Reactions maps each emoji to the IDs of the peers who reacted with it.
+	Reactions map[string][]string `json:"reactions,omitempty"`
+	// File is set when the message offers a file, the message ID identifies the offer.
+	File *FileOffer `json:"file,omitempty"`
+	// Synced is set on messages received in the history of a peer instead
+	// of the signed room topic, their sender is not verified.
+	Synced bool `json:"synced,omitempty"`
+}
+
+// Edit replaces the text of an earlier message of the same sender, or
+// removes it when sent as KindDelete.
+type Edit struct {
+	Target   string    `json:"target"`
+	SenderID string    `json:"senderId"`
+	Message  string    `json:"message,omitempty"`
+	EditedAt time.Time `json:"editedAt"`
+}
+
+// Reply references the parent of a reply. The quote is shown by peers
+// that do not have the parent stored.
+type Reply struct {
+	ID         string `json:"id"`
+	SenderID   string `json:"senderId"`
+	SenderName string `json:"senderName"`
+	Quote      string `json:"quote"`
+}
+
+// Reaction adds an emoji reaction of the sender to a message, or takes it
+// back when Removed is set.
+type Reaction struct {
+	Target   string `json:"target"`
+	SenderID string `json:"senderId"`
+	Emoji    string `json:"emoji"`
+	Removed  bool   `json:"removed,omitempty"`
+}
+
+// FileOffer describes a file its sender serves over the file protocol.
+// Hash is the hex encoded SHA-256 of the content.
+type FileOffer struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// FileRequest asks the sender of an offer for its content from Offset on.
+type FileRequest struct {
+	Offer  string `json:"offer"`
+	Offset int64  `json:"offset"`
+}
+
+// FileHeader answers a FileRequest. The content follows it on the stream
+// unless the request was refused.
+type FileHeader struct {
+	Size    int64  `json:"size"`
+	Refused string `json:"refused,omitempty"`
+}
+
+// DirectMessage is a one-to-one message together with the remote peer of the conversation.
+type DirectMessage struct {
+	PeerID string
+	ChatMessage
 }
 
 type LogMessage struct {
 	Prefix  string `json:"prefix"`
 	Message string `json:"message"`
 }
+
+// HistoryRequest asks a room peer for the messages it stored since a point in time.
+type HistoryRequest struct {
+	Topic string    `json:"topic"`
+	Since time.Time `json:"since"`
+	Limit int       `json:"limit"`
+}
+
+// HistoryResponse carries the requested messages, sealed with the room key
+// in encrypted rooms, or the reason the request was refused.
+type HistoryResponse struct {
+	Messages []ChatMessage `json:"messages,omitempty"`
+	Sealed   []byte        `json:"sealed,omitempty"`
+	Refused  string        `json:"refused,omitempty"`
+}
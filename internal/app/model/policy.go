@@ -0,0 +1,55 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Roles names the owner and the moderators of a room. It is signed by the
+// owner, every change raises Version.
+type Roles struct {
+	// Topic is the pubsub topic of the room, so that roles and policies
+	// cannot be replayed in another room.
+	Topic      string   `json:"topic"`
+	Owner      string   `json:"owner"`
+	Version    int64    `json:"version"`
+	Moderators []string `json:"moderators,omitempty"`
+	// ClaimedAt is when the owner claimed the room, the earliest of
+	// concurrent claims wins.
+	ClaimedAt time.Time `json:"claimedAt,omitzero"`
+}
+
+// Policy is the moderation state of a room, the peers banned or muted in
+// it together with the signed Roles that allow its signer, the owner or a
+// moderator, to change it. Every change raises Version.
+type Policy struct {
+	Topic   string     `json:"topic"`
+	Version int64      `json:"version"`
+	Roles   Signed     `json:"roles"`
+	Banned  []Sanction `json:"banned,omitempty"`
+	Muted   []Sanction `json:"muted,omitempty"`
+}
+
+// Sanction bans or mutes a peer, until the given time when set.
+// A kick is a ban for a few minutes.
+type Sanction struct {
+	PeerID string    `json:"peerId"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+	Until  time.Time `json:"until,omitzero"`
+}
+
+// Signed is a JSON document together with the signature of its signer.
+// Data holds the bytes exactly as they were signed, Key the marshalled
+// public key of Signer.
+type Signed struct {
+	Data      json.RawMessage `json:"data"`
+	Signer    string          `json:"signer"`
+	Key       []byte          `json:"key"`
+	Signature []byte          `json:"signature"`
+}
+
+// Equal reports whether both sanctions are the same.
+func (s Sanction) Equal(o Sanction) bool {
+	return s.PeerID == o.PeerID && s.By == o.By && s.Reason == o.Reason && s.Until.Equal(o.Until)
+}
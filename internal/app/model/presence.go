@@ -0,0 +1,24 @@
+package model
+
+type Status string
+
+const (
+	StatusOnline Status = "online"
+	StatusIdle   Status = "idle"
+	StatusAway   Status = "away"
+)
+
+// Presence is the heartbeat a peer publishes in a room. It is never stored.
+type Presence struct {
+	SenderID   string `json:"senderId"`
+	SenderName string `json:"senderName"`
+	Status     Status `json:"status"`
+	// Away is the message given with /away.
+	Away string `json:"away,omitempty"`
+}
+
+// Typing tells the room that its sender is writing a message. It is never stored.
+type Typing struct {
+	SenderID   string `json:"senderId"`
+	SenderName string `json:"senderName"`
+}
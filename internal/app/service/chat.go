@@ -2,58 +2,95 @@ package service
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Flicster/peerchat/internal/app/model"
 	"github.com/Flicster/peerchat/internal/app/storage"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
 )
 
 const (
-	defaultUser = "incognito"
-	defaultRoom = "lobby"
+	defaultUser        = "incognito"
+	defaultRoom        = "lobby"
+	encryptedLogSuffix = ".e2e"
+	// historyPage is how many messages are read from the history at once.
+	historyPage = 200
 )
 
+// ChatRoom is a joined room. History holds the latest page of stored
+// messages, older ones are read with ReadHistory. Changes receives stored
+// messages edited, deleted or reacted to by other peers, and Synced the number
+// of messages merged into the history from other peers after joining.
 type ChatRoom struct {
-	Host     *P2P
-	Inbound  chan model.ChatMessage
-	Outbound chan model.ChatMessage
-	Logs     chan model.LogMessage
-	RoomName string
-	UserName string
-	History  []model.ChatMessage
+	Host      *P2P
+	Inbound   chan model.ChatMessage
+	Outbound  chan model.ChatMessage
+	Changes   chan model.ChatMessage
+	Logs      chan model.LogMessage
+	Synced    chan int
+	RoomName  string
+	UserName  string
+	Encrypted bool
+	History   []model.ChatMessage
 
 	peerId  peer.ID
 	ctx     context.Context
 	cancel  context.CancelFunc
 	topic   *pubsub.Topic
 	sub     *pubsub.Subscription
-	storage *storage.File
-}
-
-func NewChatRoom(p2phost *P2P, username string, room string) (*ChatRoom, error) {
-	topic, err := p2phost.PubSub.Join(fmt.Sprintf("room-peerchat-%s", room))
-	if err != nil {
-		return nil, fmt.Errorf("join pub sub: %w", err)
-	}
+	crypt   *roomCipher
+	storage storage.Store
+	// logName is the name of the room history in storage
+	logName string
+	// changeMu serializes changes of stored messages
+	changeMu   sync.Mutex
+	presence   presence
+	moderation moderation
 
-	sub, err := topic.Subscribe()
-	if err != nil {
-		return nil, fmt.Errorf("subscribe room: %w", err)
-	}
+	// remote is set when the room is joined through a daemon, sent holds the
+	// IDs of messages written by this client that the daemon will echo back.
+	remote *DaemonClient
+	sent   sync.Map
+}
 
+// NewChatRoom joins the room topic. A non-empty roomKey makes the room
+// end-to-end encrypted: the topic name and every payload are derived from it.
+func NewChatRoom(p2phost *P2P, username string, room string, roomKey string) (*ChatRoom, error) {
 	if username == "" {
 		username = defaultUser
 	}
 	if room == "" {
 		room = defaultRoom
 	}
-	stor, err := storage.NewFile(room)
+
+	topicName := fmt.Sprintf("room-peerchat-%s", room)
+	logName := room
+	var crypt *roomCipher
+	if roomKey != "" {
+		var err error
+		crypt, err = newRoomCipher(room, roomKey)
+		if err != nil {
+			return nil, fmt.Errorf("room key: %w", err)
+		}
+		topicName = crypt.topic
+		logName = room + encryptedLogSuffix
+	}
+
+	topic, err := p2phost.PubSub.Join(topicName)
+	if err != nil {
+		return nil, fmt.Errorf("join pub sub: %w", err)
+	}
+
+	stor, err := storage.Open(logName)
 	if err != nil {
+		_ = topic.Close()
 		return nil, fmt.Errorf("create storage: %w", err)
 	}
 	ctx, cancel := context.WithCancel(context.Background())
@@ -61,24 +98,63 @@ func NewChatRoom(p2phost *P2P, username string, room string) (*ChatRoom, error)
 		Host:     p2phost,
 		Inbound:  make(chan model.ChatMessage),
 		Outbound: make(chan model.ChatMessage),
+		Changes:  make(chan model.ChatMessage),
 		Logs:     make(chan model.LogMessage),
+		Synced:   make(chan int),
 		ctx:      ctx,
 		cancel:   cancel,
 		topic:    topic,
-		sub:      sub,
+		crypt:    crypt,
 		storage:  stor,
+		logName:  logName,
 
-		RoomName: room,
-		UserName: username,
-		peerId:   p2phost.GetPeerID(),
+		RoomName:  room,
+		UserName:  username,
+		Encrypted: crypt != nil,
+		peerId:    p2phost.GetPeerID(),
+	}
+	chatroom.presence.lastActive = time.Now()
+
+	// the validator must be in place before the first message arrives
+	chatroom.loadPolicy()
+	if err = p2phost.PubSub.RegisterTopicValidator(topicName, chatroom.validate); err != nil {
+		cancel()
+		_ = topic.Close()
+		_ = stor.Close()
+		return nil, fmt.Errorf("register validator: %w", err)
+	}
+	// leave nothing behind, so that joining the room can be tried again
+	unwind := func() {
+		cancel()
+		_ = p2phost.PubSub.UnregisterTopicValidator(topicName)
+		_ = topic.Close()
+		_ = stor.Close()
+	}
+	if err = topic.SetScoreParams(roomScoreParams()); err != nil {
+		unwind()
+		return nil, fmt.Errorf("set score params: %w", err)
+	}
+	chatroom.sub, err = topic.Subscribe()
+	if err != nil {
+		unwind()
+		return nil, fmt.Errorf("subscribe room: %w", err)
 	}
 
 	go chatroom.SubLoop()
 	go chatroom.PubLoop()
+	go chatroom.presenceLoop()
 	err = chatroom.LoadHistory()
 	if err != nil {
+		chatroom.Exit()
 		return nil, fmt.Errorf("get history: %w", err)
 	}
+
+	p2phost.history.register(chatroom)
+	var since time.Time
+	if n := len(chatroom.History); n > 0 {
+		since = chatroom.History[n-1].CreatedAt.Add(-historyClockSkew)
+	}
+	go chatroom.syncHistory(since)
 	return chatroom, nil
 }
 
@@ -91,25 +167,57 @@ func (cr *ChatRoom) PubLoop() {
 			return
 
 		case message := <-cr.Outbound:
-			messagebytes, err := json.Marshal(message)
+			if reason := cr.silenced(); reason != "" {
+				cr.notice(model.LogMessage{Prefix: "system", Message: reason})
+				continue
+			}
+			if !message.EditedAt.IsZero() {
+				cr.publishEdit(message)
+				continue
+			}
+			if message.ID == "" {
+				message.ID = model.NewMessageID()
+			}
+			messagebytes, err := model.Wrap(model.KindChat, message.ID, message)
 			if err != nil {
-				cr.Logs <- model.LogMessage{Prefix: "system", Message: "could not marshal JSON"}
+				cr.notice(model.LogMessage{Prefix: "system", Message: "could not marshal JSON"})
+				continue
+			}
+			if cr.crypt != nil {
+				messagebytes, err = cr.crypt.Seal(messagebytes)
+				if err != nil {
+					cr.notice(model.LogMessage{Prefix: "system", Message: "could not encrypt message"})
+					continue
+				}
+			}
+			if len(messagebytes) > maxRoomMessageSize {
+				cr.notice(model.LogMessage{Prefix: "system", Message: "message is too long"})
 				continue
 			}
 
 			err = cr.topic.Publish(cr.ctx, messagebytes)
 			if err != nil {
-				cr.Logs <- model.LogMessage{Prefix: "system", Message: "could not publish to topic"}
+				cr.notice(model.LogMessage{Prefix: "system", Message: "could not publish to topic"})
 				continue
 			}
-			_ = cr.storage.SaveMessage(string(messagebytes))
+			if _, err = cr.storage.SaveMessage(message); err != nil {
+				cr.notice(model.LogMessage{Prefix: "system", Message: "could not save message"})
+			}
+			cr.touch()
 		}
 	}
 }
 
 // SubLoop continuously reads from the subscription
 // until either the subscription or pubsub context closes.
-// The received message is parsed sent into the inbound channel
+// The received message is parsed sent into the inbound channel.
+// Messages whose claimed sender does not match the signed
+// pubsub author are dropped, as are edits and deletions of
+// messages sent by someone else. Changes of stored messages
+// are sent into the changes channel, presence heartbeats and
+// typing notices are only kept in memory. Messages of banned and
+// muted peers never get here, the topic validator rejects them.
+// Nothing is passed on once the room is left.
 func (cr *ChatRoom) SubLoop() {
 	for {
 		select {
@@ -120,45 +228,239 @@ func (cr *ChatRoom) SubLoop() {
 			message, err := cr.sub.Next(cr.ctx)
 			if err != nil {
 				close(cr.Inbound)
-				cr.Logs <- model.LogMessage{Prefix: "system", Message: "subscription has closed"}
+				cr.notice(model.LogMessage{Prefix: "system", Message: "subscription has closed"})
 				return
 			}
-			if message.ReceivedFrom == cr.peerId {
+			from := message.GetFrom()
+			if from == cr.peerId {
+				continue
+			}
+			data := message.Data
+			if cr.crypt != nil {
+				// peers without the room key only produce ciphertext we cannot open
+				if data, err = cr.crypt.Open(data); err != nil {
+					continue
+				}
+			}
+			env, err := model.Unwrap(data)
+			if errors.Is(err, model.ErrUnknownKind) {
+				logrus.WithField("peer", message.ReceivedFrom.String()).Debug(err)
 				continue
 			}
-			cm := &model.ChatMessage{}
-			err = json.Unmarshal(message.Data, cm)
 			if err != nil {
-				cr.Logs <- model.LogMessage{Prefix: "system", Message: "could not unmarshal JSON"}
+				cr.notice(model.LogMessage{Prefix: "system", Message: "could not decode message"})
 				continue
 			}
-			cr.Inbound <- *cm
+			if hiddenWhenIgnored(env.Kind) && cr.Host.isIgnored(from.String()) {
+				continue
+			}
+			switch env.Kind {
+			case model.KindChat:
+				cm, err := env.DecodeChat()
+				if err != nil {
+					cr.notice(model.LogMessage{Prefix: "system", Message: "could not decode message"})
+					continue
+				}
+				if cm.SenderID != from.String() {
+					cr.notice(model.LogMessage{
+						Prefix:  "system",
+						Message: fmt.Sprintf("dropped message from %s impersonating %q", fingerprint(from.String()), cm.SenderName),
+					})
+					continue
+				}
+				cr.stopTyping(from)
+				if cr.verifySynced(cm) {
+					continue
+				}
+				added, err := cr.storage.SaveMessage(cm)
+				if err != nil {
+					cr.notice(model.LogMessage{Prefix: "system", Message: "could not save message"})
+				} else if !added {
+					// a peer published the message again, it is shown already
+					continue
+				}
+				select {
+				case cr.Inbound <- cm:
+				case <-cr.ctx.Done():
+					return
+				}
+			case model.KindEdit, model.KindDelete:
+				var edit model.Edit
+				if err = env.Decode(&edit); err != nil {
+					cr.notice(model.LogMessage{Prefix: "system", Message: "could not decode message"})
+					continue
+				}
+				cr.receiveChange(edit.Target, from, func(msg *model.ChatMessage) error {
+					return applyEdit(env.Kind, edit, from, msg)
+				})
+			case model.KindReact:
+				var reaction model.Reaction
+				if err = env.Decode(&reaction); err != nil {
+					cr.notice(model.LogMessage{Prefix: "system", Message: "could not decode message"})
+					continue
+				}
+				cr.receiveChange(reaction.Target, from, func(msg *model.ChatMessage) error {
+					return applyReaction(reaction, from, msg)
+				})
+			case model.KindPresence:
+				var p model.Presence
+				if err = env.Decode(&p); err != nil {
+					cr.notice(model.LogMessage{Prefix: "system", Message: "could not decode message"})
+					continue
+				}
+				cr.receivePresence(from, p)
+			case model.KindTyping:
+				var t model.Typing
+				if err = env.Decode(&t); err != nil {
+					cr.notice(model.LogMessage{Prefix: "system", Message: "could not decode message"})
+					continue
+				}
+				cr.receiveTyping(from, t)
+			case model.KindPolicy:
+				var policy model.Signed
+				if err = env.Decode(&policy); err != nil {
+					cr.notice(model.LogMessage{Prefix: "system", Message: "could not decode message"})
+					continue
+				}
+				cr.receivePolicy(policy)
+			}
 		}
 	}
 }
 
+// hiddenWhenIgnored reports whether messages of the kind are dropped when
+// they come from an ignored peer. Room policies are not, an ignored owner
+// or moderator still moderates the room.
+func hiddenWhenIgnored(kind model.Kind) bool {
+	switch kind {
+	case model.KindChat, model.KindEdit, model.KindDelete, model.KindReact, model.KindPresence, model.KindTyping:
+		return true
+	}
+	return false
+}
+
+// notice passes the log message on to the UI, it is dropped once the room
+// is left and nothing reads it anymore.
+func (cr *ChatRoom) notice(log model.LogMessage) {
+	select {
+	case cr.Logs <- log:
+	case <-cr.ctx.Done():
+	}
+}
+
+// publish wraps the payload as a message of the kind and publishes it to the
+// room topic, sealed with the room key in encrypted rooms.
+func (cr *ChatRoom) publish(kind model.Kind, payload any) error {
+	data, err := model.Wrap(kind, model.NewMessageID(), payload)
+	if err != nil {
+		return fmt.Errorf("wrap message: %w", err)
+	}
+	if cr.crypt != nil {
+		if data, err = cr.crypt.Seal(data); err != nil {
+			return fmt.Errorf("encrypt message: %w", err)
+		}
+	}
+	if err = cr.topic.Publish(cr.ctx, data); err != nil {
+		return fmt.Errorf("publish to topic: %w", err)
+	}
+	return nil
+}
+
 func (cr *ChatRoom) PeerList() []peer.ID {
+	if cr.remote != nil {
+		ids, err := cr.remote.Peers(cr.RoomName)
+		if err != nil {
+			return nil
+		}
+		peers := make([]peer.ID, 0, len(ids))
+		for _, id := range ids {
+			if p, err := peer.Decode(id); err == nil {
+				peers = append(peers, p)
+			}
+		}
+		return peers
+	}
 	return cr.topic.ListPeers()
 }
 
+// knownPeers returns the peers a command may name by a part of their ID:
+// those connected to the host, or the peers of the room when attached to a
+// daemon.
+func (cr *ChatRoom) knownPeers() []peer.ID {
+	if cr.remote != nil {
+		return cr.PeerList()
+	}
+	return cr.Host.Host.Network().Peers()
+}
+
+// LoadHistory reads the latest page of the room history into History.
 func (cr *ChatRoom) LoadHistory() error {
-	var err error
-	cr.History, err = cr.storage.LoadMessages()
+	history, err := cr.ReadHistory(storage.Query{Limit: historyPage})
 	if err != nil {
 		return fmt.Errorf("load history: %w", err)
 	}
+	cr.History = history
 	return nil
 }
 
+// ReadHistory returns the stored room messages matching the query ordered by time.
+func (cr *ChatRoom) ReadHistory(q storage.Query) ([]model.ChatMessage, error) {
+	if cr.remote != nil {
+		return cr.remote.History(cr.RoomName, q)
+	}
+	return cr.storage.Range(q)
+}
+
 func (cr *ChatRoom) ClearHistory() error {
+	if cr.remote != nil {
+		return cr.remote.Clear(cr.RoomName)
+	}
 	return cr.storage.Clear()
 }
 
+// Search runs a full-text search over the stored history of every conversation.
+func (cr *ChatRoom) Search(q storage.SearchQuery) ([]storage.Record, error) {
+	if cr.remote != nil {
+		return cr.remote.Search(q)
+	}
+	return storage.Search(q)
+}
+
+// Open joins another room the same way this one was joined,
+// directly or through the daemon. The away status is carried over.
+func (cr *ChatRoom) Open(room string, roomKey string) (*ChatRoom, error) {
+	var opened *ChatRoom
+	var err error
+	if cr.remote != nil {
+		opened, err = NewRemoteChatRoom(cr.remote, cr.UserName, room, roomKey)
+	} else {
+		opened, err = NewChatRoom(cr.Host, cr.UserName, room, roomKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if away, message := cr.Away(); away {
+		if err = opened.SetAway(true, message); err != nil {
+			logrus.WithError(err).Debug("could not publish presence")
+		}
+	}
+	return opened, nil
+}
+
+// Exit leaves the room. A room joined through the daemon only stops
+// receiving here, the daemon itself stays in the room.
 func (cr *ChatRoom) Exit() {
 	defer cr.cancel()
-	_ = cr.storage.Close()
+	if cr.remote != nil {
+		return
+	}
+	cr.Host.history.unregister(cr)
+	// in reverse order of NewChatRoom, so that no message in flight is
+	// saved to the closed store
 	cr.sub.Cancel()
+	_ = cr.Host.PubSub.UnregisterTopicValidator(cr.topic.String())
 	_ = cr.topic.Close()
+	_ = cr.storage.Close()
 }
 
 func (cr *ChatRoom) UpdateUser(username string) {
@@ -0,0 +1,632 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	daemonRPCName     = "Peerchat"
+	daemonEventBuffer = 1024
+	maxPollWait       = 30 * time.Second
+	daemonSendTimeout = 10 * time.Second
+	socketDialTimeout = time.Second
+)
+
+var (
+	errUnknownRoom   = errors.New("room is not joined")
+	errDaemonRunning = errors.New("another daemon is listening on the socket")
+)
+
+// DaemonEvent is an inbound room message, log line or history sync
+// notice streamed to API clients.
+type DaemonEvent struct {
+	Seq     uint64             `json:"seq"`
+	Room    string             `json:"room"`
+	Message *model.ChatMessage `json:"message,omitempty"`
+	Log     *model.LogMessage  `json:"log,omitempty"`
+	// Changed is set when Message is a stored message that was edited,
+	// deleted or reacted to.
+	Changed bool `json:"changed,omitempty"`
+	// Synced is the number of messages merged from other peers' history.
+	Synced int `json:"synced,omitempty"`
+}
+
+type Empty struct{}
+
+type InfoReply struct {
+	PeerID   string   `json:"peerId"`
+	UserName string   `json:"userName"`
+	Rooms    []string `json:"rooms"`
+}
+
+type JoinArgs struct {
+	Room string `json:"room"`
+	Key  string `json:"key"`
+}
+
+type JoinReply struct {
+	Room      string `json:"room"`
+	Encrypted bool   `json:"encrypted"`
+	// LogName is the name of the room history in storage.
+	LogName string `json:"logName"`
+	// Cursor is the position of the event stream at the time of joining.
+	Cursor uint64 `json:"cursor"`
+}
+
+type RoomArgs struct {
+	Room string `json:"room"`
+}
+
+type SendArgs struct {
+	Room    string            `json:"room"`
+	Message model.ChatMessage `json:"message"`
+}
+
+type SendReply struct {
+	ID string `json:"id"`
+}
+
+type ReactArgs struct {
+	Room  string `json:"room"`
+	ID    string `json:"id"`
+	Emoji string `json:"emoji"`
+}
+
+type ReactReply struct {
+	Message model.ChatMessage `json:"message"`
+}
+
+type PollArgs struct {
+	// Room filters events by room, all rooms when empty.
+	Room   string `json:"room"`
+	Cursor uint64 `json:"cursor"`
+	// WaitMillis is how long to wait for new events when there are none yet.
+	WaitMillis int `json:"waitMillis"`
+}
+
+type PollReply struct {
+	Events []DaemonEvent `json:"events"`
+	Cursor uint64        `json:"cursor"`
+}
+
+type SearchArgs struct {
+	Query storage.SearchQuery `json:"query"`
+}
+
+type SearchReply struct {
+	Records []storage.Record `json:"records"`
+}
+
+type PeersReply struct {
+	Peers []string `json:"peers"`
+}
+
+type MembersReply struct {
+	Members []Member `json:"members"`
+}
+
+type PeerArgs struct {
+	ID string `json:"id"`
+}
+
+type PeerInfoReply struct {
+	Peer PeerInfo `json:"peer"`
+}
+
+type AwayArgs struct {
+	Room string `json:"room"`
+	// Away sets the status to away with Message, or back to online when false.
+	Away    bool   `json:"away"`
+	Message string `json:"message"`
+}
+
+type ModerateArgs struct {
+	Room string `json:"room"`
+	// Action is one of claim, mod, unmod, kick, ban, unban, mute and unmute,
+	// Peer the peer it applies to except for claim.
+	Action string `json:"action"`
+	Peer   string `json:"peer"`
+	Reason string `json:"reason"`
+}
+
+type PolicyReply struct {
+	Policy RoomPolicy `json:"policy"`
+}
+
+type StatsReply struct {
+	// Rejected counts the room messages rejected by the topic validators by reason.
+	Rejected map[string]uint64 `json:"rejected"`
+}
+
+type IgnoreArgs struct {
+	Peer string `json:"peer"`
+	// Name is the name the peer is remembered by.
+	Name string `json:"name"`
+}
+
+type IgnoredReply struct {
+	// Peers maps the IDs of the ignored peers to their names.
+	Peers map[string]string `json:"peers"`
+}
+
+type HistoryArgs struct {
+	Room string `json:"room"`
+	// Query selects the messages, the whole history when empty.
+	Query storage.Query `json:"query"`
+}
+
+type HistoryReply struct {
+	Messages []model.ChatMessage `json:"messages"`
+}
+
+// Daemon runs chat rooms without a terminal UI and exposes them through a
+// JSON-RPC API on a local Unix socket.
+type Daemon struct {
+	Host     *P2P
+	UserName string
+
+	mu       sync.Mutex
+	rooms    map[string]*ChatRoom
+	events   []DaemonEvent
+	seq      uint64
+	notify   chan struct{}
+	listener net.Listener
+	socket   string
+}
+
+func NewDaemon(p2phost *P2P, username string) *Daemon {
+	return &Daemon{
+		Host:     p2phost,
+		UserName: username,
+		rooms:    make(map[string]*ChatRoom),
+		notify:   make(chan struct{}),
+	}
+}
+
+// Join joins the room unless it is joined already.
+func (d *Daemon) Join(room string, key string) (*ChatRoom, error) {
+	if room == "" {
+		room = defaultRoom
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if cr, ok := d.rooms[room]; ok {
+		return cr, nil
+	}
+	cr, err := NewChatRoom(d.Host, d.UserName, room, key)
+	if err != nil {
+		return nil, err
+	}
+	d.rooms[cr.RoomName] = cr
+	go d.forward(cr)
+	logrus.WithField("room", cr.RoomName).Info("joined room")
+	return cr, nil
+}
+
+func (d *Daemon) Leave(room string) error {
+	d.mu.Lock()
+	cr, ok := d.rooms[room]
+	delete(d.rooms, room)
+	d.mu.Unlock()
+
+	if !ok {
+		return errUnknownRoom
+	}
+	cr.Exit()
+	logrus.WithField("room", room).Info("left room")
+	return nil
+}
+
+func (d *Daemon) Room(room string) (*ChatRoom, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cr, ok := d.rooms[room]
+	if !ok {
+		return nil, errUnknownRoom
+	}
+	return cr, nil
+}
+
+func (d *Daemon) Rooms() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rooms := make([]string, 0, len(d.rooms))
+	for name := range d.rooms {
+		rooms = append(rooms, name)
+	}
+	return rooms
+}
+
+// Send publishes the message in the room as this node.
+func (d *Daemon) Send(room string, msg model.ChatMessage) (string, error) {
+	cr, err := d.Room(room)
+	if err != nil {
+		return "", err
+	}
+	if msg.ID == "" {
+		msg.ID = model.NewMessageID()
+	}
+	if msg.SenderName == "" {
+		msg.SenderName = d.UserName
+	}
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+	msg.SenderID = d.Host.GetPeerID().String()
+
+	select {
+	case cr.Outbound <- msg:
+	case <-cr.ctx.Done():
+		return "", errUnknownRoom
+	case <-time.After(daemonSendTimeout):
+		return "", errors.New("send timed out")
+	}
+	d.publish(DaemonEvent{Room: cr.RoomName, Message: &msg, Changed: !msg.EditedAt.IsZero()})
+	return msg.ID, nil
+}
+
+// React toggles the reaction of this node with the emoji on a room message.
+func (d *Daemon) React(room string, id string, emoji string) (model.ChatMessage, error) {
+	cr, err := d.Room(room)
+	if err != nil {
+		return model.ChatMessage{}, err
+	}
+	msg, err := cr.React(id, emoji)
+	if err != nil {
+		return model.ChatMessage{}, err
+	}
+	d.publish(DaemonEvent{Room: cr.RoomName, Message: &msg, Changed: true})
+	return msg, nil
+}
+
+// Poll returns the events after the cursor, waiting up to wait for new ones.
+func (d *Daemon) Poll(room string, cursor uint64, wait time.Duration) ([]DaemonEvent, uint64) {
+	if wait > maxPollWait {
+		wait = maxPollWait
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		d.mu.Lock()
+		events := make([]DaemonEvent, 0)
+		for _, ev := range d.events {
+			if ev.Seq > cursor && (room == "" || ev.Room == room) {
+				events = append(events, ev)
+			}
+		}
+		latest, notify := d.seq, d.notify
+		d.mu.Unlock()
+
+		if len(events) > 0 || wait <= 0 {
+			return events, latest
+		}
+		select {
+		case <-notify:
+		case <-timeout.C:
+			return events, latest
+		}
+	}
+}
+
+func (d *Daemon) Cursor() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.seq
+}
+
+// Serve listens on the Unix socket until Close is called. A socket left
+// behind by a daemon that stopped is replaced, one that still answers is not.
+func (d *Daemon) Serve(socket string) error {
+	if conn, err := net.DialTimeout("unix", socket, socketDialTimeout); err == nil {
+		_ = conn.Close()
+		return errDaemonRunning
+	}
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+	listener, err := listenPrivate(socket)
+	if err != nil {
+		return err
+	}
+
+	server := rpc.NewServer()
+	if err = server.RegisterName(daemonRPCName, &daemonRPC{daemon: d}); err != nil {
+		_ = listener.Close()
+		_ = os.Remove(socket)
+		return fmt.Errorf("register rpc: %w", err)
+	}
+
+	d.mu.Lock()
+	d.listener = listener
+	d.socket = socket
+	d.mu.Unlock()
+	logrus.WithField("socket", socket).Info("daemon api listening")
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("accept: %w", err)
+		}
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+// listenPrivate listens on the Unix socket. It is bound in a directory only
+// the user may enter and moved into place once it is private itself, so no
+// other user can connect in between.
+func listenPrivate(socket string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(socket), ".socket-")
+	if err != nil {
+		return nil, fmt.Errorf("create socket dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bound := filepath.Join(dir, filepath.Base(socket))
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	// the socket is removed under its final name on Close
+	listener.SetUnlinkOnClose(false)
+	if err = os.Chmod(bound, 0600); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("chmod socket: %w", err)
+	}
+	if err = os.Rename(bound, socket); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("move socket: %w", err)
+	}
+	return listener, nil
+}
+
+func (d *Daemon) Close() {
+	d.mu.Lock()
+	listener := d.listener
+	socket := d.socket
+	rooms := d.rooms
+	d.rooms = make(map[string]*ChatRoom)
+	d.mu.Unlock()
+
+	if listener != nil {
+		_ = listener.Close()
+		_ = os.Remove(socket)
+	}
+	for _, cr := range rooms {
+		cr.Exit()
+	}
+}
+
+// forward moves room output into the event stream so that the room loops never block.
+func (d *Daemon) forward(cr *ChatRoom) {
+	for {
+		select {
+		case <-cr.ctx.Done():
+			return
+		case msg, ok := <-cr.Inbound:
+			if !ok {
+				return
+			}
+			d.publish(DaemonEvent{Room: cr.RoomName, Message: &msg})
+		case msg := <-cr.Changes:
+			d.publish(DaemonEvent{Room: cr.RoomName, Message: &msg, Changed: true})
+		case log := <-cr.Logs:
+			d.publish(DaemonEvent{Room: cr.RoomName, Log: &log})
+		case n := <-cr.Synced:
+			d.publish(DaemonEvent{Room: cr.RoomName, Synced: n})
+		}
+	}
+}
+
+func (d *Daemon) publish(ev DaemonEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.seq++
+	ev.Seq = d.seq
+	d.events = append(d.events, ev)
+	if len(d.events) > daemonEventBuffer {
+		d.events = d.events[len(d.events)-daemonEventBuffer:]
+	}
+	close(d.notify)
+	d.notify = make(chan struct{})
+}
+
+// daemonRPC is the net/rpc receiver exposing the daemon API.
+type daemonRPC struct {
+	daemon *Daemon
+}
+
+func (r *daemonRPC) Info(_ *Empty, reply *InfoReply) error {
+	reply.PeerID = r.daemon.Host.GetPeerID().String()
+	reply.UserName = r.daemon.UserName
+	reply.Rooms = r.daemon.Rooms()
+	return nil
+}
+
+func (r *daemonRPC) Join(args *JoinArgs, reply *JoinReply) error {
+	cursor := r.daemon.Cursor()
+	cr, err := r.daemon.Join(args.Room, args.Key)
+	if err != nil {
+		return err
+	}
+	reply.Room = cr.RoomName
+	reply.Encrypted = cr.Encrypted
+	reply.LogName = cr.logName
+	reply.Cursor = cursor
+	return nil
+}
+
+func (r *daemonRPC) Leave(args *RoomArgs, _ *Empty) error {
+	return r.daemon.Leave(args.Room)
+}
+
+func (r *daemonRPC) Send(args *SendArgs, reply *SendReply) error {
+	id, err := r.daemon.Send(args.Room, args.Message)
+	if err != nil {
+		return err
+	}
+	reply.ID = id
+	return nil
+}
+
+func (r *daemonRPC) React(args *ReactArgs, reply *ReactReply) error {
+	msg, err := r.daemon.React(args.Room, args.ID, args.Emoji)
+	if err != nil {
+		return err
+	}
+	reply.Message = msg
+	return nil
+}
+
+func (r *daemonRPC) Poll(args *PollArgs, reply *PollReply) error {
+	reply.Events, reply.Cursor = r.daemon.Poll(args.Room, args.Cursor, time.Duration(args.WaitMillis)*time.Millisecond)
+	return nil
+}
+
+func (r *daemonRPC) Peers(args *RoomArgs, reply *PeersReply) error {
+	if args.Room == "" {
+		for _, p := range r.daemon.Host.Host.Network().Peers() {
+			reply.Peers = append(reply.Peers, p.String())
+		}
+		return nil
+	}
+	cr, err := r.daemon.Room(args.Room)
+	if err != nil {
+		return err
+	}
+	for _, p := range cr.PeerList() {
+		reply.Peers = append(reply.Peers, p.String())
+	}
+	return nil
+}
+
+func (r *daemonRPC) Members(args *RoomArgs, reply *MembersReply) error {
+	cr, err := r.daemon.Room(args.Room)
+	if err != nil {
+		return err
+	}
+	reply.Members = cr.Members()
+	return nil
+}
+
+func (r *daemonRPC) PeerInfo(args *PeerArgs, reply *PeerInfoReply) error {
+	id, err := peer.Decode(args.ID)
+	if err != nil {
+		return fmt.Errorf("peer id: %w", err)
+	}
+	reply.Peer = r.daemon.Host.PeerInfo(id)
+	return nil
+}
+
+func (r *daemonRPC) Typing(args *RoomArgs, _ *Empty) error {
+	cr, err := r.daemon.Room(args.Room)
+	if err != nil {
+		return err
+	}
+	cr.Typing()
+	return nil
+}
+
+func (r *daemonRPC) SetAway(args *AwayArgs, _ *Empty) error {
+	cr, err := r.daemon.Room(args.Room)
+	if err != nil {
+		return err
+	}
+	return cr.SetAway(args.Away, args.Message)
+}
+
+func (r *daemonRPC) Moderate(args *ModerateArgs, _ *Empty) error {
+	cr, err := r.daemon.Room(args.Room)
+	if err != nil {
+		return err
+	}
+	var target peer.ID
+	if args.Peer != "" {
+		if target, err = peer.Decode(args.Peer); err != nil {
+			return fmt.Errorf("peer id: %w", err)
+		}
+	}
+	return cr.Moderate(args.Action, target, args.Reason)
+}
+
+func (r *daemonRPC) Policy(args *RoomArgs, reply *PolicyReply) error {
+	cr, err := r.daemon.Room(args.Room)
+	if err != nil {
+		return err
+	}
+	reply.Policy, err = cr.Policy()
+	return err
+}
+
+func (r *daemonRPC) Stats(_ *Empty, reply *StatsReply) error {
+	reply.Rejected = r.daemon.Host.Rejections()
+	return nil
+}
+
+func (r *daemonRPC) Ignore(args *IgnoreArgs, _ *Empty) error {
+	id, err := peer.Decode(args.Peer)
+	if err != nil {
+		return fmt.Errorf("peer id: %w", err)
+	}
+	return r.daemon.Host.Ignore(id, args.Name)
+}
+
+func (r *daemonRPC) Unignore(args *PeerArgs, _ *Empty) error {
+	id, err := peer.Decode(args.ID)
+	if err != nil {
+		return fmt.Errorf("peer id: %w", err)
+	}
+	return r.daemon.Host.Unignore(id)
+}
+
+func (r *daemonRPC) Ignored(_ *Empty, reply *IgnoredReply) error {
+	reply.Peers = r.daemon.Host.Ignored()
+	return nil
+}
+
+func (r *daemonRPC) History(args *HistoryArgs, reply *HistoryReply) error {
+	cr, err := r.daemon.Room(args.Room)
+	if err != nil {
+		return err
+	}
+	reply.Messages, err = cr.ReadHistory(args.Query)
+	return err
+}
+
+func (r *daemonRPC) Search(args *SearchArgs, reply *SearchReply) error {
+	records, err := storage.Search(args.Query)
+	if err != nil {
+		return err
+	}
+	reply.Records = records
+	return nil
+}
+
+func (r *daemonRPC) Clear(args *RoomArgs, _ *Empty) error {
+	cr, err := r.daemon.Room(args.Room)
+	if err != nil {
+		return err
+	}
+	return cr.ClearHistory()
+}
@@ -0,0 +1,274 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	pollWait      = 10 * time.Second
+	pollRetryWait = time.Second
+)
+
+// DaemonClient talks to a running daemon over its Unix socket.
+type DaemonClient struct {
+	PeerID peer.ID
+
+	rpc *rpc.Client
+}
+
+func DialDaemon(socket string) (*DaemonClient, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("connect daemon: %w", err)
+	}
+	client := &DaemonClient{rpc: jsonrpc.NewClient(conn)}
+
+	var info InfoReply
+	if err = client.call("Info", &Empty{}, &info); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	client.PeerID, err = peer.Decode(info.PeerID)
+	if err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("daemon peer id: %w", err)
+	}
+	return client, nil
+}
+
+func (c *DaemonClient) Join(room string, key string) (JoinReply, error) {
+	var reply JoinReply
+	err := c.call("Join", &JoinArgs{Room: room, Key: key}, &reply)
+	return reply, err
+}
+
+func (c *DaemonClient) Leave(room string) error {
+	return c.call("Leave", &RoomArgs{Room: room}, &Empty{})
+}
+
+func (c *DaemonClient) Send(room string, msg model.ChatMessage) (string, error) {
+	var reply SendReply
+	err := c.call("Send", &SendArgs{Room: room, Message: msg}, &reply)
+	return reply.ID, err
+}
+
+func (c *DaemonClient) React(room string, id string, emoji string) (model.ChatMessage, error) {
+	var reply ReactReply
+	err := c.call("React", &ReactArgs{Room: room, ID: id, Emoji: emoji}, &reply)
+	return reply.Message, err
+}
+
+func (c *DaemonClient) Poll(room string, cursor uint64, wait time.Duration) (PollReply, error) {
+	var reply PollReply
+	err := c.call("Poll", &PollArgs{Room: room, Cursor: cursor, WaitMillis: int(wait / time.Millisecond)}, &reply)
+	return reply, err
+}
+
+func (c *DaemonClient) Peers(room string) ([]string, error) {
+	var reply PeersReply
+	err := c.call("Peers", &RoomArgs{Room: room}, &reply)
+	return reply.Peers, err
+}
+
+func (c *DaemonClient) Members(room string) ([]Member, error) {
+	var reply MembersReply
+	err := c.call("Members", &RoomArgs{Room: room}, &reply)
+	return reply.Members, err
+}
+
+func (c *DaemonClient) PeerInfo(id peer.ID) (PeerInfo, error) {
+	var reply PeerInfoReply
+	err := c.call("PeerInfo", &PeerArgs{ID: id.String()}, &reply)
+	return reply.Peer, err
+}
+
+func (c *DaemonClient) Typing(room string) error {
+	return c.call("Typing", &RoomArgs{Room: room}, &Empty{})
+}
+
+func (c *DaemonClient) SetAway(room string, away bool, message string) error {
+	return c.call("SetAway", &AwayArgs{Room: room, Away: away, Message: message}, &Empty{})
+}
+
+func (c *DaemonClient) Moderate(room string, action string, target peer.ID, reason string) error {
+	args := &ModerateArgs{Room: room, Action: action, Reason: reason}
+	if target != "" {
+		args.Peer = target.String()
+	}
+	return c.call("Moderate", args, &Empty{})
+}
+
+func (c *DaemonClient) Policy(room string) (RoomPolicy, error) {
+	var reply PolicyReply
+	err := c.call("Policy", &RoomArgs{Room: room}, &reply)
+	return reply.Policy, err
+}
+
+func (c *DaemonClient) Stats() (map[string]uint64, error) {
+	var reply StatsReply
+	err := c.call("Stats", &Empty{}, &reply)
+	return reply.Rejected, err
+}
+
+func (c *DaemonClient) Ignore(id peer.ID, name string) error {
+	return c.call("Ignore", &IgnoreArgs{Peer: id.String(), Name: name}, &Empty{})
+}
+
+func (c *DaemonClient) Unignore(id peer.ID) error {
+	return c.call("Unignore", &PeerArgs{ID: id.String()}, &Empty{})
+}
+
+func (c *DaemonClient) Ignored() (map[string]string, error) {
+	var reply IgnoredReply
+	err := c.call("Ignored", &Empty{}, &reply)
+	return reply.Peers, err
+}
+
+func (c *DaemonClient) History(room string, q storage.Query) ([]model.ChatMessage, error) {
+	var reply HistoryReply
+	err := c.call("History", &HistoryArgs{Room: room, Query: q}, &reply)
+	return reply.Messages, err
+}
+
+func (c *DaemonClient) Clear(room string) error {
+	return c.call("Clear", &RoomArgs{Room: room}, &Empty{})
+}
+
+func (c *DaemonClient) Search(q storage.SearchQuery) ([]storage.Record, error) {
+	var reply SearchReply
+	err := c.call("Search", &SearchArgs{Query: q}, &reply)
+	return reply.Records, err
+}
+
+func (c *DaemonClient) Close() error {
+	return c.rpc.Close()
+}
+
+func (c *DaemonClient) call(method string, args any, reply any) error {
+	if err := c.rpc.Call(daemonRPCName+"."+method, args, reply); err != nil {
+		return fmt.Errorf("daemon %s: %w", method, err)
+	}
+	return nil
+}
+
+// NewRemoteChatRoom joins the room through a daemon. The returned room
+// behaves like a local one, its messages are published and stored by the daemon.
+func NewRemoteChatRoom(client *DaemonClient, username string, room string, roomKey string) (*ChatRoom, error) {
+	if username == "" {
+		username = defaultUser
+	}
+	joined, err := client.Join(room, roomKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	chatroom := &ChatRoom{
+		Inbound:  make(chan model.ChatMessage),
+		Outbound: make(chan model.ChatMessage),
+		Changes:  make(chan model.ChatMessage),
+		Logs:     make(chan model.LogMessage),
+		Synced:   make(chan int),
+		ctx:      ctx,
+		cancel:   cancel,
+		remote:   client,
+
+		RoomName:  joined.Room,
+		UserName:  username,
+		Encrypted: joined.Encrypted,
+		peerId:    client.PeerID,
+		logName:   joined.LogName,
+	}
+
+	go chatroom.remoteSubLoop(joined.Cursor)
+	go chatroom.remotePubLoop()
+	if err = chatroom.LoadHistory(); err != nil {
+		return nil, fmt.Errorf("get history: %w", err)
+	}
+	return chatroom, nil
+}
+
+// remotePubLoop sends outbound messages through the daemon.
+func (cr *ChatRoom) remotePubLoop() {
+	for {
+		select {
+		case <-cr.ctx.Done():
+			return
+		case message := <-cr.Outbound:
+			if message.ID == "" {
+				message.ID = model.NewMessageID()
+			}
+			cr.sent.Store(message.ID, struct{}{})
+			if _, err := cr.remote.Send(cr.RoomName, message); err != nil {
+				cr.sent.Delete(message.ID)
+				cr.notice(model.LogMessage{Prefix: "system", Message: "could not send message - " + err.Error()})
+			}
+		}
+	}
+}
+
+// remoteSubLoop long-polls the daemon event stream of the room. Messages sent
+// by this client are skipped as the UI shows them when they are written.
+func (cr *ChatRoom) remoteSubLoop(cursor uint64) {
+	for {
+		select {
+		case <-cr.ctx.Done():
+			return
+		default:
+		}
+
+		reply, err := cr.remote.Poll(cr.RoomName, cursor, pollWait)
+		if err != nil {
+			select {
+			case cr.Logs <- model.LogMessage{Prefix: "system", Message: "lost daemon connection - " + err.Error()}:
+			case <-cr.ctx.Done():
+				return
+			}
+			time.Sleep(pollRetryWait)
+			continue
+		}
+		cursor = reply.Cursor
+		for _, ev := range reply.Events {
+			switch {
+			case ev.Message != nil && ev.Changed:
+				// changes are shown again even when made here, which is harmless
+				cr.sent.Delete(ev.Message.ID)
+				select {
+				case cr.Changes <- *ev.Message:
+				case <-cr.ctx.Done():
+					return
+				}
+			case ev.Message != nil:
+				if _, own := cr.sent.LoadAndDelete(ev.Message.ID); own {
+					continue
+				}
+				select {
+				case cr.Inbound <- *ev.Message:
+				case <-cr.ctx.Done():
+					return
+				}
+			case ev.Log != nil:
+				select {
+				case cr.Logs <- *ev.Log:
+				case <-cr.ctx.Done():
+					return
+				}
+			case ev.Synced > 0:
+				select {
+				case cr.Synced <- ev.Synced:
+				case <-cr.ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
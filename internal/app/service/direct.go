@@ -0,0 +1,187 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	directProtocol  = protocol.ID("/peerchat/dm/1.0.0")
+	directLogPrefix = "dm-"
+	directTimeout   = 10 * time.Second
+	maxDirectSize   = 64 << 10
+)
+
+var errNotDelivered = errors.New("no delivery acknowledgement")
+
+// Direct exchanges one-to-one messages over a dedicated stream protocol.
+// Streams run over the libp2p secure channel (Noise or TLS) negotiated with
+// the remote peer itself, so messages are encrypted end-to-end and the
+// sender is authenticated even when the connection goes through a relay.
+type Direct struct {
+	Host    *P2P
+	Inbound chan model.DirectMessage
+
+	mu   sync.Mutex
+	logs map[peer.ID]storage.Store
+}
+
+func NewDirect(p2phost *P2P) *Direct {
+	d := &Direct{
+		Host:    p2phost,
+		Inbound: make(chan model.DirectMessage),
+		logs:    make(map[peer.ID]storage.Store),
+	}
+	p2phost.Host.SetStreamHandler(directProtocol, d.handleStream)
+	return d
+}
+
+// Send delivers the message to the peer and waits for its acknowledgement.
+// The message is stored in the conversation log once it is acknowledged.
+func (d *Direct) Send(to peer.ID, msg model.ChatMessage) error {
+	ctx, cancel := context.WithTimeout(d.Host.Ctx, directTimeout)
+	defer cancel()
+
+	s, err := d.Host.Host.NewStream(ctx, to, directProtocol)
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(directTimeout))
+
+	data, err := model.Wrap(model.KindDirect, msg.ID, msg)
+	if err != nil {
+		_ = s.Reset()
+		return fmt.Errorf("wrap message: %w", err)
+	}
+	if _, err = s.Write(append(data, '\n')); err != nil {
+		_ = s.Reset()
+		return fmt.Errorf("write message: %w", err)
+	}
+	_ = s.CloseWrite()
+
+	env, err := readEnvelope(s, maxDirectSize)
+	if err != nil {
+		_ = s.Reset()
+		return fmt.Errorf("read ack: %w", err)
+	}
+	if env.Kind != model.KindAck || env.ID != msg.ID {
+		return errNotDelivered
+	}
+
+	_, err = d.save(to, msg)
+	return err
+}
+
+// History returns the stored conversation with the peer.
+func (d *Direct) History(with peer.ID) ([]model.ChatMessage, error) {
+	stor, err := d.storage(with)
+	if err != nil {
+		return nil, err
+	}
+	return stor.LoadMessages()
+}
+
+func (d *Direct) Close() {
+	d.Host.Host.RemoveStreamHandler(directProtocol)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, stor := range d.logs {
+		_ = stor.Close()
+	}
+	d.logs = make(map[peer.ID]storage.Store)
+}
+
+func (d *Direct) handleStream(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+	if d.Host.isIgnored(remote.String()) {
+		_ = s.Reset()
+		return
+	}
+	_ = s.SetDeadline(time.Now().Add(directTimeout))
+
+	env, err := readEnvelope(s, maxDirectSize)
+	if err != nil || env.Kind != model.KindDirect {
+		logrus.WithError(err).WithField("peer", remote.String()).Debug("invalid direct message")
+		_ = s.Reset()
+		return
+	}
+	msg, err := env.DecodeChat()
+	if err != nil || msg.SenderID != remote.String() {
+		logrus.WithError(err).WithField("peer", remote.String()).Debug("rejected direct message")
+		_ = s.Reset()
+		return
+	}
+	added, err := d.save(remote, msg)
+	if err != nil {
+		logrus.WithError(err).Warn("failed to store direct message")
+		added = true
+	}
+
+	ack, err := model.Wrap(model.KindAck, msg.ID, struct{}{})
+	if err != nil {
+		_ = s.Reset()
+		return
+	}
+	if _, err = s.Write(append(ack, '\n')); err != nil {
+		_ = s.Reset()
+		return
+	}
+	// a message sent again after its ack got lost is acked but shown once
+	if !added {
+		return
+	}
+
+	select {
+	case d.Inbound <- model.DirectMessage{PeerID: remote.String(), ChatMessage: msg}:
+	case <-d.Host.Ctx.Done():
+	}
+}
+
+// save stores the message of the conversation and reports whether it was new.
+func (d *Direct) save(with peer.ID, msg model.ChatMessage) (bool, error) {
+	stor, err := d.storage(with)
+	if err != nil {
+		return false, err
+	}
+	return stor.SaveMessage(msg)
+}
+
+func (d *Direct) storage(with peer.ID) (storage.Store, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if stor, ok := d.logs[with]; ok {
+		return stor, nil
+	}
+	stor, err := storage.Open(directLogPrefix + with.String())
+	if err != nil {
+		return nil, fmt.Errorf("create storage: %w", err)
+	}
+	d.logs[with] = stor
+	return stor, nil
+}
+
+// readEnvelope reads one newline-delimited envelope of at most limit bytes from the stream.
+func readEnvelope(r io.Reader, limit int64) (model.Envelope, error) {
+	line, err := bufio.NewReader(io.LimitReader(r, limit)).ReadBytes('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && len(line) > 0) {
+		return model.Envelope{}, err
+	}
+	return model.Unwrap(line)
+}
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/rivo/tview"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errNotAuthor = errors.New("only the author can change a message")
+	errStaleEdit = errors.New("message has been changed since")
+	errNotSynced = errors.New("message was received signed")
+)
+
+// applyEdit changes the message as the edit says. Only the author of the
+// message, as signed on the pubsub message, may change it.
+func applyEdit(kind model.Kind, edit model.Edit, from peer.ID, msg *model.ChatMessage) error {
+	if edit.SenderID != from.String() || msg.SenderID != from.String() {
+		return errNotAuthor
+	}
+	// edits may arrive out of order, the latest one wins
+	if msg.Deleted || !edit.EditedAt.After(msg.EditedAt) {
+		return errStaleEdit
+	}
+	msg.Message = edit.Message
+	msg.EditedAt = edit.EditedAt
+	if kind == model.KindDelete {
+		msg.Message = ""
+		msg.Deleted = true
+		msg.Reactions = nil
+	}
+	return nil
+}
+
+// publishEdit publishes the change of an own message as a control message
+// referring to it and stores the message in its final state.
+func (cr *ChatRoom) publishEdit(message model.ChatMessage) {
+	kind := model.KindEdit
+	if message.Deleted {
+		kind = model.KindDelete
+	}
+	edit := model.Edit{
+		Target:   message.ID,
+		SenderID: message.SenderID,
+		Message:  message.Message,
+		EditedAt: message.EditedAt,
+	}
+	_, err := cr.changeMessage(edit.Target, func(msg *model.ChatMessage) error {
+		if err := applyEdit(kind, edit, cr.peerId, msg); err != nil {
+			return err
+		}
+		return cr.publish(kind, edit)
+	})
+	if err != nil {
+		cr.notice(model.LogMessage{Prefix: "system", Message: "could not change message - " + err.Error()})
+	}
+}
+
+// receiveChange stores a change of a message made by another peer and passes
+// the changed message on. Changes of messages that are not stored or have
+// been changed again since, invalid reactions and changes that would make
+// the message too large to store are dropped quietly.
+func (cr *ChatRoom) receiveChange(id string, from peer.ID, change func(msg *model.ChatMessage) error) {
+	msg, err := cr.changeMessage(id, change)
+	switch {
+	case errors.Is(err, errNotAuthor):
+		cr.notice(model.LogMessage{
+			Prefix:  "system",
+			Message: fmt.Sprintf("dropped a forged change of a message from %s", fingerprint(from.String())),
+		})
+	case errors.Is(err, storage.ErrNotFound), errors.Is(err, errStaleEdit), errors.Is(err, errDeletedTarget),
+		errors.Is(err, errUnknownEmoji), errors.Is(err, errTooManyEmoji), errors.Is(err, storage.ErrTooLarge):
+		logrus.WithError(err).WithField("peer", from.String()).Debug("dropped message change")
+	case err != nil:
+		cr.notice(model.LogMessage{Prefix: "system", Message: "could not change message - " + err.Error()})
+	default:
+		select {
+		case cr.Changes <- msg:
+		case <-cr.ctx.Done():
+		}
+	}
+}
+
+// verifySynced replaces the signed fields of a stored copy of the message
+// that was synced from a peer with those of the message received through the
+// topic, and reports whether there was one. Reactions are kept, as are edits
+// when the synced copy named the same sender, as both were signed by their
+// own senders.
+func (cr *ChatRoom) verifySynced(cm model.ChatMessage) bool {
+	msg, err := cr.changeMessage(cm.ID, func(msg *model.ChatMessage) error {
+		if !msg.Synced {
+			return errNotSynced
+		}
+		if msg.SenderID != cm.SenderID || msg.EditedAt.IsZero() {
+			msg.Message = cm.Message
+			msg.EditedAt = cm.EditedAt
+			msg.Deleted = cm.Deleted
+		}
+		msg.SenderID = cm.SenderID
+		msg.SenderName = cm.SenderName
+		msg.CreatedAt = cm.CreatedAt
+		msg.ReplyTo = cm.ReplyTo
+		msg.File = cm.File
+		msg.Synced = false
+		return nil
+	})
+	if err != nil {
+		return false
+	}
+	select {
+	case cr.Changes <- msg:
+	case <-cr.ctx.Done():
+	}
+	return true
+}
+
+// changeMessage applies the change to the stored message and stores the
+// result. Changes are made one at a time so that none of them is lost.
+func (cr *ChatRoom) changeMessage(id string, change func(msg *model.ChatMessage) error) (model.ChatMessage, error) {
+	cr.changeMu.Lock()
+	defer cr.changeMu.Unlock()
+
+	msg, err := cr.storage.Get(id)
+	if err != nil {
+		return model.ChatMessage{}, fmt.Errorf("get message %s: %w", id, err)
+	}
+	if err = change(&msg); err != nil {
+		return model.ChatMessage{}, err
+	}
+	if err = cr.storage.Update(msg); err != nil {
+		return model.ChatMessage{}, fmt.Errorf("update message: %w", err)
+	}
+	return msg, nil
+}
+
+// ownMessage returns the selected message, or the latest own one when none
+// is selected, provided it can still be changed.
+func (ui *UI) ownMessage() (model.ChatMessage, bool) {
+	own := ui.ChatRoom.peerId.String()
+	for i := len(ui.scrollback) - 1; i >= 0; i-- {
+		msg := ui.scrollback[i]
+		if ui.selected == "" && msg.SenderID != own || ui.selected != "" && msg.ID != ui.selected {
+			continue
+		}
+		switch {
+		case msg.SenderID != own:
+			ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "only your own messages can be changed"})
+			return model.ChatMessage{}, false
+		case msg.Deleted:
+			ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "the message has been deleted"})
+			return model.ChatMessage{}, false
+		}
+		return msg, true
+	}
+	ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "no message of yours to change"})
+	return model.ChatMessage{}, false
+}
+
+// startEdit puts the text of the selected own message into the input box,
+// sending it replaces the message.
+func (ui *UI) startEdit() {
+	msg, ok := ui.ownMessage()
+	if !ok {
+		return
+	}
+	if ui.replyTo != nil {
+		ui.cancelReply()
+	}
+	ui.editing = &msg
+	ui.inputBox.SetText(msg.Message, true)
+	ui.inputBox.SetTitle(fmt.Sprintf("%s > edit %s ", ui.UserName, tview.Escape(snippet(msg.Message, ""))))
+	ui.TerminalApp.SetFocus(ui.inputBox)
+}
+
+// takeEdit returns the message being edited with its new text and leaves edit mode.
+func (ui *UI) takeEdit(text string) (model.ChatMessage, bool) {
+	if ui.editing == nil {
+		return model.ChatMessage{}, false
+	}
+	msg := *ui.editing
+	ui.editing = nil
+	ui.inputBox.SetTitle(ui.UserName + " > ")
+	msg.Message = text
+	msg.EditedAt = time.Now()
+	return msg, true
+}
+
+func (ui *UI) cancelEdit() {
+	ui.editing = nil
+	ui.inputBox.SetText("", true)
+	ui.inputBox.SetTitle(ui.UserName + " > ")
+}
+
+// changeOwn changes the selected own message, deleting it when text is
+// empty, and returns the changed message to publish.
+func (ui *UI) changeOwn(text string) (model.ChatMessage, bool) {
+	msg, ok := ui.ownMessage()
+	if !ok {
+		return model.ChatMessage{}, false
+	}
+	msg.Message = text
+	msg.EditedAt = time.Now()
+	msg.Deleted = text == ""
+	ui.updateMessage(msg)
+	return msg, true
+}
+
+// updateMessage shows a changed message in place of the one in the message box.
+func (ui *UI) updateMessage(msg model.ChatMessage) {
+	for i := range ui.scrollback {
+		if ui.scrollback[i].ID != msg.ID {
+			continue
+		}
+		ui.scrollback[i] = msg
+		row, _ := ui.messageBox.GetScrollOffset()
+		ui.renderScrollback()
+		if ui.pinned {
+			ui.messageBox.ScrollTo(row, 0)
+		}
+		return
+	}
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestApplyEdit(t *testing.T) {
+	author, other := peer.ID("author"), peer.ID("other")
+	sent := time.Now()
+	msg := model.ChatMessage{SenderID: author.String(), Message: "hi", CreatedAt: sent, Reactions: map[string][]string{"👍": {other.String()}}}
+	edited := msg
+	edited.Message, edited.EditedAt = "hello", sent.Add(time.Minute)
+	later := edited
+	later.Message, later.EditedAt = "hey", sent.Add(2*time.Minute)
+	deleted := msg
+	deleted.Message, deleted.EditedAt, deleted.Deleted, deleted.Reactions = "", sent.Add(time.Minute), true, nil
+	edit := func(from peer.ID, text string, at time.Time) model.Edit {
+		return model.Edit{SenderID: from.String(), Message: text, EditedAt: at}
+	}
+
+	tests := []struct {
+		desc string
+		kind model.Kind
+		edit model.Edit
+		from peer.ID
+		msg  model.ChatMessage
+		want model.ChatMessage
+		err  error
+	}{
+		{"edit", model.KindEdit, edit(author, "hello", sent.Add(time.Minute)), author, msg, edited, nil},
+		{"delete", model.KindDelete, edit(author, "", sent.Add(time.Minute)), author, msg, deleted, nil},
+		{"later edit", model.KindEdit, edit(author, "hey", sent.Add(2*time.Minute)), author, edited, later, nil},
+		{"earlier edit", model.KindEdit, edit(author, "hey", sent), author, edited, edited, errStaleEdit},
+		{"same edit again", model.KindEdit, edit(author, "hello", sent.Add(time.Minute)), author, edited, edited, errStaleEdit},
+		{"edit of a deleted message", model.KindEdit, edit(author, "hey", sent.Add(2*time.Minute)), author, deleted, deleted, errStaleEdit},
+		{"edit by another peer", model.KindEdit, edit(other, "hey", sent.Add(time.Minute)), other, msg, msg, errNotAuthor},
+		{"edit naming the author", model.KindEdit, edit(author, "hey", sent.Add(time.Minute)), other, msg, msg, errNotAuthor},
+	}
+	for _, tt := range tests {
+		got := tt.msg
+		err := applyEdit(tt.kind, tt.edit, tt.from, &got)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: applyEdit error = %v, want %v", tt.desc, err, tt.err)
+			continue
+		}
+		if got.Message != tt.want.Message || !got.EditedAt.Equal(tt.want.EditedAt) || got.Deleted != tt.want.Deleted || len(got.Reactions) != len(tt.want.Reactions) {
+			t.Errorf("%s: applyEdit = %+v, want %+v", tt.desc, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,648 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/rivo/tview"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	fileProtocol = protocol.ID("/peerchat/file/1.0.0")
+	// fileTimeout bounds opening a stream and every chunk read or written.
+	fileTimeout   = 30 * time.Second
+	fileChunkSize = 64 << 10
+	// fileRetries is how often a broken download is resumed before giving up.
+	fileRetries    = 3
+	fileRetryWait  = 2 * time.Second
+	maxUploads     = 4
+	partExtension  = ".part"
+	fileHashPrefix = 8
+)
+
+var (
+	errFileRefused    = errors.New("file request refused")
+	errHashMismatch   = errors.New("content does not match the offered hash")
+	errAlreadyFetched = errors.New("the file is already being downloaded")
+)
+
+// Files offers local files to peers and downloads the files they offer over
+// a dedicated stream protocol. Offers are served until the process exits,
+// downloads are written next to their final name with a .part extension
+// so that an interrupted download is resumed where it stopped.
+type Files struct {
+	Host *P2P
+	// Dir is the directory downloads are saved in.
+	Dir string
+	// Finished receives every download once it is saved or has failed.
+	Finished chan Transfer
+
+	mu      sync.Mutex
+	offers  map[string]localOffer
+	running map[string]*download
+	uploads chan struct{}
+}
+
+// localOffer is a file offered by this peer. Peer restricts it to the
+// peer of a direct conversation, anyone knowing the offer ID may fetch
+// room offers.
+type localOffer struct {
+	path    string
+	offer   model.FileOffer
+	peer    peer.ID
+	modTime time.Time
+}
+
+// Transfer is the state of a download.
+type Transfer struct {
+	ID    string
+	From  peer.ID
+	Offer model.FileOffer
+	// Received counts the bytes saved so far including those of earlier attempts.
+	Received int64
+	// Rate is the average speed of this attempt in bytes per second.
+	Rate float64
+	// Path is where the file was saved, Err why it was not.
+	Path string
+	Err  error
+}
+
+type download struct {
+	id       string
+	from     peer.ID
+	offer    model.FileOffer
+	received atomic.Int64
+	resumed  atomic.Int64
+	started  time.Time
+}
+
+func NewFiles(p2phost *P2P, dir string) *Files {
+	f := &Files{
+		Host:     p2phost,
+		Dir:      dir,
+		Finished: make(chan Transfer),
+		offers:   make(map[string]localOffer),
+		running:  make(map[string]*download),
+		uploads:  make(chan struct{}, maxUploads),
+	}
+	p2phost.Host.SetStreamHandler(fileProtocol, f.handleStream)
+	return f
+}
+
+// Offer hashes the file and serves it under the offer ID, to the peer only
+// when one is given.
+func (f *Files) Offer(id string, path string, to peer.ID) (model.FileOffer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return model.FileOffer{}, fmt.Errorf("open file: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return model.FileOffer{}, fmt.Errorf("stat file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return model.FileOffer{}, fmt.Errorf("%s is not a regular file", path)
+	}
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return model.FileOffer{}, fmt.Errorf("hash file: %w", err)
+	}
+
+	offer := model.FileOffer{
+		Name: filepath.Base(path),
+		Size: info.Size(),
+		Hash: hex.EncodeToString(hash.Sum(nil)),
+	}
+	f.mu.Lock()
+	f.offers[id] = localOffer{path: path, offer: offer, peer: to, modTime: info.ModTime()}
+	f.mu.Unlock()
+	return offer, nil
+}
+
+// Accept starts downloading the offer from its sender. Progress is read
+// with Transfers and the result arrives on Finished.
+func (f *Files) Accept(id string, from peer.ID, offer model.FileOffer) error {
+	if _, err := downloadName(offer.Name); err != nil {
+		return err
+	}
+	if err := checkHash(offer.Hash); err != nil {
+		return err
+	}
+	if offer.Size < 0 {
+		return fmt.Errorf("invalid size %d", offer.Size)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.running[id]; ok {
+		return errAlreadyFetched
+	}
+	d := &download{id: id, from: from, offer: offer, started: time.Now()}
+	f.running[id] = d
+	go f.download(d)
+	return nil
+}
+
+// Transfers returns the running downloads ordered by start.
+func (f *Files) Transfers() []Transfer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	transfers := make([]Transfer, 0, len(f.running))
+	for _, d := range f.running {
+		transfers = append(transfers, d.transfer())
+	}
+	slices.SortFunc(transfers, func(a, b Transfer) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return transfers
+}
+
+func (f *Files) Close() {
+	f.Host.Host.RemoveStreamHandler(fileProtocol)
+}
+
+func (d *download) transfer() Transfer {
+	t := Transfer{ID: d.id, From: d.from, Offer: d.offer, Received: d.received.Load()}
+	if elapsed := time.Since(d.started).Seconds(); elapsed > 0 {
+		t.Rate = float64(t.Received-d.resumed.Load()) / elapsed
+	}
+	return t
+}
+
+// download fetches the offer, resuming it after broken streams, verifies
+// its hash and moves it to its final name.
+func (f *Files) download(d *download) {
+	part, err := f.partPath(d.offer)
+	for attempt := 0; err == nil; attempt++ {
+		err = f.fetch(d, part)
+		if err == nil || errors.Is(err, errFileRefused) || attempt+1 >= fileRetries {
+			break
+		}
+		logrus.WithError(err).WithField("file", d.offer.Name).Debug("download interrupted, resuming")
+		select {
+		case <-time.After(fileRetryWait):
+		case <-f.Host.Ctx.Done():
+			err = f.Host.Ctx.Err()
+		}
+	}
+
+	t := d.transfer()
+	if err == nil {
+		t.Path, err = f.finish(d.offer, part)
+	}
+	t.Err = err
+
+	f.mu.Lock()
+	delete(f.running, d.id)
+	f.mu.Unlock()
+	select {
+	case f.Finished <- t:
+	case <-f.Host.Ctx.Done():
+	}
+}
+
+// fetch requests the content after what the part file holds already and
+// appends it.
+func (f *Files) fetch(d *download, part string) error {
+	file, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open download: %w", err)
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("seek download: %w", err)
+	}
+	if offset > d.offer.Size {
+		// not the file offered, start over
+		if err = file.Truncate(0); err != nil {
+			return fmt.Errorf("truncate download: %w", err)
+		}
+		if offset, err = file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("seek download: %w", err)
+		}
+	}
+	if d.received.Load() == 0 {
+		d.resumed.Store(offset)
+	}
+	d.received.Store(offset)
+	if offset == d.offer.Size {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(f.Host.Ctx, fileTimeout)
+	defer cancel()
+	s, err := f.Host.Host.NewStream(ctx, d.from, fileProtocol)
+	if err != nil {
+		return fmt.Errorf("open stream: %w", err)
+	}
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(fileTimeout))
+
+	data, err := model.Wrap(model.KindFileRequest, model.NewMessageID(), model.FileRequest{Offer: d.id, Offset: offset})
+	if err != nil {
+		_ = s.Reset()
+		return fmt.Errorf("wrap request: %w", err)
+	}
+	if _, err = s.Write(append(data, '\n')); err != nil {
+		_ = s.Reset()
+		return fmt.Errorf("write request: %w", err)
+	}
+	_ = s.CloseWrite()
+
+	// the content follows the header on the same reader
+	r := bufio.NewReader(s)
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		_ = s.Reset()
+		return fmt.Errorf("read header: %w", err)
+	}
+	env, err := model.Unwrap(line)
+	if err != nil || env.Kind != model.KindFile {
+		_ = s.Reset()
+		return fmt.Errorf("read header: %w", model.ErrMalformed)
+	}
+	var header model.FileHeader
+	if err = env.Decode(&header); err != nil {
+		_ = s.Reset()
+		return err
+	}
+	if header.Refused != "" {
+		return fmt.Errorf("%w: %s", errFileRefused, header.Refused)
+	}
+	if header.Size != d.offer.Size {
+		_ = s.Reset()
+		return fmt.Errorf("%w: the file has changed", errFileRefused)
+	}
+
+	content := io.LimitReader(r, d.offer.Size-offset)
+	buf := make([]byte, fileChunkSize)
+	for {
+		_ = s.SetReadDeadline(time.Now().Add(fileTimeout))
+		n, err := content.Read(buf)
+		if n > 0 {
+			if _, werr := file.Write(buf[:n]); werr != nil {
+				_ = s.Reset()
+				return fmt.Errorf("write download: %w", werr)
+			}
+			d.received.Add(int64(n))
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			_ = s.Reset()
+			return fmt.Errorf("read content: %w", err)
+		}
+	}
+	if d.received.Load() != d.offer.Size {
+		return fmt.Errorf("read content: %w", io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// finish checks the downloaded content against the offered hash and moves
+// it to its final name, one not taken yet.
+func (f *Files) finish(offer model.FileOffer, part string) (string, error) {
+	file, err := os.Open(part)
+	if err != nil {
+		return "", fmt.Errorf("open download: %w", err)
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	_ = file.Close()
+	if err != nil {
+		return "", fmt.Errorf("hash download: %w", err)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != offer.Hash {
+		_ = os.Remove(part)
+		return "", errHashMismatch
+	}
+
+	name, _ := downloadName(offer.Name)
+	ext := filepath.Ext(name)
+	path := filepath.Join(f.Dir, name)
+	for i := 1; ; i++ {
+		if _, err = os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		path = filepath.Join(f.Dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+	if err = os.Rename(part, path); err != nil {
+		return "", fmt.Errorf("save download: %w", err)
+	}
+	return path, nil
+}
+
+// partPath returns the file a download is written to until it is complete.
+// The hash is part of its name so that different files of the same name
+// are not resumed from each other.
+func (f *Files) partPath(offer model.FileOffer) (string, error) {
+	name, err := downloadName(offer.Name)
+	if err != nil {
+		return "", err
+	}
+	if err = checkHash(offer.Hash); err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(f.Dir, 0755); err != nil {
+		return "", fmt.Errorf("mkdir: %w", err)
+	}
+	return filepath.Join(f.Dir, fmt.Sprintf(".%s.%s%s", name, offer.Hash[:fileHashPrefix], partExtension)), nil
+}
+
+// downloadName rejects offered names that would leave the downloads directory.
+func downloadName(name string) (string, error) {
+	base := filepath.Base(name)
+	if base != name || name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return name, nil
+}
+
+// checkHash rejects offered hashes that are not a hex encoded SHA-256 sum
+// as Offer writes them, as a prefix of the hash is part of the file name.
+func checkHash(hash string) error {
+	if len(hash) != 2*sha256.Size || strings.Trim(hash, "0123456789abcdef") != "" {
+		return fmt.Errorf("invalid hash %q", hash)
+	}
+	return nil
+}
+
+func (f *Files) handleStream(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+	_ = s.SetDeadline(time.Now().Add(fileTimeout))
+
+	env, err := readEnvelope(s, maxDirectSize)
+	if err != nil || env.Kind != model.KindFileRequest {
+		logrus.WithError(err).WithField("peer", remote.String()).Debug("invalid file request")
+		_ = s.Reset()
+		return
+	}
+	var req model.FileRequest
+	if err = env.Decode(&req); err != nil {
+		logrus.WithError(err).WithField("peer", remote.String()).Debug("invalid file request")
+		_ = s.Reset()
+		return
+	}
+
+	select {
+	case f.uploads <- struct{}{}:
+		defer func() { <-f.uploads }()
+	default:
+		f.writeHeader(s, env.ID, model.FileHeader{Refused: "too many downloads, try again later"})
+		return
+	}
+	file, size, refused := f.open(remote, req)
+	if refused != "" {
+		logrus.WithFields(logrus.Fields{"peer": remote.String(), "reason": refused}).Debug("refused file request")
+		f.writeHeader(s, env.ID, model.FileHeader{Refused: refused})
+		return
+	}
+	defer file.Close()
+	if !f.writeHeader(s, env.ID, model.FileHeader{Size: size}) {
+		return
+	}
+
+	buf := make([]byte, fileChunkSize)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			_ = s.SetWriteDeadline(time.Now().Add(fileTimeout))
+			if _, werr := s.Write(buf[:n]); werr != nil {
+				_ = s.Reset()
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			logrus.WithError(err).Warn("failed to read offered file")
+			_ = s.Reset()
+			return
+		}
+	}
+}
+
+// open returns the offered file positioned at the requested offset, or why
+// the request is refused.
+func (f *Files) open(remote peer.ID, req model.FileRequest) (*os.File, int64, string) {
+	f.mu.Lock()
+	local, ok := f.offers[req.Offer]
+	f.mu.Unlock()
+	if !ok || local.peer != "" && local.peer != remote {
+		return nil, 0, "no such offer"
+	}
+	file, err := os.Open(local.path)
+	if err != nil {
+		return nil, 0, "the file is no longer available"
+	}
+	info, err := file.Stat()
+	if err != nil || info.Size() != local.offer.Size || !info.ModTime().Equal(local.modTime) {
+		_ = file.Close()
+		return nil, 0, "the file has changed since it was offered"
+	}
+	if req.Offset < 0 || req.Offset > info.Size() {
+		_ = file.Close()
+		return nil, 0, "invalid offset"
+	}
+	if _, err = file.Seek(req.Offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, 0, "the file is no longer available"
+	}
+	return file, info.Size(), ""
+}
+
+func (f *Files) writeHeader(s network.Stream, id string, header model.FileHeader) bool {
+	data, err := model.Wrap(model.KindFile, id, header)
+	if err != nil {
+		_ = s.Reset()
+		return false
+	}
+	if _, err = s.Write(append(data, '\n')); err != nil {
+		_ = s.Reset()
+		return false
+	}
+	return true
+}
+
+// sendFile offers the file in the open direct conversation, or in the room.
+func (ui *UI) sendFile(cr *ChatRoom, path string) {
+	if ui.Files == nil {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "file transfer is not available when attached to a daemon"}
+		return
+	}
+	if path == "" {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "missing file for command"}
+		return
+	}
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(homeDir, strings.TrimPrefix(path, "~"))
+		}
+	}
+	conversation := make(chan peer.ID, 1)
+	ui.TerminalApp.QueueUpdateDraw(func() {
+		conversation <- ui.directPeer
+	})
+	to := <-conversation
+
+	id := model.NewMessageID()
+	offer, err := ui.Files.Offer(id, path, to)
+	if err != nil {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "could not offer file - " + err.Error()}
+		return
+	}
+	m := model.ChatMessage{
+		ID:         id,
+		Message:    fmt.Sprintf("offers %s (%s)", offer.Name, formatSize(offer.Size)),
+		SenderID:   cr.peerId.String(),
+		SenderName: cr.UserName,
+		CreatedAt:  time.Now(),
+		File:       &offer,
+	}
+	if to != "" {
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.writeMessage(ui.directBox, m, ui.theme.Own)
+		})
+		if err = ui.Direct.Send(to, m); err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("message was not delivered - %s", err)}
+		}
+		return
+	}
+	ui.TerminalApp.QueueUpdateDraw(func() {
+		if ui.ChatRoom != cr {
+			return
+		}
+		ui.pinned = false
+		if ui.newer {
+			ui.loadLatest(m)
+			return
+		}
+		ui.displayMessage(m)
+	})
+	cr.Outbound <- m
+}
+
+// acceptFile downloads the offer whose ID starts with the prefix, the
+// latest offer when none is given.
+func (ui *UI) acceptFile(prefix string) {
+	if ui.Files == nil {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "file transfer is not available when attached to a daemon"}
+		return
+	}
+	found := make(chan model.ChatMessage, 1)
+	ui.TerminalApp.QueueUpdateDraw(func() {
+		defer close(found)
+		msg, err := ui.findOffer(prefix)
+		if err != nil {
+			ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: err.Error()})
+			return
+		}
+		found <- msg
+	})
+	msg, ok := <-found
+	if !ok {
+		return
+	}
+	from, err := peer.Decode(msg.SenderID)
+	if err != nil {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "invalid sender of the offer"}
+		return
+	}
+	if err = ui.Files.Accept(msg.ID, from, *msg.File); err != nil {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "could not accept file - " + err.Error()}
+		return
+	}
+	ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("downloading %s from %s", msg.File.Name, msg.SenderName)}
+}
+
+// recordOffer remembers a file offered by a peer so that it can be accepted.
+func (ui *UI) recordOffer(msg model.ChatMessage) {
+	if msg.File == nil || msg.Deleted || ui.isOwn(msg) {
+		return
+	}
+	ui.offers[msg.ID] = msg
+	if latest, ok := ui.offers[ui.lastOffer]; !ok || !msg.CreatedAt.Before(latest.CreatedAt) {
+		ui.lastOffer = msg.ID
+	}
+}
+
+func (ui *UI) findOffer(prefix string) (model.ChatMessage, error) {
+	if prefix == "" {
+		if msg, ok := ui.offers[ui.lastOffer]; ok {
+			return msg, nil
+		}
+		return model.ChatMessage{}, errors.New("no file offered")
+	}
+	var found []model.ChatMessage
+	for id, msg := range ui.offers {
+		if strings.HasPrefix(id, prefix) {
+			found = append(found, msg)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return model.ChatMessage{}, fmt.Errorf("no file offer %s", prefix)
+	case 1:
+		return found[0], nil
+	default:
+		return model.ChatMessage{}, fmt.Errorf("offer ID %s is ambiguous", prefix)
+	}
+}
+
+// displayTransfer tells where a download was saved or why it failed.
+func (ui *UI) displayTransfer(t Transfer) {
+	message := fmt.Sprintf("saved %s to %s", t.Offer.Name, t.Path)
+	if t.Err != nil {
+		message = fmt.Sprintf("could not download %s - %s", t.Offer.Name, t.Err)
+	}
+	ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: message})
+}
+
+// transferText shows the progress of the running downloads.
+func transferText(transfers []Transfer) string {
+	parts := make([]string, 0, len(transfers))
+	for _, t := range transfers {
+		percent := int64(100)
+		if t.Offer.Size > 0 {
+			percent = t.Received * 100 / t.Offer.Size
+		}
+		parts = append(parts, fmt.Sprintf("⇣ %s %d%% %s/s", tview.Escape(t.Offer.Name), percent, formatSize(int64(t.Rate))))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatSize renders a byte count for people.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
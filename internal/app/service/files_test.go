@@ -0,0 +1,60 @@
+package service
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+)
+
+func TestDownloadName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"report.pdf", true},
+		{".bashrc", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../report.pdf", false},
+		{"dir/report.pdf", false},
+		{`dir\report.pdf`, false},
+		{"/etc/passwd", false},
+	}
+	for _, tt := range tests {
+		_, err := downloadName(tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("downloadName(%q) error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestPartPath(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	tests := []struct {
+		desc string
+		hash string
+		ok   bool
+	}{
+		{"sha-256 sum", hash, true},
+		{"traversal in the prefix", "/../../x" + hash[8:], false},
+		{"upper case", strings.ToUpper(hash), false},
+		{"short", hash[:8], false},
+		{"long", hash + "00", false},
+		{"empty", "", false},
+	}
+	f := &Files{Dir: t.TempDir()}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			part, err := f.partPath(model.FileOffer{Name: "report.pdf", Hash: tt.hash})
+			if (err == nil) != tt.ok {
+				t.Fatalf("partPath error = %v, want ok %v", err, tt.ok)
+			}
+			if err == nil && filepath.Dir(part) != f.Dir {
+				t.Fatalf("partPath = %q, outside of %q", part, f.Dir)
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	historyProtocol = protocol.ID("/peerchat/history/1.0.0")
+	historyTimeout  = 15 * time.Second
+	// historyPeerWait is how long a newly joined room waits for topic peers to ask.
+	historyPeerWait  = 10 * time.Second
+	historyPeerPoll  = 500 * time.Millisecond
+	historySyncPeers = 3
+	historyClockSkew = time.Minute
+	maxHistorySize   = 8 << 20
+
+	defaultHistoryLimit  = 500
+	defaultHistoryMaxAge = 7 * 24 * time.Hour
+	defaultHistoryRate   = 6
+)
+
+var errHistoryRefused = errors.New("history request refused")
+
+// HistoryOptions controls how room history is synced with other peers.
+type HistoryOptions struct {
+	// Refuse answers every history request from other peers with a refusal.
+	Refuse bool
+	// Limit is the most messages requested from or served to a peer at once.
+	Limit int
+	// MaxAge bounds how far back a newly joined room is synced.
+	MaxAge time.Duration
+	// RatePerMinute is how many history requests a single peer may make per minute.
+	RatePerMinute int
+}
+
+// historyService answers history requests for the rooms joined on this host.
+// Requests are only served to peers subscribed to the room topic, and for
+// encrypted rooms the messages are sealed with the room key.
+type historyService struct {
+	host *P2P
+	opts HistoryOptions
+
+	mu       sync.Mutex
+	rooms    map[string]*ChatRoom
+	requests map[peer.ID][]time.Time
+}
+
+func newHistoryService(p2phost *P2P, opts HistoryOptions) *historyService {
+	if opts.Limit <= 0 {
+		opts.Limit = defaultHistoryLimit
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = defaultHistoryMaxAge
+	}
+	if opts.RatePerMinute <= 0 {
+		opts.RatePerMinute = defaultHistoryRate
+	}
+	h := &historyService{
+		host:     p2phost,
+		opts:     opts,
+		rooms:    make(map[string]*ChatRoom),
+		requests: make(map[peer.ID][]time.Time),
+	}
+	p2phost.Host.SetStreamHandler(historyProtocol, h.handleStream)
+	return h
+}
+
+func (h *historyService) register(cr *ChatRoom) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rooms[cr.topic.String()] = cr
+}
+
+func (h *historyService) unregister(cr *ChatRoom) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rooms[cr.topic.String()] == cr {
+		delete(h.rooms, cr.topic.String())
+	}
+}
+
+func (h *historyService) room(topic string) *ChatRoom {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rooms[topic]
+}
+
+// allow reports whether the peer is within its request rate.
+func (h *historyService) allow(p peer.ID) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cutoff := time.Now().Add(-time.Minute)
+	for id, times := range h.requests {
+		times = slices.DeleteFunc(times, func(t time.Time) bool { return t.Before(cutoff) })
+		if len(times) == 0 {
+			delete(h.requests, id)
+		} else {
+			h.requests[id] = times
+		}
+	}
+	if len(h.requests[p]) >= h.opts.RatePerMinute {
+		return false
+	}
+	h.requests[p] = append(h.requests[p], time.Now())
+	return true
+}
+
+func (h *historyService) handleStream(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+	_ = s.SetDeadline(time.Now().Add(historyTimeout))
+
+	env, err := readEnvelope(s, maxDirectSize)
+	if err != nil || env.Kind != model.KindHistoryRequest {
+		logrus.WithError(err).WithField("peer", remote.String()).Debug("invalid history request")
+		_ = s.Reset()
+		return
+	}
+	var req model.HistoryRequest
+	if err = env.Decode(&req); err != nil {
+		logrus.WithError(err).WithField("peer", remote.String()).Debug("invalid history request")
+		_ = s.Reset()
+		return
+	}
+
+	resp := h.answer(remote, req)
+	if resp.Refused != "" {
+		logrus.WithFields(logrus.Fields{"peer": remote.String(), "reason": resp.Refused}).Debug("refused history request")
+	}
+	data, err := model.Wrap(model.KindHistory, env.ID, resp)
+	if err != nil {
+		_ = s.Reset()
+		return
+	}
+	if _, err = s.Write(append(data, '\n')); err != nil {
+		_ = s.Reset()
+	}
+}
+
+func (h *historyService) answer(remote peer.ID, req model.HistoryRequest) model.HistoryResponse {
+	if h.opts.Refuse {
+		return model.HistoryResponse{Refused: "history sharing is disabled"}
+	}
+	if !h.allow(remote) {
+		return model.HistoryResponse{Refused: "rate limited"}
+	}
+	cr := h.room(req.Topic)
+	if cr == nil || !slices.Contains(cr.topic.ListPeers(), remote) {
+		return model.HistoryResponse{Refused: "not a member of the room"}
+	}
+
+	limit := h.opts.Limit
+	if req.Limit > 0 && req.Limit < limit {
+		limit = req.Limit
+	}
+	messages, err := cr.storage.Range(storage.Query{Since: req.Since, Limit: limit})
+	if err != nil {
+		logrus.WithError(err).Warn("failed to load history for peer")
+		return model.HistoryResponse{Refused: "history unavailable"}
+	}
+
+	if cr.crypt == nil {
+		return model.HistoryResponse{Messages: messages}
+	}
+	data, err := json.Marshal(messages)
+	if err == nil {
+		data, err = cr.crypt.Seal(data)
+	}
+	if err != nil {
+		return model.HistoryResponse{Refused: "history unavailable"}
+	}
+	return model.HistoryResponse{Sealed: data}
+}
+
+// request asks the peer for the room history.
+func (h *historyService) request(ctx context.Context, p peer.ID, req model.HistoryRequest) (model.HistoryResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, historyTimeout)
+	defer cancel()
+
+	s, err := h.host.Host.NewStream(ctx, p, historyProtocol)
+	if err != nil {
+		return model.HistoryResponse{}, fmt.Errorf("open stream: %w", err)
+	}
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(historyTimeout))
+
+	id := model.NewMessageID()
+	data, err := model.Wrap(model.KindHistoryRequest, id, req)
+	if err != nil {
+		_ = s.Reset()
+		return model.HistoryResponse{}, fmt.Errorf("wrap request: %w", err)
+	}
+	if _, err = s.Write(append(data, '\n')); err != nil {
+		_ = s.Reset()
+		return model.HistoryResponse{}, fmt.Errorf("write request: %w", err)
+	}
+	_ = s.CloseWrite()
+
+	env, err := readEnvelope(s, maxHistorySize)
+	if err != nil {
+		_ = s.Reset()
+		return model.HistoryResponse{}, fmt.Errorf("read history: %w", err)
+	}
+	if env.Kind != model.KindHistory || env.ID != id {
+		return model.HistoryResponse{}, model.ErrMalformed
+	}
+	var resp model.HistoryResponse
+	if err = env.Decode(&resp); err != nil {
+		return model.HistoryResponse{}, err
+	}
+	if resp.Refused != "" {
+		return model.HistoryResponse{}, fmt.Errorf("%w: %s", errHistoryRefused, resp.Refused)
+	}
+	return resp, nil
+}
+
+// syncHistory asks a few room peers for the messages stored after since and
+// merges them into the room log by message ID, marked as synced.
+func (cr *ChatRoom) syncHistory(since time.Time) {
+	history := cr.Host.history
+	if limit := time.Now().Add(-history.opts.MaxAge); since.Before(limit) {
+		since = limit
+	}
+	req := model.HistoryRequest{
+		Topic: cr.topic.String(),
+		Since: since,
+		Limit: history.opts.Limit,
+	}
+
+	peers := cr.waitTopicPeers()
+	if len(peers) > historySyncPeers {
+		peers = peers[:historySyncPeers]
+	}
+
+	added := 0
+	for _, p := range peers {
+		resp, err := history.request(cr.ctx, p, req)
+		if err != nil {
+			logrus.WithError(err).WithField("peer", p.String()).Debug("history sync failed")
+			continue
+		}
+		messages, err := cr.openHistory(resp)
+		if err != nil {
+			logrus.WithError(err).WithField("peer", p.String()).Debug("history sync failed")
+			continue
+		}
+		messages = slices.DeleteFunc(messages, func(msg model.ChatMessage) bool {
+			return cr.isBanned(msg.SenderID) || cr.Host.isIgnored(msg.SenderID)
+		})
+		n, err := cr.storage.Merge(messages)
+		if err != nil {
+			logrus.WithError(err).Warn("failed to store synced history")
+		}
+		added += n
+	}
+	if added == 0 {
+		return
+	}
+
+	select {
+	case cr.Synced <- added:
+	case <-cr.ctx.Done():
+	}
+}
+
+// waitTopicPeers waits until other peers show up in the room topic.
+func (cr *ChatRoom) waitTopicPeers() []peer.ID {
+	deadline := time.NewTimer(historyPeerWait)
+	defer deadline.Stop()
+	ticker := time.NewTicker(historyPeerPoll)
+	defer ticker.Stop()
+
+	for {
+		if peers := cr.topic.ListPeers(); len(peers) > 0 {
+			return peers
+		}
+		select {
+		case <-cr.ctx.Done():
+			return nil
+		case <-deadline.C:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// openHistory returns the well-formed messages of a history response. They
+// are marked as synced, as any peer may answer with messages of others.
+// Messages larger than the room would carry are dropped.
+func (cr *ChatRoom) openHistory(resp model.HistoryResponse) ([]model.ChatMessage, error) {
+	messages := resp.Messages
+	if cr.crypt != nil {
+		data, err := cr.crypt.Open(resp.Sealed)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("%w: %v", model.ErrMalformed, err)
+		}
+	}
+
+	latest := time.Now().Add(historyClockSkew)
+	valid := make([]model.ChatMessage, 0, len(messages))
+	for _, msg := range messages {
+		if msg.ID == "" || msg.CreatedAt.After(latest) {
+			continue
+		}
+		if _, err := peer.Decode(msg.SenderID); err != nil {
+			continue
+		}
+		if data, err := model.Wrap(model.KindChat, msg.ID, msg); err != nil || len(data) > maxRoomMessageSize {
+			continue
+		}
+		msg.Synced = true
+		valid = append(valid, msg)
+	}
+	if limit := cr.Host.history.opts.Limit; len(valid) > limit {
+		valid = valid[len(valid)-limit:]
+	}
+	return valid, nil
+}
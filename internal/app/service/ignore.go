@@ -0,0 +1,235 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+)
+
+var errIgnoreSelf = errors.New("cannot ignore yourself")
+
+// ignoreList holds the peers the user ignores, mapping their IDs to the
+// name they had when ignored. Their room messages, presence and direct
+// messages are dropped as they arrive, and with block set connections to
+// and from them are refused as well.
+type ignoreList struct {
+	mu    sync.Mutex
+	peers map[string]string
+	block bool
+}
+
+// loadIgnoreList reads the stored ignored peers, a broken file leaves none
+// ignored.
+func loadIgnoreList(block bool) *ignoreList {
+	peers, err := storage.LoadIgnored()
+	if err != nil {
+		logrus.WithError(err).Warn("failed to load ignored peers")
+		peers = make(map[string]string)
+	}
+	return &ignoreList{peers: peers, block: block}
+}
+
+func (l *ignoreList) has(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.peers[id]
+	return ok
+}
+
+// set adds the peer to the list, or removes it, and saves the list.
+func (l *ignoreList) set(id, name string, ignored bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	peers := maps.Clone(l.peers)
+	if ignored {
+		peers[id] = name
+	} else {
+		delete(peers, id)
+	}
+	if err := storage.SaveIgnored(peers); err != nil {
+		return err
+	}
+	l.peers = peers
+	return nil
+}
+
+// ignoreGater refuses connections with ignored peers. Inbound connections
+// are refused once the handshake revealed the remote peer.
+type ignoreGater struct {
+	list *ignoreList
+}
+
+func (g ignoreGater) InterceptPeerDial(p peer.ID) bool {
+	return !g.list.has(p.String())
+}
+
+func (g ignoreGater) InterceptAddrDial(p peer.ID, _ multiaddr.Multiaddr) bool {
+	return !g.list.has(p.String())
+}
+
+func (g ignoreGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (g ignoreGater) InterceptSecured(_ network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	return !g.list.has(p.String())
+}
+
+func (g ignoreGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// isIgnored reports whether the user ignores the peer.
+func (p *P2P) isIgnored(id string) bool {
+	return p.ignored.has(id)
+}
+
+// Ignore hides the room messages, presence and direct messages of the peer
+// from now on and remembers it under the name. When ignored peers are
+// blocked, the connections with the peer are closed too.
+func (p *P2P) Ignore(id peer.ID, name string) error {
+	if id == p.Host.ID() {
+		return errIgnoreSelf
+	}
+	if err := p.ignored.set(id.String(), name, true); err != nil {
+		return err
+	}
+	if p.ignored.block {
+		_ = p.Host.Network().ClosePeer(id)
+	}
+	return nil
+}
+
+// Unignore shows the peer again.
+func (p *P2P) Unignore(id peer.ID) error {
+	return p.ignored.set(id.String(), "", false)
+}
+
+// Ignored returns the ignored peers, mapping their IDs to the name they had
+// when ignored.
+func (p *P2P) Ignored() map[string]string {
+	p.ignored.mu.Lock()
+	defer p.ignored.mu.Unlock()
+	return maps.Clone(p.ignored.peers)
+}
+
+// Ignore ignores the peer on this node, or on the daemon's node.
+func (cr *ChatRoom) Ignore(id peer.ID, name string) error {
+	if cr.remote != nil {
+		return cr.remote.Ignore(id, name)
+	}
+	return cr.Host.Ignore(id, name)
+}
+
+// Unignore shows the peer again on this node, or on the daemon's node.
+func (cr *ChatRoom) Unignore(id peer.ID) error {
+	if cr.remote != nil {
+		return cr.remote.Unignore(id)
+	}
+	return cr.Host.Unignore(id)
+}
+
+// Ignored returns the peers ignored on this node, or on the daemon's node.
+func (cr *ChatRoom) Ignored() (map[string]string, error) {
+	if cr.remote != nil {
+		return cr.remote.Ignored()
+	}
+	return cr.Host.Ignored(), nil
+}
+
+// ignore handles /ignore and /unignore, /ignore without a peer lists the
+// ignored peers.
+func (ui *UI) ignore(cr *ChatRoom, command, target string) {
+	if target == "" && command == "/ignore" {
+		ui.showIgnored(cr)
+		return
+	}
+	if target == "" {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "missing peer for command"}
+		return
+	}
+	id, err := ui.resolveIgnored(cr, target)
+	if err != nil {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: err.Error()}
+		return
+	}
+	name := ui.describePeer(cr, id.String())
+	if command == "/unignore" {
+		if err = cr.Unignore(id); err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "could not unignore peer - " + err.Error()}
+			return
+		}
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "no longer ignoring " + name}
+		return
+	}
+	if err = cr.Ignore(id, ui.peerName(id)); err != nil {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "could not ignore peer - " + err.Error()}
+		return
+	}
+	ui.Logs <- model.LogMessage{Prefix: "system", Message: "ignoring " + name}
+}
+
+// resolveIgnored finds a peer like resolvePeer, or among the ignored peers,
+// who are not connected when they are blocked. A name given when ignoring
+// must have been given to a single ignored peer only.
+func (ui *UI) resolveIgnored(cr *ChatRoom, target string) (peer.ID, error) {
+	peers := cr.knownPeers()
+	ignored, err := cr.Ignored()
+	if err != nil {
+		return ui.resolvePeerAmong(cr, target, peers)
+	}
+	var named []peer.ID
+	for known, name := range ignored {
+		id, err := peer.Decode(known)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, id)
+		if name == target {
+			named = append(named, id)
+		}
+	}
+	slices.Sort(peers)
+	id, err := ui.resolvePeerAmong(cr, target, slices.Compact(peers))
+	switch {
+	case err == nil || len(named) == 0:
+		return id, err
+	case len(named) > 1:
+		return "", fmt.Errorf("%d ignored peers are named %q, give their fingerprint or ID", len(named), target)
+	}
+	ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("%s is %s", target, ui.describePeer(cr, named[0].String()))}
+	return named[0], nil
+}
+
+// showIgnored lists the ignored peers.
+func (ui *UI) showIgnored(cr *ChatRoom) {
+	ignored, err := cr.Ignored()
+	if err != nil {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "could not read ignored peers - " + err.Error()}
+		return
+	}
+	if len(ignored) == 0 {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "no peers ignored"}
+		return
+	}
+	names := make([]string, 0, len(ignored))
+	for _, id := range slices.Sorted(maps.Keys(ignored)) {
+		if name := ignored[id]; name != "" {
+			names = append(names, name+"#"+fingerprint(id))
+		} else {
+			names = append(names, fingerprint(id))
+		}
+	}
+	ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("ignored peers: %s", strings.Join(names, ", "))}
+}
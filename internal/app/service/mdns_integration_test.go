@@ -0,0 +1,88 @@
+//go:build integration
+
+package service
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// TestMDNSJoinRoom runs two local hosts with mDNS discovery only, so no
+// bootstrap node or internet access is involved, and checks that a message
+// published by one of them arrives in the same room on the other.
+func TestMDNSJoinRoom(t *testing.T) {
+	alice := newMDNSHost(t)
+	bob := newMDNSHost(t)
+
+	deadline := time.Now().Add(30 * time.Second)
+	for alice.Host.Network().Connectedness(bob.Host.ID()) != network.Connected {
+		if time.Now().After(deadline) {
+			t.Fatal("hosts did not discover each other over mdns")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	aliceRoom := newTestRoom(t, alice, "alice")
+	bobRoom := newTestRoom(t, bob, "bob")
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-bobRoom.Inbound:
+			if msg.SenderID != alice.Host.ID().String() || msg.Message != "hello over lan" {
+				t.Fatalf("unexpected message: %+v", msg)
+			}
+			return
+		case <-ticker.C:
+			if time.Now().After(deadline) {
+				t.Fatal("message was not delivered")
+			}
+			// the gossipsub mesh needs a few heartbeats to form, so keep publishing
+			aliceRoom.Outbound <- model.ChatMessage{
+				ID:         model.NewMessageID(),
+				Message:    "hello over lan",
+				SenderID:   alice.Host.ID().String(),
+				SenderName: "alice",
+				CreatedAt:  time.Now(),
+			}
+		}
+	}
+}
+
+func newMDNSHost(t *testing.T) *P2P {
+	t.Helper()
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewP2P(priv, P2POptions{Discovery: DiscoveryMDNS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p.Close() })
+	return p
+}
+
+func newTestRoom(t *testing.T, p *P2P, user string) *ChatRoom {
+	t.Helper()
+
+	// separate data directories so both nodes keep their own room log
+	t.Setenv("HOME", t.TempDir())
+	room, err := NewChatRoom(p, user, "integration", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range room.Logs {
+		}
+	}()
+	t.Cleanup(room.Exit)
+	return room
+}
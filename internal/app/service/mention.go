@@ -0,0 +1,197 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Flicster/peerchat/internal/app/config"
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
+	"github.com/rivo/tview"
+	"github.com/sirupsen/logrus"
+)
+
+const notifyTimeout = 10 * time.Second
+
+// mentionIndexes returns the start and end of every @name in the text,
+// ignoring case. The name must end at a word boundary and the @ must not
+// follow a word, so that mail addresses do not count.
+func mentionIndexes(text string, name string) [][2]int {
+	if name == "" {
+		return nil
+	}
+	needle := "@" + strings.ToLower(name)
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		// lower-casing changed byte offsets, they would not fit the text
+		lower = text
+	}
+	var found [][2]int
+	for offset := 0; ; {
+		i := strings.Index(lower[offset:], needle)
+		if i < 0 {
+			return found
+		}
+		start, end := offset+i, offset+i+len(needle)
+		offset = end
+		if r, _ := utf8.DecodeLastRuneInString(text[:start]); start > 0 && isWordRune(r) {
+			continue
+		}
+		if r, _ := utf8.DecodeRuneInString(text[end:]); end < len(text) && isWordRune(r) {
+			continue
+		}
+		found = append(found, [2]int{start, end})
+	}
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-'
+}
+
+// mentionsMe reports whether the message of another peer mentions the own name.
+func (ui *UI) mentionsMe(msg model.ChatMessage) bool {
+	return !ui.isOwn(msg) && !msg.Deleted && len(mentionIndexes(msg.Message, ui.ChatRoom.UserName)) > 0
+}
+
+// isOwn reports whether this peer sent the message. Messages stored before
+// sender IDs were recorded carry only the name.
+func (ui *UI) isOwn(msg model.ChatMessage) bool {
+	if msg.SenderID != "" {
+		return msg.SenderID == ui.ChatRoom.peerId.String()
+	}
+	return msg.SenderName == ui.ChatRoom.UserName
+}
+
+// highlightMentions escapes the text and colors the mentions of the own
+// name in it. Mentions are found in the text as sent, the parts around
+// them are escaped one by one.
+func (ui *UI) highlightMentions(text string) string {
+	var b strings.Builder
+	prev := 0
+	for _, m := range mentionIndexes(text, ui.ChatRoom.UserName) {
+		fmt.Fprintf(&b, "%s[%s]%s[-]", tview.Escape(text[prev:m[0]]), ui.theme.Mention, tview.Escape(text[m[0]:m[1]]))
+		prev = m[1]
+	}
+	b.WriteString(tview.Escape(text[prev:]))
+	return b.String()
+}
+
+// setupNotify returns the notification settings of the UI. A notify command
+// that cannot be found is left out, only the terminal UI ever runs it.
+func setupNotify(notify config.Notify) config.Notify {
+	if len(notify.Command) == 0 {
+		return notify
+	}
+	if _, err := exec.LookPath(notify.Command[0]); err != nil {
+		logrus.WithError(err).Warn("ui.notify.command is not run")
+		notify.Command = nil
+	}
+	return notify
+}
+
+// notifyMention rings the bell and runs the notify command for a message
+// mentioning the own name.
+func (ui *UI) notifyMention(cr *ChatRoom, msg model.ChatMessage) {
+	if ui.notify.Bell && ui.screen != nil {
+		_ = ui.screen.Beep()
+	}
+	if len(ui.notify.Command) == 0 {
+		return
+	}
+	title := fmt.Sprintf("%s in %s", msg.SenderName, roomLabel(cr))
+	args := append(slices.Clone(ui.notify.Command[1:]), title, msg.Message)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if out, err := exec.CommandContext(ctx, ui.notify.Command[0], args...).CombinedOutput(); err != nil {
+			logrus.WithError(err).WithField("output", string(out)).Warn("notify command failed")
+		}
+	}()
+}
+
+// memberNames returns the names of the peers seen so far, for completing mentions.
+func (ui *UI) memberNames() []string {
+	names := make([]string, 0)
+	for _, msg := range ui.scrollback {
+		if !ui.isOwn(msg) && msg.SenderName != "" {
+			names = append(names, msg.SenderName)
+		}
+	}
+	ui.namesMu.Lock()
+	for name := range ui.nameClaims {
+		names = append(names, name)
+	}
+	ui.namesMu.Unlock()
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// completeMention completes the @name before the cursor in the input box
+// and reports whether there was one. With several candidates it completes
+// their common prefix, or lists them when there is none to add.
+func (ui *UI) completeMention() bool {
+	selected, start, end := ui.inputBox.GetSelection()
+	if selected != "" || start != end {
+		return false
+	}
+	before := ui.inputBox.GetText()[:start]
+	at := strings.LastIndexFunc(before, unicode.IsSpace) + 1
+	word, ok := strings.CutPrefix(before[at:], "@")
+	if !ok {
+		return false
+	}
+
+	var candidates []string
+	for _, name := range ui.memberNames() {
+		if strings.HasPrefix(strings.ToLower(name), strings.ToLower(word)) {
+			candidates = append(candidates, name)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: fmt.Sprintf("no peer named %s...", word)})
+	case 1:
+		ui.inputBox.Replace(at, start, "@"+candidates[0]+" ")
+	default:
+		common := candidates[0]
+		for _, name := range candidates[1:] {
+			for !strings.HasPrefix(strings.ToLower(name), strings.ToLower(common)) {
+				_, size := utf8.DecodeLastRuneInString(common)
+				common = common[:len(common)-size]
+			}
+		}
+		if len(common) > len(word) {
+			ui.inputBox.Replace(at, start, "@"+common)
+			break
+		}
+		ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "@" + strings.Join(candidates, " @")})
+	}
+	return true
+}
+
+// searchMentions returns the latest messages of other peers mentioning the own name.
+func (ui *UI) searchMentions(cr *ChatRoom) (storage.SearchQuery, []storage.Record, error) {
+	name := cr.UserName
+	q := storage.SearchQuery{Query: storage.Query{Limit: searchLimit}, Terms: searchTerms(name)}
+	if len(q.Terms) == 0 {
+		return q, nil, fmt.Errorf("the name %s cannot be searched for", name)
+	}
+	records, err := cr.Search(q)
+	if err != nil {
+		return q, nil, err
+	}
+	own := cr.peerId.String()
+	mentions := make([]storage.Record, 0, len(records))
+	for _, rec := range records {
+		if rec.SenderID != own && len(mentionIndexes(rec.Message, name)) > 0 {
+			mentions = append(mentions, rec)
+		}
+	}
+	return q, mentions, nil
+}
@@ -0,0 +1,31 @@
+package service
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMentionIndexes(t *testing.T) {
+	tests := []struct {
+		desc string
+		text string
+		name string
+		want [][2]int
+	}{
+		{"alone", "@hero", "hero", [][2]int{{0, 5}}},
+		{"in a sentence", "hi @hero, look", "hero", [][2]int{{3, 8}}},
+		{"other case", "hi @HERO", "hero", [][2]int{{3, 8}}},
+		{"twice", "@hero and @hero", "hero", [][2]int{{0, 5}, {10, 15}}},
+		{"mail address", "mail me@hero", "hero", nil},
+		{"longer name", "@heroine", "hero", nil},
+		{"name with a dash", "@hero-2", "hero", nil},
+		{"after non-ASCII text", "héllo @hero", "hero", [][2]int{{7, 12}}},
+		{"no mention", "hero", "hero", nil},
+		{"no name", "@hero", "", nil},
+	}
+	for _, tt := range tests {
+		if got := mentionIndexes(tt.text, tt.name); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: mentionIndexes(%q, %q) = %v, want %v", tt.desc, tt.text, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,677 @@
+package service
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// Moderation actions of ChatRoom.Moderate.
+const (
+	ActionClaim  = "claim"
+	ActionMod    = "mod"
+	ActionUnmod  = "unmod"
+	ActionKick   = "kick"
+	ActionBan    = "ban"
+	ActionUnban  = "unban"
+	ActionMute   = "mute"
+	ActionUnmute = "unmute"
+)
+
+const (
+	// kickDuration is how long a kicked peer is banned.
+	kickDuration    = 10 * time.Minute
+	maxReasonSize   = 200
+	maxSanctionSize = 1000
+)
+
+var (
+	errBadSignature = errors.New("invalid signature")
+	errBadPolicy    = errors.New("invalid room policy")
+	errStalePolicy  = errors.New("room policy has been changed since")
+	errOtherOwner   = errors.New("room policy of another owner")
+	errNotModerator = errors.New("only the owner and moderators of the room can do that")
+	errNotOwner     = errors.New("only the owner of the room can do that")
+	errNoOwner      = errors.New("the room has no owner, /claim it first")
+	errOwned        = errors.New("the room has an owner already")
+)
+
+// RoomPolicy is the policy in force in a room without expired sanctions,
+// empty when the room has no owner.
+type RoomPolicy struct {
+	Owner      string           `json:"owner,omitempty"`
+	Moderators []string         `json:"moderators,omitempty"`
+	Banned     []model.Sanction `json:"banned,omitempty"`
+	Muted      []model.Sanction `json:"muted,omitempty"`
+}
+
+// moderation holds the policy in force in a room. The first valid policy
+// seen for a room pins its owner, later ones must be of the same owner
+// except for an earlier concurrent claim.
+type moderation struct {
+	mu      sync.Mutex
+	current *roomPolicy
+}
+
+// roomPolicy is a signed policy together with its verified content.
+type roomPolicy struct {
+	signed model.Signed
+	policy model.Policy
+	roles  model.Roles
+}
+
+// sign signs the JSON encoding of v with the key.
+func sign(priv crypto.PrivKey, v any) (model.Signed, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return model.Signed{}, fmt.Errorf("marshal: %w", err)
+	}
+	sig, err := priv.Sign(data)
+	if err != nil {
+		return model.Signed{}, fmt.Errorf("sign: %w", err)
+	}
+	key, err := crypto.MarshalPublicKey(priv.GetPublic())
+	if err != nil {
+		return model.Signed{}, fmt.Errorf("marshal key: %w", err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return model.Signed{}, fmt.Errorf("peer id: %w", err)
+	}
+	return model.Signed{Data: data, Signer: id.String(), Key: key, Signature: sig}, nil
+}
+
+// verify checks the signature of the document, decodes it into v and
+// returns its signer.
+func verify(s model.Signed, v any) (peer.ID, error) {
+	key, err := crypto.UnmarshalPublicKey(s.Key)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errBadSignature, err)
+	}
+	id, err := peer.IDFromPublicKey(key)
+	if err != nil || id.String() != s.Signer {
+		return "", errBadSignature
+	}
+	if ok, err := key.Verify(s.Data, s.Signature); err != nil || !ok {
+		return "", errBadSignature
+	}
+	if err = json.Unmarshal(s.Data, v); err != nil {
+		return "", fmt.Errorf("%w: %v", model.ErrMalformed, err)
+	}
+	return id, nil
+}
+
+// openPolicy verifies a signed policy of the topic on its own: the roles
+// must be signed by the owner, the policy by the owner or a moderator, the
+// owner cannot be sanctioned and moderators only by the owner.
+func openPolicy(s model.Signed, topic string) (roomPolicy, error) {
+	rp := roomPolicy{signed: s}
+	signer, err := verify(s, &rp.policy)
+	if err != nil {
+		return rp, err
+	}
+	owner, err := verify(rp.policy.Roles, &rp.roles)
+	if err != nil {
+		return rp, err
+	}
+	if rp.policy.Topic != topic || rp.roles.Topic != topic || owner.String() != rp.roles.Owner {
+		return rp, errBadPolicy
+	}
+	if len(rp.policy.Banned)+len(rp.policy.Muted) > maxSanctionSize {
+		return rp, errBadPolicy
+	}
+	if !rp.isModerator(signer) {
+		return rp, errNotModerator
+	}
+	byOwner := signer.String() == rp.roles.Owner
+	for _, s := range slices.Concat(rp.policy.Banned, rp.policy.Muted) {
+		if s.PeerID == rp.roles.Owner {
+			return rp, errBadPolicy
+		}
+		if !byOwner && slices.Contains(rp.roles.Moderators, s.PeerID) {
+			return rp, errNotOwner
+		}
+	}
+	return rp, nil
+}
+
+// isModerator reports whether the peer is the owner or a moderator.
+func (rp roomPolicy) isModerator(id peer.ID) bool {
+	return id.String() == rp.roles.Owner || slices.Contains(rp.roles.Moderators, id.String())
+}
+
+// newer reports whether the policy replaces cur. Changes of the roles win
+// over changes of the sanctions, concurrent changes of the same version
+// are decided by their signatures so that every peer keeps the same one.
+func (rp roomPolicy) newer(cur roomPolicy) bool {
+	return cmp.Or(
+		cmp.Compare(rp.roles.Version, cur.roles.Version),
+		cmp.Compare(rp.policy.Version, cur.policy.Version),
+		bytes.Compare(rp.signed.Signature, cur.signed.Signature),
+	) > 0
+}
+
+// winsClaim reports whether rp claims the room over the claim of another
+// owner in cur. While neither owner changed the roles, the claim signed
+// earlier wins, so that the peers seeing two concurrent claims all pin the
+// same owner. A claim must be signed within maxMessageSkew of now to win,
+// so that it cannot be backdated past a claim older than that.
+func (rp roomPolicy) winsClaim(cur roomPolicy, now time.Time) bool {
+	if rp.roles.Version != 1 || cur.roles.Version != 1 || rp.roles.ClaimedAt.IsZero() ||
+		now.Sub(rp.roles.ClaimedAt).Abs() > maxMessageSkew {
+		return false
+	}
+	return cmp.Or(
+		rp.roles.ClaimedAt.Compare(cur.roles.ClaimedAt),
+		bytes.Compare(cur.policy.Roles.Signature, rp.policy.Roles.Signature),
+	) < 0
+}
+
+// supersedes reports whether the policy replaces the one in force, m.mu
+// must be held. Policies of another owner only replace an earlier claim.
+func (m *moderation) supersedes(rp roomPolicy, now time.Time) bool {
+	cur := m.current
+	switch {
+	case cur == nil:
+		return true
+	case rp.roles.Owner != cur.roles.Owner:
+		return rp.winsClaim(*cur, now)
+	default:
+		return rp.newer(*cur)
+	}
+}
+
+// check verifies a policy received in the room against the one in force.
+// The policy in force itself passes, older ones fail with errStalePolicy
+// and those of another owner with errOtherOwner.
+func (m *moderation) check(s model.Signed, topic string) (roomPolicy, error) {
+	rp, err := openPolicy(s, topic)
+	if err != nil {
+		return rp, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case m.supersedes(rp, time.Now()):
+		return rp, nil
+	case rp.roles.Owner != m.current.roles.Owner:
+		return rp, errOtherOwner
+	case !bytes.Equal(rp.signed.Signature, m.current.signed.Signature):
+		return rp, errStalePolicy
+	}
+	return rp, nil
+}
+
+// replace puts the policy in force unless it does not supersede the one
+// in force, and returns the one it replaced.
+func (m *moderation) replace(rp roomPolicy) (*roomPolicy, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.current
+	if !m.supersedes(rp, time.Now()) {
+		return prev, false
+	}
+	m.current = &rp
+	return prev, true
+}
+
+// sanctioned returns the sanction of the peer in force, if any.
+func sanctioned(sanctions []model.Sanction, id string, now time.Time) (model.Sanction, bool) {
+	for _, s := range sanctions {
+		if s.PeerID == id && (s.Until.IsZero() || now.Before(s.Until)) {
+			return s, true
+		}
+	}
+	return model.Sanction{}, false
+}
+
+// isBanned reports whether the peer is banned from the room.
+func (cr *ChatRoom) isBanned(id string) bool {
+	cr.moderation.mu.Lock()
+	defer cr.moderation.mu.Unlock()
+	if cr.moderation.current == nil {
+		return false
+	}
+	_, banned := sanctioned(cr.moderation.current.policy.Banned, id, time.Now())
+	return banned
+}
+
+// silenced tells why the own messages are rejected in the room, if they are.
+func (cr *ChatRoom) silenced() string {
+	cr.moderation.mu.Lock()
+	defer cr.moderation.mu.Unlock()
+	if cr.moderation.current == nil {
+		return ""
+	}
+	now := time.Now()
+	if _, banned := sanctioned(cr.moderation.current.policy.Banned, cr.peerId.String(), now); banned {
+		return "you are banned from this room"
+	}
+	if _, muted := sanctioned(cr.moderation.current.policy.Muted, cr.peerId.String(), now); muted {
+		return "you are muted in this room"
+	}
+	return ""
+}
+
+// moderationVerdict checks a room message against the policy in force.
+// Messages of muted peers are rejected except their presence heartbeats,
+// as are forged or unauthorized policies. Banned peers are rejected before
+// their messages are read, see isBanned.
+func (cr *ChatRoom) moderationVerdict(author string, env model.Envelope) (pubsub.ValidationResult, string) {
+	if env.Kind == model.KindPolicy {
+		var s model.Signed
+		if err := env.Decode(&s); err != nil {
+			return pubsub.ValidationReject, rejectMalformed
+		}
+		_, err := cr.moderation.check(s, cr.topic.String())
+		switch {
+		case errors.Is(err, errStalePolicy), errors.Is(err, errOtherOwner):
+			// peers that missed an update keep sending the policy they know
+			return pubsub.ValidationIgnore, ""
+		case err != nil:
+			logrus.WithError(err).WithField("peer", author).Debug("rejected room policy")
+			return pubsub.ValidationReject, rejectPolicy
+		}
+		return pubsub.ValidationAccept, ""
+	}
+
+	cr.moderation.mu.Lock()
+	current := cr.moderation.current
+	cr.moderation.mu.Unlock()
+	if current != nil && env.Kind != model.KindPresence {
+		if _, muted := sanctioned(current.policy.Muted, author, time.Now()); muted {
+			return pubsub.ValidationReject, rejectMuted
+		}
+	}
+	return pubsub.ValidationAccept, ""
+}
+
+// loadPolicy puts the policy stored for the room in force.
+func (cr *ChatRoom) loadPolicy() {
+	s, err := storage.LoadPolicy(cr.logName)
+	if err != nil {
+		logrus.WithError(err).Warn("failed to load room policy")
+		return
+	}
+	if s == nil {
+		return
+	}
+	rp, err := openPolicy(*s, cr.topic.String())
+	if err != nil {
+		logrus.WithError(err).Warn("dropped invalid room policy")
+		return
+	}
+	cr.moderation.mu.Lock()
+	cr.moderation.current = &rp
+	cr.moderation.mu.Unlock()
+}
+
+// receivePolicy puts a policy published in the room in force, stores it
+// and tells what it changed.
+func (cr *ChatRoom) receivePolicy(s model.Signed) {
+	rp, err := cr.moderation.check(s, cr.topic.String())
+	if err != nil {
+		logrus.WithError(err).Debug("dropped room policy")
+		return
+	}
+	prev, ok := cr.moderation.replace(rp)
+	if !ok || prev != nil && bytes.Equal(prev.signed.Signature, rp.signed.Signature) {
+		return
+	}
+	if err = storage.SavePolicy(cr.logName, rp.signed); err != nil {
+		logrus.WithError(err).Warn("failed to save room policy")
+	}
+	cr.announcePolicy(prev, rp)
+}
+
+// publishPolicy publishes the policy in force so that peers joining the
+// room learn it.
+func (cr *ChatRoom) publishPolicy() error {
+	cr.moderation.mu.Lock()
+	current := cr.moderation.current
+	cr.moderation.mu.Unlock()
+	if current == nil {
+		return nil
+	}
+	return cr.publish(model.KindPolicy, current.signed)
+}
+
+// moderates reports whether the own peer is the owner or a moderator.
+func (cr *ChatRoom) moderates() bool {
+	cr.moderation.mu.Lock()
+	defer cr.moderation.mu.Unlock()
+	return cr.moderation.current != nil && cr.moderation.current.isModerator(cr.peerId)
+}
+
+// Policy returns the policy in force in the room.
+func (cr *ChatRoom) Policy() (RoomPolicy, error) {
+	if cr.remote != nil {
+		return cr.remote.Policy(cr.RoomName)
+	}
+	cr.moderation.mu.Lock()
+	current := cr.moderation.current
+	cr.moderation.mu.Unlock()
+	if current == nil {
+		return RoomPolicy{}, nil
+	}
+	now := time.Now()
+	expired := func(s model.Sanction) bool {
+		return !s.Until.IsZero() && !now.Before(s.Until)
+	}
+	return RoomPolicy{
+		Owner:      current.roles.Owner,
+		Moderators: current.roles.Moderators,
+		Banned:     slices.DeleteFunc(slices.Clone(current.policy.Banned), expired),
+		Muted:      slices.DeleteFunc(slices.Clone(current.policy.Muted), expired),
+	}, nil
+}
+
+// Moderate changes the policy of the room as the action says, signs it
+// with the own key and publishes it. Claiming makes the own peer the owner
+// of a room without one, the owner appoints moderators, owner and
+// moderators kick, ban and mute peers. Moderators cannot sanction each other.
+func (cr *ChatRoom) Moderate(action string, target peer.ID, reason string) error {
+	if cr.remote != nil {
+		return cr.remote.Moderate(cr.RoomName, action, target, reason)
+	}
+	priv := cr.Host.Host.Peerstore().PrivKey(cr.peerId)
+	if priv == nil {
+		return errors.New("own key is not available")
+	}
+	if len(reason) > maxReasonSize {
+		reason = strings.ToValidUTF8(reason[:maxReasonSize], "")
+	}
+	topic := cr.topic.String()
+	self := cr.peerId.String()
+
+	cr.moderation.mu.Lock()
+	current := cr.moderation.current
+	cr.moderation.mu.Unlock()
+
+	var roles model.Roles
+	var policy model.Policy
+	switch {
+	case action == ActionClaim && current != nil:
+		return errOwned
+	case action == ActionClaim:
+		roles = model.Roles{Topic: topic, Owner: self, Version: 1, ClaimedAt: time.Now()}
+		policy = model.Policy{Topic: topic, Version: 1}
+	case current == nil:
+		return errNoOwner
+	case !current.isModerator(cr.peerId):
+		return errNotModerator
+	default:
+		roles = current.roles
+		roles.Moderators = slices.Clone(roles.Moderators)
+		policy = current.policy
+		policy.Version++
+		policy.Banned = pruneSanctions(policy.Banned, "")
+		policy.Muted = pruneSanctions(policy.Muted, "")
+	}
+
+	if action != ActionClaim {
+		switch {
+		case target == "":
+			return errors.New("missing peer")
+		case target.String() == roles.Owner:
+			return errors.New("the owner cannot be moderated")
+		case action == ActionMod || action == ActionUnmod:
+			if self != roles.Owner {
+				return errNotOwner
+			}
+		case slices.Contains(roles.Moderators, target.String()) && self != roles.Owner:
+			return errors.New("moderators cannot moderate each other")
+		}
+	}
+
+	isTarget := func(id string) bool { return id == target.String() }
+	if slices.Contains([]string{ActionKick, ActionBan, ActionMute}, action) && slices.ContainsFunc(roles.Moderators, isTarget) {
+		// only the owner gets here, a sanctioned peer moderates no more
+		roles.Moderators = slices.DeleteFunc(roles.Moderators, isTarget)
+		roles.Version++
+	}
+
+	sanction := model.Sanction{PeerID: target.String(), By: self, Reason: reason}
+	switch action {
+	case ActionMod:
+		if !slices.Contains(roles.Moderators, target.String()) {
+			roles.Moderators = append(roles.Moderators, target.String())
+		}
+		policy.Banned = pruneSanctions(policy.Banned, target.String())
+		policy.Muted = pruneSanctions(policy.Muted, target.String())
+		roles.Version++
+	case ActionUnmod:
+		roles.Moderators = slices.DeleteFunc(roles.Moderators, isTarget)
+		roles.Version++
+	case ActionKick:
+		sanction.Until = time.Now().Add(kickDuration)
+		policy.Banned = append(pruneSanctions(policy.Banned, target.String()), sanction)
+	case ActionBan:
+		policy.Banned = append(pruneSanctions(policy.Banned, target.String()), sanction)
+	case ActionUnban:
+		policy.Banned = pruneSanctions(policy.Banned, target.String())
+	case ActionMute:
+		policy.Muted = append(pruneSanctions(policy.Muted, target.String()), sanction)
+	case ActionUnmute:
+		policy.Muted = pruneSanctions(policy.Muted, target.String())
+	case ActionClaim:
+	default:
+		return fmt.Errorf("unknown moderation action %q", action)
+	}
+
+	if current == nil || roles.Version != current.roles.Version {
+		signed, err := sign(priv, roles)
+		if err != nil {
+			return fmt.Errorf("sign roles: %w", err)
+		}
+		policy.Roles = signed
+	}
+	signed, err := sign(priv, policy)
+	if err != nil {
+		return fmt.Errorf("sign policy: %w", err)
+	}
+	rp, err := openPolicy(signed, topic)
+	if err != nil {
+		return err
+	}
+	prev, ok := cr.moderation.replace(rp)
+	if !ok {
+		return errStalePolicy
+	}
+	if err = storage.SavePolicy(cr.logName, signed); err != nil {
+		logrus.WithError(err).Warn("failed to save room policy")
+	}
+	if err = cr.publish(model.KindPolicy, signed); err != nil {
+		return err
+	}
+	cr.announcePolicy(prev, rp)
+	return nil
+}
+
+// pruneSanctions drops the expired sanctions and those of the peer.
+func pruneSanctions(sanctions []model.Sanction, id string) []model.Sanction {
+	now := time.Now()
+	return slices.DeleteFunc(slices.Clone(sanctions), func(s model.Sanction) bool {
+		return s.PeerID == id || !s.Until.IsZero() && !now.Before(s.Until)
+	})
+}
+
+// announcePolicy tells the room what a new policy changed.
+func (cr *ChatRoom) announcePolicy(prev *roomPolicy, next roomPolicy) {
+	var lines []string
+	if prev == nil || prev.roles.Owner != next.roles.Owner {
+		// a competing claim won, or the room had no owner
+		lines = append(lines, fmt.Sprintf("%s owns the room", cr.memberName(next.roles.Owner)))
+		prev = &roomPolicy{}
+	}
+	for _, id := range next.roles.Moderators {
+		if !slices.Contains(prev.roles.Moderators, id) {
+			lines = append(lines, fmt.Sprintf("%s is a moderator now", cr.memberName(id)))
+		}
+	}
+	for _, id := range prev.roles.Moderators {
+		if !slices.Contains(next.roles.Moderators, id) {
+			lines = append(lines, fmt.Sprintf("%s is no longer a moderator", cr.memberName(id)))
+		}
+	}
+	lines = append(lines, cr.sanctionChanges("banned", prev.policy.Banned, next.policy.Banned)...)
+	lines = append(lines, cr.sanctionChanges("muted", prev.policy.Muted, next.policy.Muted)...)
+	for _, line := range lines {
+		cr.notice(model.LogMessage{Prefix: "system", Message: line})
+	}
+}
+
+func (cr *ChatRoom) sanctionChanges(verb string, prev []model.Sanction, next []model.Sanction) []string {
+	now := time.Now()
+	var lines []string
+	for _, s := range next {
+		if slices.ContainsFunc(prev, s.Equal) || !s.Until.IsZero() && !now.Before(s.Until) {
+			continue
+		}
+		line := fmt.Sprintf("%s was %s by %s", cr.memberName(s.PeerID), verb, cr.memberName(s.By))
+		if !s.Until.IsZero() {
+			line += " until " + s.Until.Local().Format(time.TimeOnly)
+		}
+		if s.Reason != "" {
+			line += ": " + s.Reason
+		}
+		lines = append(lines, line)
+	}
+	for _, s := range prev {
+		if _, still := sanctioned(next, s.PeerID, now); !still && (s.Until.IsZero() || now.Before(s.Until)) {
+			lines = append(lines, fmt.Sprintf("%s is no longer %s", cr.memberName(s.PeerID), verb))
+		}
+	}
+	return lines
+}
+
+// memberName names the peer by its presence in the room and fingerprint.
+func (cr *ChatRoom) memberName(id string) string {
+	name := ""
+	if id == cr.peerId.String() {
+		name = cr.UserName
+	}
+	if p, err := peer.Decode(id); err == nil && name == "" {
+		cr.presence.mu.Lock()
+		name = cr.presence.peers[p].SenderName
+		cr.presence.mu.Unlock()
+	}
+	if name == "" {
+		return fingerprint(id)
+	}
+	return name + "#" + fingerprint(id)
+}
+
+// moderate runs a moderation command, its argument is the peer and an
+// optional reason.
+func (ui *UI) moderate(cr *ChatRoom, action string, arg string) {
+	var target peer.ID
+	reason := ""
+	if action != ActionClaim {
+		name, rest, _ := strings.Cut(strings.TrimSpace(arg), " ")
+		if name == "" {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "missing peer for command"}
+			return
+		}
+		var err error
+		if target, err = ui.resolveModerated(cr, name); err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: err.Error()}
+			return
+		}
+		reason = strings.TrimSpace(rest)
+	}
+	if err := cr.Moderate(action, target, reason); err != nil {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "could not moderate - " + err.Error()}
+	}
+}
+
+// resolveModerated finds a peer like resolvePeer, or among the peers named
+// in the room policy, who are not connected when they are banned.
+func (ui *UI) resolveModerated(cr *ChatRoom, target string) (peer.ID, error) {
+	peers := cr.knownPeers()
+	policy, err := cr.Policy()
+	if err != nil {
+		return ui.resolvePeerAmong(cr, target, peers)
+	}
+	ids := slices.Clone(policy.Moderators)
+	for _, s := range slices.Concat(policy.Banned, policy.Muted) {
+		ids = append(ids, s.PeerID)
+	}
+	for _, known := range ids {
+		if id, err := peer.Decode(known); err == nil {
+			peers = append(peers, id)
+		}
+	}
+	slices.Sort(peers)
+	return ui.resolvePeerAmong(cr, target, slices.Compact(peers))
+}
+
+// showPolicy lists the owner, moderators and sanctioned peers of the room.
+func (ui *UI) showPolicy(cr *ChatRoom) {
+	policy, err := cr.Policy()
+	if err != nil {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "could not read room policy - " + err.Error()}
+		return
+	}
+	if policy.Owner == "" {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "the room has no owner, /claim makes you its owner"}
+		return
+	}
+	lines := []string{"owner: " + ui.describePeer(cr, policy.Owner)}
+	moderators := make([]string, 0, len(policy.Moderators))
+	for _, id := range policy.Moderators {
+		moderators = append(moderators, ui.describePeer(cr, id))
+	}
+	if len(moderators) == 0 {
+		moderators = append(moderators, "none")
+	}
+	lines = append(lines, "moderators: "+strings.Join(moderators, ", "))
+	sections := []struct {
+		verb      string
+		sanctions []model.Sanction
+	}{
+		{"banned", policy.Banned},
+		{"muted", policy.Muted},
+	}
+	for _, section := range sections {
+		for _, s := range section.sanctions {
+			line := fmt.Sprintf("%s: %s by %s", section.verb, ui.describePeer(cr, s.PeerID), ui.describePeer(cr, s.By))
+			if !s.Until.IsZero() {
+				line += " until " + s.Until.Local().Format(time.TimeOnly)
+			}
+			if s.Reason != "" {
+				line += " - " + s.Reason
+			}
+			lines = append(lines, line)
+		}
+	}
+	for _, line := range lines {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: line}
+	}
+}
+
+// describePeer names the peer by its latest known name and fingerprint.
+func (ui *UI) describePeer(cr *ChatRoom, id string) string {
+	if id == cr.peerId.String() {
+		return cr.UserName + "#" + fingerprint(id)
+	}
+	if p, err := peer.Decode(id); err == nil {
+		if name := ui.peerName(p); name != "" {
+			return name + "#" + fingerprint(id)
+		}
+	}
+	return fingerprint(id)
+}
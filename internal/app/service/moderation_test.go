@@ -0,0 +1,186 @@
+package service
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const testTopic = "room:test"
+
+type testPeer struct {
+	priv crypto.PrivKey
+	id   string
+}
+
+func newTestPeer(t *testing.T) testPeer {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testPeer{priv: priv, id: id.String()}
+}
+
+// signPolicy signs the roles with the owner's key and the policy with the
+// signer's key.
+func signPolicy(t *testing.T, owner, signer testPeer, roles model.Roles, policy model.Policy) model.Signed {
+	t.Helper()
+	var err error
+	if policy.Roles, err = sign(owner.priv, roles); err != nil {
+		t.Fatal(err)
+	}
+	s, err := sign(signer.priv, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestOpenPolicy(t *testing.T) {
+	owner, mod, other := newTestPeer(t), newTestPeer(t), newTestPeer(t)
+	roles := model.Roles{Topic: testTopic, Owner: owner.id, Version: 1, Moderators: []string{mod.id}}
+	ban := func(id string) []model.Sanction {
+		return []model.Sanction{{PeerID: id}}
+	}
+	tests := []struct {
+		desc   string
+		signer testPeer
+		roles  model.Roles
+		policy model.Policy
+		topic  string
+		err    error
+	}{
+		{"signed by the owner", owner, roles, model.Policy{Topic: testTopic, Banned: ban(other.id)}, testTopic, nil},
+		{"signed by a moderator", mod, roles, model.Policy{Topic: testTopic, Muted: ban(other.id)}, testTopic, nil},
+		{"signed by another peer", other, roles, model.Policy{Topic: testTopic}, testTopic, errNotModerator},
+		{"of another room", owner, roles, model.Policy{Topic: testTopic}, "room:other", errBadPolicy},
+		{"roles naming another owner", owner, model.Roles{Topic: testTopic, Owner: other.id, Version: 1}, model.Policy{Topic: testTopic}, testTopic, errBadPolicy},
+		{"owner sanctioned", mod, roles, model.Policy{Topic: testTopic, Banned: ban(owner.id)}, testTopic, errBadPolicy},
+		{"moderator sanctioned by the owner", owner, roles, model.Policy{Topic: testTopic, Muted: ban(mod.id)}, testTopic, nil},
+		{"moderator sanctioned by a moderator", mod, roles, model.Policy{Topic: testTopic, Banned: ban(mod.id)}, testTopic, errNotOwner},
+		{"too many sanctions", owner, roles, model.Policy{Topic: testTopic, Banned: make([]model.Sanction, maxSanctionSize+1)}, testTopic, errBadPolicy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			s := signPolicy(t, owner, tt.signer, tt.roles, tt.policy)
+			if _, err := openPolicy(s, tt.topic); !errors.Is(err, tt.err) {
+				t.Fatalf("openPolicy error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	t.Run("forged signature", func(t *testing.T) {
+		s := signPolicy(t, owner, owner, roles, model.Policy{Topic: testTopic})
+		s.Signature[0] ^= 0xff
+		if _, err := openPolicy(s, testTopic); !errors.Is(err, errBadSignature) {
+			t.Fatalf("openPolicy error = %v, want %v", err, errBadSignature)
+		}
+	})
+}
+
+// testPolicy returns a policy of the owner with the versions, not actually
+// signed, sig stands in for both of its signatures.
+func testPolicy(owner string, rolesVersion, policyVersion int64, sig byte) roomPolicy {
+	return roomPolicy{
+		signed: model.Signed{Signature: []byte{sig}},
+		policy: model.Policy{Version: policyVersion, Roles: model.Signed{Signature: []byte{sig}}},
+		roles:  model.Roles{Owner: owner, Version: rolesVersion},
+	}
+}
+
+func TestNewer(t *testing.T) {
+	tests := []struct {
+		desc string
+		rp   roomPolicy
+		cur  roomPolicy
+		want bool
+	}{
+		{"later roles", testPolicy("a", 2, 0, 1), testPolicy("a", 1, 5, 2), true},
+		{"earlier roles", testPolicy("a", 1, 5, 2), testPolicy("a", 2, 0, 1), false},
+		{"later sanctions", testPolicy("a", 1, 3, 1), testPolicy("a", 1, 2, 2), true},
+		{"earlier sanctions", testPolicy("a", 1, 2, 2), testPolicy("a", 1, 3, 1), false},
+		{"same versions, greater signature", testPolicy("a", 1, 1, 2), testPolicy("a", 1, 1, 1), true},
+		{"same versions, smaller signature", testPolicy("a", 1, 1, 1), testPolicy("a", 1, 1, 2), false},
+		{"the same policy", testPolicy("a", 1, 1, 1), testPolicy("a", 1, 1, 1), false},
+	}
+	for _, tt := range tests {
+		if got := tt.rp.newer(tt.cur); got != tt.want {
+			t.Errorf("%s: newer = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestSupersedes(t *testing.T) {
+	now := time.Now()
+	ref := func(rp roomPolicy) *roomPolicy { return &rp }
+	claim := func(owner string, rolesVersion int64, at time.Time, sig byte) roomPolicy {
+		rp := testPolicy(owner, rolesVersion, 0, sig)
+		rp.roles.ClaimedAt = at
+		return rp
+	}
+	tests := []struct {
+		desc string
+		cur  *roomPolicy
+		rp   roomPolicy
+		want bool
+	}{
+		{"first policy", nil, testPolicy("a", 1, 0, 1), true},
+		{"newer of the owner", ref(testPolicy("a", 1, 0, 1)), testPolicy("a", 1, 1, 1), true},
+		{"older of the owner", ref(testPolicy("a", 1, 1, 1)), testPolicy("a", 1, 0, 1), false},
+		{"earlier claim", ref(claim("a", 1, now.Add(-time.Second), 1)), claim("b", 1, now.Add(-2*time.Second), 1), true},
+		{"later claim", ref(claim("a", 1, now.Add(-2*time.Second), 1)), claim("b", 1, now.Add(-time.Second), 1), false},
+		{"concurrent claim winning", ref(claim("a", 1, now, 1)), claim("b", 1, now, 2), true},
+		{"concurrent claim losing", ref(claim("a", 1, now, 2)), claim("b", 1, now, 1), false},
+		{"backdated claim", ref(claim("a", 1, now, 1)), claim("b", 1, now.Add(-2*maxMessageSkew), 1), false},
+		{"claim without a time", ref(claim("a", 1, now, 1)), claim("b", 1, time.Time{}, 1), false},
+		{"claim against a stored owner", ref(claim("a", 1, time.Time{}, 1)), claim("b", 1, now, 1), false},
+		{"claim against changed roles", ref(claim("a", 2, now, 1)), claim("b", 1, now.Add(-time.Second), 1), false},
+		{"other owner with changed roles", ref(claim("a", 1, now, 1)), claim("b", 2, now.Add(-time.Second), 1), false},
+	}
+	for _, tt := range tests {
+		m := &moderation{current: tt.cur}
+		if got := m.supersedes(tt.rp, now); got != tt.want {
+			t.Errorf("%s: supersedes = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestModerationCheck(t *testing.T) {
+	owner, other := newTestPeer(t), newTestPeer(t)
+	roles := model.Roles{Topic: testTopic, Owner: owner.id, Version: 1}
+	first := signPolicy(t, owner, owner, roles, model.Policy{Topic: testTopic, Version: 1})
+	second := signPolicy(t, owner, owner, roles, model.Policy{Topic: testTopic, Version: 2})
+	claim := signPolicy(t, other, other, model.Roles{Topic: testTopic, Owner: other.id, Version: 1}, model.Policy{Topic: testTopic})
+
+	var m moderation
+	rp, err := m.check(second, testTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.current = &rp
+
+	tests := []struct {
+		desc string
+		s    model.Signed
+		err  error
+	}{
+		{"the policy in force", second, nil},
+		{"an older policy", first, errStalePolicy},
+		{"a policy of another owner", claim, errOtherOwner},
+	}
+	for _, tt := range tests {
+		if _, err := m.check(tt.s, testTopic); !errors.Is(err, tt.err) {
+			t.Errorf("%s: check error = %v, want %v", tt.desc, err, tt.err)
+		}
+	}
+}
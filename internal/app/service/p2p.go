@@ -2,8 +2,8 @@ package service
 
 import (
 	"context"
-	"crypto/rand"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p"
@@ -11,88 +11,191 @@ import (
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
 	discovery "github.com/libp2p/go-libp2p/p2p/discovery/routing"
 	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	"github.com/multiformats/go-multiaddr"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
-const serviceName = "peerchat"
+const (
+	serviceName   = "peerchat"
+	defaultListen = "/ip4/0.0.0.0/tcp/0"
+	connLow       = 100
+	connHigh      = 400
+	// bootstrapTimeout bounds the dial of each bootstrap peer.
+	bootstrapTimeout = 10 * time.Second
+)
+
+const (
+	DiscoveryDHT  = "dht"
+	DiscoveryMDNS = "mdns"
+	DiscoveryBoth = "both"
+)
+
+type P2POptions struct {
+	// Discovery selects how peers are found: DiscoveryDHT uses the public
+	// IPFS DHT, DiscoveryMDNS only the local network, DiscoveryBoth uses both.
+	Discovery string
+	// ServiceName is advertised and looked up to find other peerchat nodes.
+	ServiceName string
+	// ListenAddrs are the multiaddrs the host listens on.
+	ListenAddrs []string
+	// ConnLow and ConnHigh are the connection manager water marks.
+	ConnLow  int
+	ConnHigh int
+	// BootstrapPeers are additional bootstrap multiaddrs including the /p2p/ peer ID.
+	BootstrapPeers []string
+	// NoPublicBootstrap skips the public IPFS bootstrap nodes.
+	NoPublicBootstrap bool
+	// PSK restricts the host to a private network of nodes holding the same swarm key.
+	PSK pnet.PSK
+	// History controls room history sync with other peers.
+	History HistoryOptions
+	// BlockIgnored refuses connections with ignored peers instead of only
+	// dropping their messages.
+	BlockIgnored bool
+}
 
 type P2P struct {
 	Ctx       context.Context
 	Host      host.Host
 	Discovery *discovery.RoutingDiscovery
 	PubSub    *pubsub.PubSub
+
+	serviceName string
+	dht         *dht.IpfsDHT
+	mdns        mdns.Service
+	history     *historyService
+	// holePunched holds the peers reached through a hole punch
+	holePunched *sync.Map
+	validation  *validation
+	ignored     *ignoreList
 }
 
-func NewP2P() (*P2P, error) {
+func NewP2P(priv crypto.PrivKey, opts P2POptions) (*P2P, error) {
 	ctx := context.Background()
 
-	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+	if opts.Discovery == "" {
+		opts.Discovery = DiscoveryDHT
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = serviceName
+	}
+	if len(opts.ListenAddrs) == 0 {
+		opts.ListenAddrs = []string{defaultListen}
+	}
+	if opts.ConnLow == 0 && opts.ConnHigh == 0 {
+		opts.ConnLow, opts.ConnHigh = connLow, connHigh
+	}
+	useDHT := opts.Discovery == DiscoveryDHT || opts.Discovery == DiscoveryBoth
+	useMDNS := opts.Discovery == DiscoveryMDNS || opts.Discovery == DiscoveryBoth
+	if !useDHT && !useMDNS {
+		return nil, fmt.Errorf("unsupported discovery %q", opts.Discovery)
+	}
+	bootstrapPeers, err := bootstrapAddrInfos(opts, useDHT)
 	if err != nil {
-		return nil, fmt.Errorf("generate identity key: %w", err)
+		return nil, err
 	}
 
-	cm, err := connmgr.NewConnManager(100, 400, connmgr.WithGracePeriod(time.Minute))
+	cm, err := connmgr.NewConnManager(opts.ConnLow, opts.ConnHigh, connmgr.WithGracePeriod(time.Minute))
 	if err != nil {
 		return nil, fmt.Errorf("create conn manager: %w", err)
 	}
 
-	h, err := libp2p.New(
+	holePunched := &sync.Map{}
+	ignored := loadIgnoreList(opts.BlockIgnored)
+	hostOpts := []libp2p.Option{
 		libp2p.Identity(priv),
-		libp2p.ListenAddrStrings("/ip4/0.0.0.0/tcp/0"),
+		libp2p.ListenAddrStrings(opts.ListenAddrs...),
 		libp2p.ConnectionManager(cm),
 		libp2p.NATPortMap(),
 		libp2p.EnableRelay(),
-		libp2p.EnableHolePunching(),
-	)
+		libp2p.EnableHolePunching(holepunch.WithTracer(holePunchTracer{peers: holePunched})),
+		libp2p.PrivateNetwork(opts.PSK),
+	}
+	if opts.BlockIgnored {
+		hostOpts = append(hostOpts, libp2p.ConnectionGater(ignoreGater{list: ignored}))
+	}
+	h, err := libp2p.New(hostOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("create p2p: %w", err)
 	}
 	logrus.Debugf("created host: %s", h.ID().String())
 
-	kaddht, err := dht.New(ctx, h, dht.Mode(dht.ModeServer))
-	if err != nil {
-		_ = h.Close()
-		return nil, fmt.Errorf("create dht: %w", err)
-	}
-	if err = kaddht.Bootstrap(ctx); err != nil {
-		return nil, fmt.Errorf("bootstrap kaddht: %w", err)
+	h.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, c network.Conn) {
+			if n.Connectedness(c.RemotePeer()) != network.Connected {
+				holePunched.Delete(c.RemotePeer())
+			}
+		},
+	})
+
+	p := &P2P{
+		Ctx:         ctx,
+		Host:        h,
+		serviceName: opts.ServiceName,
+		holePunched: holePunched,
+		validation:  newValidation(),
+		ignored:     ignored,
 	}
-	for _, addr := range dht.DefaultBootstrapPeers {
-		pi, _ := peer.AddrInfoFromP2pAddr(addr)
-		if err = h.Connect(ctx, *pi); err != nil {
-			logrus.WithError(err).Warn("failed to connect bootstrap peer")
+	p.history = newHistoryService(p, opts.History)
+
+	scoreParams, scoreThresholds := peerScoreParams()
+	psOpts := []pubsub.Option{pubsub.WithPeerScore(scoreParams, scoreThresholds)}
+	if useDHT {
+		p.dht, err = dht.New(ctx, h, dht.Mode(dht.ModeServer), dht.BootstrapPeers(bootstrapPeers...))
+		if err != nil {
+			_ = h.Close()
+			return nil, fmt.Errorf("create dht: %w", err)
 		}
+		if err = p.dht.Bootstrap(ctx); err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("bootstrap kaddht: %w", err)
+		}
+		p.Discovery = discovery.NewRoutingDiscovery(p.dht)
+		psOpts = append(psOpts, pubsub.WithDiscovery(p.Discovery))
 	}
 
-	routingDiscovery := discovery.NewRoutingDiscovery(kaddht)
+	connectBootstrap(ctx, h, bootstrapPeers)
 
-	ps, err := pubsub.NewGossipSub(ctx, h, pubsub.WithDiscovery(routingDiscovery))
+	p.PubSub, err = pubsub.NewGossipSub(ctx, h, psOpts...)
 	if err != nil {
-		_ = kaddht.Close()
-		_ = h.Close()
+		_ = p.Close()
 		return nil, fmt.Errorf("create gossipsub: %w", err)
 	}
 
-	return &P2P{
-		Ctx:       ctx,
-		Host:      h,
-		Discovery: routingDiscovery,
-		PubSub:    ps,
-	}, nil
+	if useMDNS {
+		p.mdns = mdns.NewMdnsService(h, p.serviceName, &mdnsNotifee{p2p: p})
+		if err = p.mdns.Start(); err != nil {
+			_ = p.Close()
+			return nil, fmt.Errorf("start mdns: %w", err)
+		}
+	}
+
+	return p, nil
 }
 
+// AdvertiseConnect advertises the service on the DHT and connects to the
+// peers found there. It is a no-op when only mDNS discovery is enabled,
+// as mDNS advertises and connects on its own.
 func (p *P2P) AdvertiseConnect() error {
-	ttl, err := p.Discovery.Advertise(p.Ctx, serviceName)
+	if p.Discovery == nil {
+		return nil
+	}
+
+	ttl, err := p.Discovery.Advertise(p.Ctx, p.serviceName)
 	if err != nil {
 		return fmt.Errorf("discovery advertise: %w", err)
 	}
-	logrus.Debugf("advertised service %q (ttl=%s)", serviceName, ttl)
+	logrus.Debugf("advertised service %q (ttl=%s)", p.serviceName, ttl)
 
-	peerCh, err := p.Discovery.FindPeers(p.Ctx, serviceName)
+	peerCh, err := p.Discovery.FindPeers(p.Ctx, p.serviceName)
 	if err != nil {
 		return fmt.Errorf("find peers: %w", err)
 	}
@@ -100,6 +203,56 @@ func (p *P2P) AdvertiseConnect() error {
 	return nil
 }
 
+// bootstrapAddrInfos merges the public bootstrap nodes with the configured ones.
+// Public nodes are only used for the DHT, and skipped on a private network as
+// they could never connect.
+func bootstrapAddrInfos(opts P2POptions, useDHT bool) ([]peer.AddrInfo, error) {
+	var addrs []multiaddr.Multiaddr
+	if useDHT && !opts.NoPublicBootstrap && opts.PSK == nil {
+		addrs = append(addrs, dht.DefaultBootstrapPeers...)
+	}
+	for _, s := range opts.BootstrapPeers {
+		addr, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap peer %q: %w", s, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	pis, err := peer.AddrInfosFromP2pAddrs(addrs...)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap peers: %w", err)
+	}
+	return pis, nil
+}
+
+// connectBootstrap dials the bootstrap peers at once, each for at most
+// bootstrapTimeout, and waits for all of them.
+func connectBootstrap(ctx context.Context, h host.Host, peers []peer.AddrInfo) {
+	var wg sync.WaitGroup
+	for _, pi := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dialCtx, cancel := context.WithTimeout(ctx, bootstrapTimeout)
+			defer cancel()
+			if err := h.Connect(dialCtx, pi); err != nil {
+				logrus.WithError(err).WithField("peer", pi.ID.String()).Warn("failed to connect bootstrap peer")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *P2P) Close() error {
+	if p.mdns != nil {
+		_ = p.mdns.Close()
+	}
+	if p.dht != nil {
+		_ = p.dht.Close()
+	}
+	return p.Host.Close()
+}
+
 func (p *P2P) GetPeerID() peer.ID {
 	if p == nil || p.Host == nil {
 		return ""
@@ -135,3 +288,24 @@ func (p *P2P) handlePeerDiscovery(peerCh <-chan peer.AddrInfo) error {
 	}
 	return g.Wait()
 }
+
+// mdnsNotifee connects to the peers advertising the service on the local network.
+type mdnsNotifee struct {
+	p2p *P2P
+}
+
+func (n *mdnsNotifee) HandlePeerFound(pi peer.AddrInfo) {
+	if pi.ID == n.p2p.Host.ID() {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(n.p2p.Ctx, 10*time.Second)
+		defer cancel()
+
+		if err := n.p2p.Host.Connect(ctx, pi); err != nil {
+			logrus.WithError(err).WithField("peer", pi.ID.String()).Debug("failed to connect mdns peer")
+			return
+		}
+		logrus.WithField("peer", pi.ID.String()).Debug("connected mdns peer")
+	}()
+}
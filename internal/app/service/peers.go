@@ -0,0 +1,348 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/rivo/tview"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	pagePeer = "peer"
+
+	connDirect      = "direct"
+	connRelayed     = "relayed"
+	connHolePunched = "hole-punched"
+
+	pingTimeout = 5 * time.Second
+)
+
+// PeerInfo describes a peer as known to the host's peerstore.
+type PeerInfo struct {
+	ID peer.ID `json:"id"`
+	// Connection is direct, relayed or hole-punched, empty when not connected.
+	Connection string `json:"connection,omitempty"`
+	// Latency is the moving average of the round trip time.
+	Latency      time.Duration `json:"latency,omitempty"`
+	AgentVersion string        `json:"agentVersion,omitempty"`
+	// Addrs are the known addresses of the peer, Conns the remote
+	// addresses and directions of the open connections.
+	Addrs     []string `json:"addrs"`
+	Conns     []string `json:"conns"`
+	Protocols []string `json:"protocols"`
+}
+
+// holePunchTracer remembers the peers reached through a successful hole punch.
+type holePunchTracer struct {
+	peers *sync.Map
+}
+
+func (t holePunchTracer) Trace(evt *holepunch.Event) {
+	if end, ok := evt.Evt.(*holepunch.EndHolePunchEvt); ok && end.Success {
+		t.peers.Store(evt.Remote, struct{}{})
+	}
+}
+
+// connection returns how the host is connected to the peer. A direct
+// connection is preferred over a relayed one.
+func (p *P2P) connection(id peer.ID) string {
+	kind := ""
+	for _, c := range p.Host.Network().ConnsToPeer(id) {
+		if isRelayed(c.RemoteMultiaddr()) {
+			kind = connRelayed
+			continue
+		}
+		if _, punched := p.holePunched.Load(id); punched {
+			return connHolePunched
+		}
+		return connDirect
+	}
+	return kind
+}
+
+func isRelayed(addr multiaddr.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(multiaddr.P_CIRCUIT)
+	return err == nil
+}
+
+// PeerInfo returns what the host knows about the peer.
+func (p *P2P) PeerInfo(id peer.ID) PeerInfo {
+	ps := p.Host.Peerstore()
+	info := PeerInfo{
+		ID:         id,
+		Connection: p.connection(id),
+		Latency:    ps.LatencyEWMA(id),
+		Addrs:      make([]string, 0),
+		Conns:      make([]string, 0),
+		Protocols:  make([]string, 0),
+	}
+	if v, err := ps.Get(id, "AgentVersion"); err == nil {
+		info.AgentVersion, _ = v.(string)
+	}
+	for _, addr := range ps.Addrs(id) {
+		info.Addrs = append(info.Addrs, addr.String())
+	}
+	for _, c := range p.Host.Network().ConnsToPeer(id) {
+		info.Conns = append(info.Conns, fmt.Sprintf("%s (%s)", c.RemoteMultiaddr(), c.Stat().Direction))
+	}
+	protocols, err := ps.GetProtocols(id)
+	if err == nil {
+		for _, proto := range protocols {
+			info.Protocols = append(info.Protocols, string(proto))
+		}
+	}
+	slices.Sort(info.Addrs)
+	slices.Sort(info.Protocols)
+	return info
+}
+
+// pingPeers measures the latency to the connected peers, the peerstore
+// keeps a moving average of the results.
+func (p *P2P) pingPeers(ctx context.Context, ids []peer.ID) {
+	for _, id := range ids {
+		if p.Host.Network().Connectedness(id) != network.Connected {
+			continue
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+			defer cancel()
+			if res := <-ping.Ping(ctx, p.Host, id); res.Error != nil {
+				logrus.WithError(res.Error).WithField("peer", id.String()).Debug("ping failed")
+			}
+		}()
+	}
+}
+
+// PeerInfo returns what the host, or the daemon's host, knows about the peer.
+func (cr *ChatRoom) PeerInfo(id peer.ID) (PeerInfo, error) {
+	if cr.remote != nil {
+		return cr.remote.PeerInfo(id)
+	}
+	return cr.Host.PeerInfo(id), nil
+}
+
+// syncPeerBox lists the peers of the room with their names, status and
+// connection, peers without a heartbeat by their shortened ID, and shows
+// the running downloads and who is typing above the input box. The selected peer stays selected.
+func (ui *UI) syncPeerBox() {
+	members := ui.Members()
+	slices.SortFunc(members, func(a, b Member) int {
+		if (a.SenderName == "") != (b.SenderName == "") {
+			if a.SenderName == "" {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Or(
+			strings.Compare(strings.ToLower(a.SenderName), strings.ToLower(b.SenderName)),
+			strings.Compare(a.ID.String(), b.ID.String()),
+		)
+	})
+
+	var selected peer.ID
+	if i := ui.peerBox.GetCurrentItem(); i >= 0 && i < len(ui.members) {
+		selected = ui.members[i].ID
+	}
+	ui.members = members
+	ui.peerBox.Clear()
+	var typing []string
+	for i, m := range members {
+		ui.peerBox.AddItem(ui.formatMember(m), formatConnection(m.Connection, m.Latency), 0, nil)
+		if m.ID == selected {
+			ui.peerBox.SetCurrentItem(i)
+		}
+		if m.SenderName == "" {
+			continue
+		}
+		ui.learnName(m.ID, m.SenderName)
+		if m.Typing {
+			typing = append(typing, m.SenderName)
+		}
+	}
+	status := typingText(typing)
+	if ui.Files != nil {
+		if transfers := transferText(ui.Files.Transfers()); transfers != "" && status != "" {
+			status = transfers + " | " + status
+		} else if transfers != "" {
+			status = transfers
+		}
+	}
+	ui.statusBox.SetText(status)
+}
+
+// formatMember renders the status and name of a peer, verified peers are
+// marked with a check.
+func (ui *UI) formatMember(m Member) string {
+	if m.SenderName == "" {
+		peerId := m.ID.String()
+		if len(peerId) > 8 {
+			peerId = peerId[len(peerId)-8:]
+		}
+		return fmt.Sprintf("[%s]%s[-]", ui.theme.Timestamp, peerId)
+	}
+	name := tview.Escape(m.SenderName)
+	if ui.isVerified(m.ID) {
+		name += " ✓"
+	}
+	switch m.Status {
+	case model.StatusAway:
+		return fmt.Sprintf("[%s]○ %s[-]", ui.theme.System, name)
+	case model.StatusIdle:
+		return fmt.Sprintf("[%s]◌ %s[-]", ui.theme.Timestamp, name)
+	default:
+		return fmt.Sprintf("[%s]● %s[-]", ui.theme.Peer, name)
+	}
+}
+
+func formatConnection(connection string, latency time.Duration) string {
+	if connection == "" {
+		return "not connected"
+	}
+	if latency > 0 {
+		return fmt.Sprintf("%s %s", connection, latency.Round(time.Millisecond))
+	}
+	return connection
+}
+
+// showPeer opens the details of the peer from the peerstore.
+func (ui *UI) showPeer(id peer.ID) {
+	cr := ui.ChatRoom
+	var member Member
+	for _, m := range ui.members {
+		if m.ID == id {
+			member = m
+		}
+	}
+	go func() {
+		info, err := cr.PeerInfo(id)
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			if err != nil {
+				ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "could not load peer details - " + err.Error()})
+				return
+			}
+			ui.writePeer(member, info)
+			if front, _ := ui.pages.GetFrontPage(); front != pagePeer {
+				ui.peerReturn = front
+			}
+			ui.pages.SwitchToPage(pagePeer)
+			ui.TerminalApp.SetFocus(ui.peerDetail)
+		})
+	}()
+}
+
+func (ui *UI) writePeer(m Member, info PeerInfo) {
+	name := m.SenderName
+	if name == "" {
+		name = "unknown"
+	}
+	ui.peerDetail.Clear()
+	ui.peerDetail.SetTitle(fmt.Sprintf("Peer %s#%s (Esc to close)", tview.Escape(name), fingerprint(info.ID.String())))
+	w := ui.peerDetail
+	label := func(l string) string {
+		return fmt.Sprintf("[%s]%-12s[-]", ui.theme.Timestamp, l)
+	}
+	fmt.Fprintf(w, "%s%s\n", label("ID"), info.ID)
+	if ui.isVerified(info.ID) {
+		fmt.Fprintf(w, "%s[%s]verified ✓[-]\n", label("Contact"), ui.theme.Own)
+	} else {
+		fmt.Fprintf(w, "%snot verified, compare the ID with them and /verify %s\n", label("Contact"), info.ID)
+	}
+	if m.Status != "" {
+		status := string(m.Status)
+		if m.Away != "" {
+			status += ": " + tview.Escape(m.Away)
+		}
+		fmt.Fprintf(w, "%s%s\n", label("Status"), status)
+	}
+	fmt.Fprintf(w, "%s%s\n", label("Connection"), formatConnection(info.Connection, info.Latency))
+	if info.AgentVersion != "" {
+		fmt.Fprintf(w, "%s%s\n", label("Agent"), tview.Escape(info.AgentVersion))
+	}
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"Connections", info.Conns},
+		{"Addresses", info.Addrs},
+		{"Protocols", info.Protocols},
+	}
+	for _, s := range sections {
+		fmt.Fprintf(w, "\n[%s]%s[-]\n", ui.theme.Timestamp, s.title)
+		if len(s.lines) == 0 {
+			fmt.Fprintln(w, "  none")
+		}
+		for _, line := range s.lines {
+			fmt.Fprintf(w, "  %s\n", tview.Escape(line))
+		}
+	}
+	ui.peerDetail.ScrollToBeginning()
+}
+
+func (ui *UI) closePeer() {
+	if ui.peerReturn == "" {
+		ui.peerReturn = pageRoom
+	}
+	ui.pages.SwitchToPage(ui.peerReturn)
+	ui.TerminalApp.SetFocus(ui.peerBox)
+}
+
+// loadContacts reads the verified peers, a broken file leaves none verified.
+func (ui *UI) loadContacts() {
+	contacts, err := storage.LoadContacts()
+	if err != nil {
+		logrus.WithError(err).Warn("failed to load contacts")
+	}
+	ui.contactsMu.Lock()
+	ui.contacts = contacts
+	ui.contactsMu.Unlock()
+}
+
+func (ui *UI) isVerified(id peer.ID) bool {
+	ui.contactsMu.Lock()
+	defer ui.contactsMu.Unlock()
+	_, ok := ui.contacts.Verified[id.String()]
+	return ok
+}
+
+// setVerified marks the peer as verified under its current name, or takes
+// the mark back, and saves the contacts.
+func (ui *UI) setVerified(id peer.ID, name string, verified bool) error {
+	ui.contactsMu.Lock()
+	defer ui.contactsMu.Unlock()
+	contacts := ui.contacts
+	contacts.Verified = maps.Clone(contacts.Verified)
+	if contacts.Verified == nil {
+		contacts.Verified = make(map[string]string)
+	}
+	if verified {
+		contacts.Verified[id.String()] = name
+	} else {
+		delete(contacts.Verified, id.String())
+	}
+	if err := storage.SaveContacts(contacts); err != nil {
+		return err
+	}
+	ui.contacts = contacts
+	return nil
+}
+
+// peerName returns the latest name known for the peer.
+func (ui *UI) peerName(id peer.ID) string {
+	ui.namesMu.Lock()
+	defer ui.namesMu.Unlock()
+	return ui.peerNames[id]
+}
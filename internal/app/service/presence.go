@@ -0,0 +1,299 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/rivo/tview"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// presenceInterval is how often the own presence is published in a room.
+	presenceInterval = 30 * time.Second
+	// presenceJoinDelay gives the mesh time to form before the first heartbeat.
+	presenceJoinDelay = 2 * time.Second
+	// presenceTimeout is how long a heartbeat counts without a newer one.
+	presenceTimeout = 3 * presenceInterval
+	// presenceReplyGap throttles answering peers seen for the first time.
+	presenceReplyGap = 5 * time.Second
+	// idleAfter is how long without typing or sending before the own status is idle.
+	idleAfter = 5 * time.Minute
+	// typingInterval throttles typing notices while writing a message.
+	typingInterval = 3 * time.Second
+	// typingTimeout is how long a peer is shown typing after its last notice.
+	typingTimeout = 2 * typingInterval
+	maxAwaySize   = 100
+)
+
+// Member is a peer of a room as listed in the peer box. Presence is empty
+// for peers that have not published a heartbeat recently, Connection and
+// Latency are as in PeerInfo.
+type Member struct {
+	ID peer.ID `json:"id"`
+	model.Presence
+	Typing     bool          `json:"typing,omitempty"`
+	Connection string        `json:"connection,omitempty"`
+	Latency    time.Duration `json:"latency,omitempty"`
+}
+
+// presence holds the own status in a room and the heartbeats of its peers.
+type presence struct {
+	mu          sync.Mutex
+	away        bool
+	awayMessage string
+	lastActive  time.Time
+	// sent is the status of the last own heartbeat, sentAt its time
+	sent       model.Status
+	sentAt     time.Time
+	lastTyping time.Time
+	peers      map[peer.ID]peerPresence
+}
+
+type peerPresence struct {
+	model.Presence
+	seen   time.Time
+	typing time.Time
+}
+
+// status returns the own status, p.mu must be held.
+func (p *presence) status() model.Status {
+	switch {
+	case p.away:
+		return model.StatusAway
+	case time.Since(p.lastActive) > idleAfter:
+		return model.StatusIdle
+	}
+	return model.StatusOnline
+}
+
+// presenceLoop publishes the own presence shortly after joining and then
+// periodically until the room is left, measuring the latency to the peers
+// of the room each time. Owner and moderators republish the room policy
+// with it.
+func (cr *ChatRoom) presenceLoop() {
+	timer := time.NewTimer(presenceJoinDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-cr.ctx.Done():
+			return
+		case <-timer.C:
+			if err := cr.publishPresence(); err != nil {
+				logrus.WithError(err).Debug("could not publish presence")
+			}
+			if cr.moderates() {
+				if err := cr.publishPolicy(); err != nil {
+					logrus.WithError(err).Debug("could not publish room policy")
+				}
+			}
+			cr.Host.pingPeers(cr.ctx, cr.topic.ListPeers())
+			timer.Reset(presenceInterval)
+		}
+	}
+}
+
+func (cr *ChatRoom) publishPresence() error {
+	cr.presence.mu.Lock()
+	p := model.Presence{
+		SenderID:   cr.peerId.String(),
+		SenderName: cr.UserName,
+		Status:     cr.presence.status(),
+		Away:       cr.presence.awayMessage,
+	}
+	cr.presence.sent = p.Status
+	cr.presence.sentAt = time.Now()
+	cr.presence.mu.Unlock()
+	return cr.publish(model.KindPresence, p)
+}
+
+// touch records activity of the user, an idle status is lifted right away.
+func (cr *ChatRoom) touch() {
+	cr.presence.mu.Lock()
+	wasIdle := cr.presence.sent == model.StatusIdle
+	cr.presence.lastActive = time.Now()
+	cr.presence.mu.Unlock()
+	if wasIdle {
+		if err := cr.publishPresence(); err != nil {
+			logrus.WithError(err).Debug("could not publish presence")
+		}
+	}
+}
+
+// Typing tells the room that the user is writing a message, at most once
+// every typingInterval.
+func (cr *ChatRoom) Typing() {
+	cr.presence.mu.Lock()
+	if time.Since(cr.presence.lastTyping) < typingInterval {
+		cr.presence.mu.Unlock()
+		return
+	}
+	cr.presence.lastTyping = time.Now()
+	cr.presence.mu.Unlock()
+
+	if cr.remote != nil {
+		if err := cr.remote.Typing(cr.RoomName); err != nil {
+			logrus.WithError(err).Debug("could not send typing notice")
+		}
+		return
+	}
+	cr.touch()
+	typing := model.Typing{SenderID: cr.peerId.String(), SenderName: cr.UserName}
+	if err := cr.publish(model.KindTyping, typing); err != nil {
+		logrus.WithError(err).Debug("could not send typing notice")
+	}
+}
+
+// SetAway sets the own status to away with the message, or back to online.
+func (cr *ChatRoom) SetAway(away bool, message string) error {
+	cr.presence.mu.Lock()
+	cr.presence.away = away
+	cr.presence.awayMessage = message
+	if !away {
+		cr.presence.awayMessage = ""
+		cr.presence.lastActive = time.Now()
+	}
+	cr.presence.mu.Unlock()
+
+	if cr.remote != nil {
+		return cr.remote.SetAway(cr.RoomName, away, message)
+	}
+	return cr.publishPresence()
+}
+
+// Away returns whether the own status is away and its message.
+func (cr *ChatRoom) Away() (bool, string) {
+	cr.presence.mu.Lock()
+	defer cr.presence.mu.Unlock()
+	return cr.presence.away, cr.presence.awayMessage
+}
+
+// receivePresence records the heartbeat of a peer. Peers seen for the first
+// time are answered with the own presence and the room policy so they need
+// not wait for the next.
+func (cr *ChatRoom) receivePresence(from peer.ID, p model.Presence) {
+	if p.SenderID != from.String() {
+		logrus.WithField("peer", from.String()).Debug("dropped a forged presence")
+		return
+	}
+	if !slices.Contains([]model.Status{model.StatusOnline, model.StatusIdle, model.StatusAway}, p.Status) {
+		p.Status = model.StatusOnline
+	}
+	if len(p.Away) > maxAwaySize {
+		p.Away = strings.ToValidUTF8(p.Away[:maxAwaySize], "")
+	}
+
+	cr.presence.mu.Lock()
+	if cr.presence.peers == nil {
+		cr.presence.peers = make(map[peer.ID]peerPresence)
+	}
+	prev, known := cr.presence.peers[from]
+	known = known && time.Since(prev.seen) < presenceTimeout
+	prev.Presence = p
+	prev.seen = time.Now()
+	cr.presence.peers[from] = prev
+	reply := !known && time.Since(cr.presence.sentAt) > presenceReplyGap
+	cr.presence.mu.Unlock()
+
+	if reply {
+		if err := cr.publishPresence(); err != nil {
+			logrus.WithError(err).Debug("could not publish presence")
+		}
+		if err := cr.publishPolicy(); err != nil {
+			logrus.WithError(err).Debug("could not publish room policy")
+		}
+	}
+}
+
+// receiveTyping marks the peer as typing, which also shows it is online.
+func (cr *ChatRoom) receiveTyping(from peer.ID, t model.Typing) {
+	if t.SenderID != from.String() {
+		logrus.WithField("peer", from.String()).Debug("dropped a forged typing notice")
+		return
+	}
+	cr.presence.mu.Lock()
+	defer cr.presence.mu.Unlock()
+	if cr.presence.peers == nil {
+		cr.presence.peers = make(map[peer.ID]peerPresence)
+	}
+	p := cr.presence.peers[from]
+	p.SenderID = t.SenderID
+	p.SenderName = t.SenderName
+	if p.Status == "" {
+		p.Status = model.StatusOnline
+	}
+	p.seen = time.Now()
+	p.typing = p.seen
+	cr.presence.peers[from] = p
+}
+
+// stopTyping clears the typing mark of a peer whose message arrived.
+func (cr *ChatRoom) stopTyping(from peer.ID) {
+	cr.presence.mu.Lock()
+	defer cr.presence.mu.Unlock()
+	if p, ok := cr.presence.peers[from]; ok {
+		p.typing = time.Time{}
+		cr.presence.peers[from] = p
+	}
+}
+
+// Members lists the peers of the room with their presence and whether they
+// are typing, leaving out ignored peers. Heartbeats of peers gone for longer
+// than presenceTimeout are forgotten.
+func (cr *ChatRoom) Members() []Member {
+	if cr.remote != nil {
+		members, err := cr.remote.Members(cr.RoomName)
+		if err != nil {
+			return nil
+		}
+		return members
+	}
+	ids := cr.topic.ListPeers()
+	now := time.Now()
+
+	cr.presence.mu.Lock()
+	defer cr.presence.mu.Unlock()
+	for id, p := range cr.presence.peers {
+		if now.Sub(p.seen) >= presenceTimeout {
+			delete(cr.presence.peers, id)
+		}
+	}
+	members := make([]Member, 0, len(ids))
+	for _, id := range ids {
+		if cr.Host.isIgnored(id.String()) {
+			continue
+		}
+		m := Member{
+			ID:         id,
+			Connection: cr.Host.connection(id),
+			Latency:    cr.Host.Host.Peerstore().LatencyEWMA(id),
+		}
+		if p, ok := cr.presence.peers[id]; ok {
+			m.Presence = p.Presence
+			m.Typing = now.Sub(p.typing) < typingTimeout
+		}
+		members = append(members, m)
+	}
+	return members
+}
+
+func typingText(names []string) string {
+	for i := range names {
+		names[i] = tview.Escape(names[i])
+	}
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return names[0] + " is typing…"
+	case 2:
+		return names[0] + " and " + names[1] + " are typing…"
+	default:
+		return fmt.Sprintf("%s and %d others are typing…", strings.Join(names[:2], ", "), len(names)-2)
+	}
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/rivo/tview"
+)
+
+const (
+	// maxEmojiSize bounds an emoji in bytes, enough for joined sequences like families.
+	maxEmojiSize = 32
+	// maxReactions bounds the different emoji on a single message.
+	maxReactions = 20
+)
+
+var (
+	errUnknownEmoji  = errors.New("unknown emoji")
+	errTooManyEmoji  = errors.New("too many different reactions")
+	errDeletedTarget = errors.New("message has been deleted")
+)
+
+// emojiCodes are the shortcodes accepted next to plain emoji.
+var emojiCodes = map[string]string{
+	"+1":         "👍",
+	"thumbsup":   "👍",
+	"-1":         "👎",
+	"thumbsdown": "👎",
+	"heart":      "❤️",
+	"joy":        "😂",
+	"smile":      "😄",
+	"wink":       "😉",
+	"cry":        "😢",
+	"open_mouth": "😮",
+	"thinking":   "🤔",
+	"tada":       "🎉",
+	"eyes":       "👀",
+	"fire":       "🔥",
+	"rocket":     "🚀",
+	"clap":       "👏",
+	"pray":       "🙏",
+	"wave":       "👋",
+	"ok_hand":    "👌",
+	"100":        "💯",
+	"check":      "✅",
+	"x":          "❌",
+}
+
+// parseEmoji returns the emoji of a shortcode like :+1:, or the emoji itself.
+func parseEmoji(s string) (string, error) {
+	if code, ok := strings.CutPrefix(s, ":"); ok {
+		if emoji, known := emojiCodes[strings.TrimSuffix(code, ":")]; known {
+			return emoji, nil
+		}
+		return "", fmt.Errorf("%w %s", errUnknownEmoji, s)
+	}
+	if !validEmoji(s) {
+		return "", fmt.Errorf("%w %s", errUnknownEmoji, s)
+	}
+	return s, nil
+}
+
+// validEmoji rejects text posing as an emoji, including color tags. Keycap
+// sequences are the only emoji containing ASCII.
+func validEmoji(s string) bool {
+	if s == "" || len(s) > maxEmojiSize {
+		return false
+	}
+	for _, r := range s {
+		if r < utf8.RuneSelf && !strings.ContainsRune("0123456789#*", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyReaction adds the reaction of its sender to the message or takes it back.
+func applyReaction(reaction model.Reaction, from peer.ID, msg *model.ChatMessage) error {
+	if reaction.SenderID != from.String() {
+		return errNotAuthor
+	}
+	if !validEmoji(reaction.Emoji) {
+		return fmt.Errorf("%w %q", errUnknownEmoji, reaction.Emoji)
+	}
+	if msg.Deleted {
+		return errDeletedTarget
+	}
+
+	peers := msg.Reactions[reaction.Emoji]
+	i := slices.Index(peers, reaction.SenderID)
+	switch {
+	case reaction.Removed && i >= 0:
+		peers = slices.Delete(slices.Clone(peers), i, i+1)
+	case !reaction.Removed && i < 0:
+		if len(peers) == 0 && len(msg.Reactions) >= maxReactions {
+			return errTooManyEmoji
+		}
+		peers = append(slices.Clone(peers), reaction.SenderID)
+	default:
+		return nil
+	}
+
+	reactions := maps.Clone(msg.Reactions)
+	if reactions == nil {
+		reactions = make(map[string][]string)
+	}
+	reactions[reaction.Emoji] = peers
+	if len(peers) == 0 {
+		delete(reactions, reaction.Emoji)
+	}
+	msg.Reactions = reactions
+	if len(reactions) == 0 {
+		msg.Reactions = nil
+	}
+	return nil
+}
+
+// React toggles the own reaction with the emoji on the message and returns
+// the message with its reactions.
+func (cr *ChatRoom) React(id string, emoji string) (model.ChatMessage, error) {
+	if cr.remote != nil {
+		return cr.remote.React(cr.RoomName, id, emoji)
+	}
+	own := cr.peerId.String()
+	return cr.changeMessage(id, func(msg *model.ChatMessage) error {
+		reaction := model.Reaction{
+			Target:   id,
+			SenderID: own,
+			Emoji:    emoji,
+			Removed:  slices.Contains(msg.Reactions[emoji], own),
+		}
+		if err := applyReaction(reaction, cr.peerId, msg); err != nil {
+			return err
+		}
+		return cr.publish(model.KindReact, reaction)
+	})
+}
+
+// formatReactions renders the reactions after the message text, most used
+// first. Reactions of this peer are shown in the own color.
+func (ui *UI) formatReactions(msg model.ChatMessage) string {
+	emoji := slices.Sorted(maps.Keys(msg.Reactions))
+	slices.SortStableFunc(emoji, func(a, b string) int {
+		return cmp.Compare(len(msg.Reactions[b]), len(msg.Reactions[a]))
+	})
+	own := ui.ChatRoom.peerId.String()
+	var b strings.Builder
+	for _, e := range emoji {
+		color := ui.theme.Timestamp
+		if slices.Contains(msg.Reactions[e], own) {
+			color = ui.theme.Own
+		}
+		// synced reactions are not checked against the known emoji
+		fmt.Fprintf(&b, " [%s]%s %d[-]", color, tview.Escape(e), len(msg.Reactions[e]))
+	}
+	return b.String()
+}
+
+// findMessage returns the shown message whose ID starts with the prefix.
+func (ui *UI) findMessage(prefix string) (model.ChatMessage, error) {
+	var found []model.ChatMessage
+	for _, msg := range ui.scrollback {
+		if strings.HasPrefix(msg.ID, prefix) {
+			found = append(found, msg)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return model.ChatMessage{}, fmt.Errorf("no message %s in view", prefix)
+	case 1:
+		return found[0], nil
+	default:
+		return model.ChatMessage{}, fmt.Errorf("message ID %s is ambiguous", prefix)
+	}
+}
+
+// startReaction writes the react command for the selected message into the
+// input box, only the emoji is left to type.
+func (ui *UI) startReaction() {
+	msg, ok := ui.selectedMessage()
+	if !ok {
+		ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "no message to react to"})
+		return
+	}
+	ui.inputBox.SetText(fmt.Sprintf("/react %s ", shortID(msg.ID)), true)
+	ui.TerminalApp.SetFocus(ui.inputBox)
+}
+
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
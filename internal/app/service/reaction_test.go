@@ -0,0 +1,68 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestApplyReaction(t *testing.T) {
+	a, b := peer.ID("a"), peer.ID("b")
+	reacted := func(emoji string, peers ...peer.ID) map[string][]string {
+		ids := make([]string, 0, len(peers))
+		for _, p := range peers {
+			ids = append(ids, p.String())
+		}
+		return map[string][]string{emoji: ids}
+	}
+	full := make(map[string][]string, maxReactions)
+	for i := range maxReactions {
+		full[fmt.Sprint(i)] = []string{b.String()}
+	}
+	fullWithA := maps.Clone(full)
+	fullWithA["0"] = []string{b.String(), a.String()}
+	react := func(from peer.ID, emoji string, removed bool) model.Reaction {
+		return model.Reaction{SenderID: from.String(), Emoji: emoji, Removed: removed}
+	}
+
+	tests := []struct {
+		desc      string
+		reaction  model.Reaction
+		from      peer.ID
+		msg       model.ChatMessage
+		reactions map[string][]string
+		err       error
+	}{
+		{"first reaction", react(a, "👍", false), a, model.ChatMessage{}, reacted("👍", a), nil},
+		{"second peer", react(b, "👍", false), b, model.ChatMessage{Reactions: reacted("👍", a)}, reacted("👍", a, b), nil},
+		{"same reaction again", react(a, "👍", false), a, model.ChatMessage{Reactions: reacted("👍", a)}, reacted("👍", a), nil},
+		{"taken back", react(a, "👍", true), a, model.ChatMessage{Reactions: reacted("👍", a, b)}, reacted("👍", b), nil},
+		{"last taken back", react(a, "👍", true), a, model.ChatMessage{Reactions: reacted("👍", a)}, nil, nil},
+		{"taken back without reacting", react(a, "👍", true), a, model.ChatMessage{Reactions: reacted("👍", b)}, reacted("👍", b), nil},
+		{"forged sender", react(a, "👍", false), b, model.ChatMessage{Reactions: reacted("👍", b)}, reacted("👍", b), errNotAuthor},
+		{"text as emoji", react(a, "[red]x", false), a, model.ChatMessage{}, nil, errUnknownEmoji},
+		{"deleted message", react(a, "👍", false), a, model.ChatMessage{Deleted: true}, nil, errDeletedTarget},
+		{"too many emoji", react(a, "👍", false), a, model.ChatMessage{Reactions: full}, full, errTooManyEmoji},
+		{"reacting with an emoji already there", react(a, "0", false), a, model.ChatMessage{Reactions: full}, fullWithA, nil},
+	}
+	for _, tt := range tests {
+		msg := tt.msg
+		before := maps.Clone(msg.Reactions)
+		err := applyReaction(tt.reaction, tt.from, &msg)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: applyReaction error = %v, want %v", tt.desc, err, tt.err)
+		}
+		if !maps.EqualFunc(msg.Reactions, tt.reactions, slices.Equal) || len(tt.reactions) == 0 && msg.Reactions != nil {
+			t.Errorf("%s: reactions = %v, want %v", tt.desc, msg.Reactions, tt.reactions)
+		}
+		// the stored copy read before must not change with it
+		if !maps.EqualFunc(tt.msg.Reactions, before, slices.Equal) {
+			t.Errorf("%s: applyReaction changed the reactions it was given", tt.desc)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	roomKeySalt   = "peerchat-room-key:"
+	roomScryptN   = 1 << 15
+	roomScryptR   = 8
+	roomScryptP   = 1
+	roomSecretLen = 32
+)
+
+var errRoomDecrypt = errors.New("could not decrypt room message")
+
+// roomCipher encrypts room traffic with a key derived from a shared passphrase.
+// The topic name is derived from the same secret, so it reveals neither
+// the room name nor the passphrase.
+type roomCipher struct {
+	topic string
+	aead  cipher.AEAD
+}
+
+func newRoomCipher(room string, passphrase string) (*roomCipher, error) {
+	secret, err := scrypt.Key([]byte(passphrase), []byte(roomKeySalt+room), roomScryptN, roomScryptR, roomScryptP, roomSecretLen)
+	if err != nil {
+		return nil, fmt.Errorf("derive room secret: %w", err)
+	}
+
+	topicID := make([]byte, 16)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("topic")), topicID); err != nil {
+		return nil, fmt.Errorf("derive topic: %w", err)
+	}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("message")), key); err != nil {
+		return nil, fmt.Errorf("derive message key: %w", err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher: %w", err)
+	}
+
+	return &roomCipher{
+		topic: "room-peerchat-e2e-" + hex.EncodeToString(topicID),
+		aead:  aead,
+	}, nil
+}
+
+// Seal encrypts plaintext as nonce||ciphertext bound to the topic name.
+func (c *roomCipher) Seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, []byte(c.topic)), nil
+}
+
+func (c *roomCipher) Open(data []byte) ([]byte, error) {
+	if len(data) < c.aead.NonceSize()+c.aead.Overhead() {
+		return nil, errRoomDecrypt
+	}
+	nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, []byte(c.topic))
+	if err != nil {
+		return nil, errRoomDecrypt
+	}
+	return plaintext, nil
+}
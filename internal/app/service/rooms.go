@@ -0,0 +1,228 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
+	"github.com/rivo/tview"
+	"github.com/sirupsen/logrus"
+)
+
+// joinRoom joins the room next to the others through the host of the given
+// one and shows it, or only shows it when it is joined already.
+func (ui *UI) joinRoom(current *ChatRoom, roomName string, roomKey string) *ChatRoom {
+	if roomName == "" {
+		roomName = defaultRoom
+	}
+	if cr := ui.findRoom(roomName, roomKey != ""); cr != nil {
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.showRoom(cr)
+		})
+		return cr
+	}
+
+	ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("joining new room <%s>...", roomName)}
+	cr, err := current.Open(roomName, roomKey)
+	if err != nil {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("could not join chat room - %s", err)}
+		return nil
+	}
+	ui.roomsMu.Lock()
+	ui.rooms = append(ui.rooms, cr)
+	ui.roomsMu.Unlock()
+	go ui.watchRoom(cr)
+
+	ui.TerminalApp.QueueUpdateDraw(func() {
+		ui.showRoom(cr)
+	})
+	return cr
+}
+
+// partRoom leaves the room and shows the one before it in the room list.
+// The last room cannot be left. A room joined through the daemon is left
+// by the daemon as well.
+func (ui *UI) partRoom(cr *ChatRoom) {
+	ui.roomsMu.Lock()
+	i := slices.Index(ui.rooms, cr)
+	n := len(ui.rooms)
+	if i < 0 || n == 1 {
+		ui.roomsMu.Unlock()
+		if i < 0 {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("not in room <%s>", cr.RoomName)}
+		} else {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "cannot leave the last room, use /quit instead"}
+		}
+		return
+	}
+	ui.rooms = slices.Delete(ui.rooms, i, i+1)
+	next := ui.rooms[max(0, i-1)]
+	ui.roomsMu.Unlock()
+
+	ui.TerminalApp.QueueUpdateDraw(func() {
+		delete(ui.unread, cr)
+		delete(ui.mentioned, cr)
+		if ui.ChatRoom == cr {
+			ui.showRoom(next)
+		} else {
+			ui.syncRoomBox()
+		}
+	})
+	if cr.remote != nil {
+		if err := cr.remote.Leave(cr.RoomName); err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("could not leave chat room - %s", err)}
+		}
+	}
+	cr.Exit()
+}
+
+// changeRoom replaces the room with another one.
+func (ui *UI) changeRoom(old *ChatRoom, roomName string, roomKey string) {
+	if cr := ui.joinRoom(old, roomName, roomKey); cr != nil && cr != old {
+		ui.partRoom(old)
+	}
+}
+
+// findRoom returns the joined room with the name, encrypted or not.
+func (ui *UI) findRoom(roomName string, encrypted bool) *ChatRoom {
+	ui.roomsMu.Lock()
+	defer ui.roomsMu.Unlock()
+	for _, cr := range ui.rooms {
+		if cr.RoomName == roomName && cr.Encrypted == encrypted {
+			return cr
+		}
+	}
+	return nil
+}
+
+// cycleRoom shows the next room in the room list, or a previous one for a
+// negative step.
+func (ui *UI) cycleRoom(step int) {
+	ui.roomsMu.Lock()
+	i := slices.Index(ui.rooms, ui.ChatRoom)
+	n := len(ui.rooms)
+	next := ui.rooms[((i+step)%n+n)%n]
+	ui.roomsMu.Unlock()
+	ui.showRoom(next)
+}
+
+// showRoom makes the room the current one, reading its latest messages
+// again as those received in the background were only stored.
+func (ui *UI) showRoom(cr *ChatRoom) {
+	ui.directPeer = ""
+	ui.pages.SwitchToPage(pageRoom)
+	if cr != ui.ChatRoom {
+		ui.ChatRoom = cr
+		ui.pinned = false
+		ui.loading = false
+		ui.scrollback = nil
+		ui.newer = false
+		ui.selected = ""
+		ui.renderScrollback()
+		if ui.jump.ID != "" {
+			ui.showMessage(ui.jump)
+		} else {
+			ui.loadLatest()
+		}
+	} else if ui.jump.ID != "" {
+		ui.showMessage(ui.jump)
+	}
+	ui.jump = model.ChatMessage{}
+	delete(ui.unread, cr)
+	delete(ui.mentioned, cr)
+	ui.syncRoomBox()
+	ui.syncPeerBox()
+}
+
+// watchRoom shows what arrives in the room until it is left. Messages of
+// rooms in the background are counted as unread, mentions of the own name
+// are marked and announced in any room.
+func (ui *UI) watchRoom(cr *ChatRoom) {
+	inbound := cr.Inbound
+	for {
+		select {
+		case <-cr.ctx.Done():
+			return
+		case msg, ok := <-inbound:
+			if !ok {
+				// the subscription has closed, its log message follows
+				inbound = nil
+				continue
+			}
+			ui.TerminalApp.QueueUpdateDraw(func() {
+				mentioned := ui.mentionsMe(msg)
+				if mentioned {
+					ui.notifyMention(cr, msg)
+				}
+				if cr != ui.ChatRoom {
+					ui.rememberPeer(msg)
+					ui.unread[cr]++
+					ui.mentioned[cr] = ui.mentioned[cr] || mentioned
+					ui.syncRoomBox()
+					return
+				}
+				ui.displayMessage(msg)
+			})
+		case msg := <-cr.Changes:
+			ui.TerminalApp.QueueUpdateDraw(func() {
+				if cr == ui.ChatRoom {
+					ui.updateMessage(msg)
+				}
+			})
+		case n := <-cr.Synced:
+			// the page is read here and handed to the draw loop, which reads
+			// the history of the room
+			history, err := cr.ReadHistory(storage.Query{Limit: historyPage})
+			if err != nil {
+				logrus.WithError(err).Warn("failed to reload history")
+			}
+			ui.TerminalApp.QueueUpdateDraw(func() {
+				if err == nil {
+					cr.History = history
+				}
+				if cr != ui.ChatRoom {
+					return
+				}
+				ui.displayHistory()
+				ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: fmt.Sprintf("synced %d messages", n)})
+			})
+		case log := <-cr.Logs:
+			ui.TerminalApp.QueueUpdateDraw(func() {
+				if cr != ui.ChatRoom {
+					log.Message = fmt.Sprintf("%s: %s", roomLabel(cr), log.Message)
+				}
+				ui.displayLogMessage(log)
+			})
+		}
+	}
+}
+
+// syncRoomBox lists the joined rooms with their unread message counts,
+// rooms where the own name was mentioned in the mention color.
+func (ui *UI) syncRoomBox() {
+	ui.roomsMu.Lock()
+	defer ui.roomsMu.Unlock()
+
+	ui.roomBox.Clear()
+	for _, cr := range ui.rooms {
+		label := tview.Escape(roomLabel(cr))
+		switch {
+		case cr == ui.ChatRoom:
+			fmt.Fprintf(ui.roomBox, "[%s]> %s[-]\n", ui.theme.Own, label)
+		case ui.mentioned[cr]:
+			fmt.Fprintf(ui.roomBox, "  %s [%s](@%d)[-]\n", label, ui.theme.Mention, ui.unread[cr])
+		case ui.unread[cr] > 0:
+			fmt.Fprintf(ui.roomBox, "  %s [%s](%d)[-]\n", label, ui.theme.Peer, ui.unread[cr])
+		default:
+			fmt.Fprintf(ui.roomBox, "  %s\n", label)
+		}
+	}
+}
+
+func roomLabel(cr *ChatRoom) string {
+	if cr.Encrypted {
+		return cr.RoomName + " (e2e)"
+	}
+	return cr.RoomName
+}
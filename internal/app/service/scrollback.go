@@ -0,0 +1,264 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
+	"github.com/rivo/tview"
+)
+
+const (
+	// maxScrollback bounds the room messages held by the message box. Pages
+	// scrolled out of it are read from storage again when scrolling back.
+	maxScrollback = 5 * historyPage
+	scrollStep    = 10
+)
+
+// displayHistory shows the latest page of the room history.
+func (ui *UI) displayHistory() {
+	ui.scrollback = slices.Clone(ui.ChatRoom.History)
+	ui.newer = false
+	ui.renderScrollback()
+}
+
+// appendScrollback shows a new room message below the others. While older
+// pages are shown it is only stored, End returns to the latest messages.
+func (ui *UI) appendScrollback(msg model.ChatMessage, color string) {
+	if ui.newer {
+		return
+	}
+	ui.scrollback = append(ui.scrollback, msg)
+	if len(ui.scrollback) <= maxScrollback+historyPage {
+		ui.writeMessage(ui.messageBox, msg, color)
+		return
+	}
+
+	// drop a page at the top at once rather than redrawing for every message
+	drop := len(ui.scrollback) - maxScrollback
+	shift := ui.lineCount(ui.formatMessages(ui.scrollback)) - ui.lineCount(ui.formatMessages(ui.scrollback[drop:]))
+	row, _ := ui.messageBox.GetScrollOffset()
+	ui.scrollback = slices.Clone(ui.scrollback[drop:])
+	ui.renderScrollback()
+	if ui.pinned {
+		ui.messageBox.ScrollTo(max(0, row-shift), 0)
+	}
+}
+
+// loadOlder reads the page before the first message shown and puts it above,
+// then scrolls up by rows from the former top, or to the new beginning.
+func (ui *UI) loadOlder(rows int, toBeginning bool) {
+	if ui.loading || len(ui.scrollback) == 0 {
+		return
+	}
+	ui.loading = true
+	cr := ui.ChatRoom
+	first := ui.scrollback[0]
+	go func() {
+		older, err := cr.ReadHistory(storage.Query{Until: first.CreatedAt, Limit: historyPage})
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.loading = false
+			if cr != ui.ChatRoom {
+				return
+			}
+			if err != nil {
+				ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "could not load older messages - " + err.Error()})
+				return
+			}
+			older = withoutShown(older, ui.scrollback)
+			if len(older) == 0 {
+				ui.messageBox.ScrollToBeginning()
+				return
+			}
+
+			top := ui.lineCount(ui.formatMessages(older))
+			window := append(older, ui.scrollback...)
+			if len(window) > maxScrollback {
+				window = window[:maxScrollback]
+				ui.newer = true
+			}
+			ui.scrollback = window
+			ui.pinned = true
+			ui.renderScrollback()
+			if toBeginning {
+				ui.messageBox.ScrollToBeginning()
+			} else {
+				ui.messageBox.ScrollTo(max(0, top-rows), 0)
+			}
+		})
+	}()
+}
+
+// loadNewer reads the page after the last message shown and puts it below,
+// dropping as many messages at the top as needed to stay within maxScrollback.
+func (ui *UI) loadNewer(rows int) {
+	if ui.loading || len(ui.scrollback) == 0 {
+		return
+	}
+	ui.loading = true
+	cr := ui.ChatRoom
+	last := ui.scrollback[len(ui.scrollback)-1]
+	go func() {
+		newer, err := cr.ReadHistory(storage.Query{Since: last.CreatedAt.Add(-time.Nanosecond), Limit: historyPage, First: true})
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.loading = false
+			if cr != ui.ChatRoom {
+				return
+			}
+			if err != nil {
+				ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "could not load newer messages - " + err.Error()})
+				return
+			}
+			ui.newer = len(newer) == historyPage
+			newer = withoutShown(newer, ui.scrollback)
+
+			row, _ := ui.messageBox.GetScrollOffset()
+			window := append(slices.Clone(ui.scrollback), newer...)
+			shift := 0
+			if drop := len(window) - maxScrollback; drop > 0 {
+				shift = ui.lineCount(ui.formatMessages(ui.scrollback)) - ui.lineCount(ui.formatMessages(ui.scrollback[drop:]))
+				window = window[drop:]
+			}
+			ui.scrollback = window
+			ui.pinned = true
+			ui.renderScrollback()
+			ui.messageBox.ScrollTo(max(0, row-shift+rows), 0)
+		})
+	}()
+}
+
+// loadLatest returns to the latest page of the room history. The pending
+// messages have been sent but may not be stored yet.
+func (ui *UI) loadLatest(pending ...model.ChatMessage) {
+	if ui.loading {
+		return
+	}
+	ui.loading = true
+	cr := ui.ChatRoom
+	go func() {
+		latest, err := cr.ReadHistory(storage.Query{Limit: historyPage})
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.loading = false
+			if cr != ui.ChatRoom {
+				return
+			}
+			if err != nil {
+				ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "could not load latest messages - " + err.Error()})
+				return
+			}
+			ui.scrollback = append(latest, withoutShown(pending, latest)...)
+			ui.newer = false
+			ui.pinned = false
+			ui.renderScrollback()
+			ui.messageBox.ScrollToEnd()
+		})
+	}()
+}
+
+// showMessage highlights a room message, reading the pages around it from
+// storage when it is not shown.
+func (ui *UI) showMessage(msg model.ChatMessage) {
+	if slices.ContainsFunc(ui.scrollback, func(m model.ChatMessage) bool { return m.ID == msg.ID }) {
+		ui.highlight(ui.messageBox, msg.ID)
+		return
+	}
+	if ui.loading {
+		return
+	}
+	ui.loading = true
+	cr := ui.ChatRoom
+	go func() {
+		before, err := cr.ReadHistory(storage.Query{Until: msg.CreatedAt, Limit: historyPage / 2})
+		var after []model.ChatMessage
+		if err == nil {
+			after, err = cr.ReadHistory(storage.Query{Since: msg.CreatedAt, Limit: historyPage / 2, First: true})
+		}
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.loading = false
+			if cr != ui.ChatRoom {
+				return
+			}
+			if err != nil {
+				ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "could not load the message - " + err.Error()})
+				return
+			}
+			ui.scrollback = append(before, withoutShown(after, before)...)
+			ui.newer = len(after) == historyPage/2
+			ui.renderScrollback()
+			ui.highlight(ui.messageBox, msg.ID)
+		})
+	}()
+}
+
+// atBottom reports whether the last line of the message box is in view.
+func (ui *UI) atBottom() bool {
+	row, _ := ui.messageBox.GetScrollOffset()
+	_, _, width, height := ui.messageBox.GetInnerRect()
+	if width != ui.scrollWidth {
+		ui.scrollLines = ui.lineCount(ui.formatMessages(ui.scrollback))
+		ui.scrollWidth = width
+	}
+	return row+height >= ui.scrollLines
+}
+
+func (ui *UI) renderScrollback() {
+	title := roomTitle(ui.ChatRoom)
+	if ui.newer {
+		title += " - End for the latest messages"
+	}
+	ui.scrollWidth = 0
+	ui.messageBox.Clear()
+	ui.messageBox.SetTitle(title)
+	fmt.Fprint(ui.messageBox, ui.formatMessages(ui.scrollback))
+}
+
+// formatMessages renders room messages the way they are shown in the
+// message box, with the date above the first message of each day.
+func (ui *UI) formatMessages(msgs []model.ChatMessage) string {
+	var b strings.Builder
+	var prevDay string
+	for _, msg := range msgs {
+		if day := msg.CreatedAt.Format(time.DateOnly); day != prevDay {
+			prevDay = day
+			ui.printDate(&b, msg.CreatedAt)
+		}
+		ui.rememberPeer(msg)
+		color := ui.theme.Peer
+		if ui.isOwn(msg) {
+			color = ui.theme.Own
+		}
+		ui.writeMessage(&b, msg, color)
+	}
+	return b.String()
+}
+
+// lineCount returns how many lines the text takes in the message box,
+// long lines are wrapped to its width.
+func (ui *UI) lineCount(text string) int {
+	if text == "" {
+		return 0
+	}
+	_, _, width, _ := ui.messageBox.GetInnerRect()
+	view := tview.NewTextView().
+		SetDynamicColors(true).
+		SetRegions(true).
+		SetSize(0, width)
+	view.SetText(strings.TrimSuffix(text, "\n"))
+	return view.GetWrappedLineCount()
+}
+
+// withoutShown drops the messages already in shown, pages are read with
+// inclusive bounds so that messages sharing a timestamp are not skipped.
+func withoutShown(msgs []model.ChatMessage, shown []model.ChatMessage) []model.ChatMessage {
+	ids := make(map[string]struct{}, len(shown))
+	for _, m := range shown {
+		ids[m.ID] = struct{}{}
+	}
+	return slices.DeleteFunc(msgs, func(m model.ChatMessage) bool {
+		_, ok := ids[m.ID]
+		return ok
+	})
+}
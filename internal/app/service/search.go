@@ -0,0 +1,249 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/rivo/tview"
+)
+
+const (
+	pageSearch = "search"
+
+	searchLimit   = 200
+	snippetLength = 60
+	searchDate    = "2006-01-02"
+)
+
+var errEmptySearch = errors.New("nothing to search for")
+
+// parseSearch parses the /search arguments: words, "quoted phrases" and
+// the filters from:<name or peer id>, room:<name>, since:<date or age>
+// and until:<date>. Dates are written as 2006-01-02, ages as 12h or 7d.
+func parseSearch(arg string) (storage.SearchQuery, error) {
+	q := storage.SearchQuery{Query: storage.Query{Limit: searchLimit}}
+
+	var tokens []string
+	var current strings.Builder
+	quoted := false
+	flush := func() {
+		if current.Len() > 0 {
+			if quoted {
+				q.Phrases = append(q.Phrases, current.String())
+			} else {
+				tokens = append(tokens, current.String())
+			}
+			current.Reset()
+		}
+	}
+	for _, r := range arg {
+		switch {
+		case r == '"':
+			flush()
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+
+	for _, token := range tokens {
+		name, value, found := strings.Cut(token, ":")
+		if !found || value == "" {
+			q.Terms = append(q.Terms, searchTerms(token)...)
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "from":
+			if id, err := peer.Decode(value); err == nil {
+				q.SenderID = id.String()
+			} else {
+				q.SenderName = value
+			}
+		case "room":
+			q.Rooms = append(q.Rooms, value, value+encryptedLogSuffix)
+		case "since":
+			t, err := parseSearchTime(value)
+			if err != nil {
+				return q, fmt.Errorf("since: %w", err)
+			}
+			q.Since = t.Add(-time.Nanosecond)
+		case "until":
+			t, err := time.ParseInLocation(searchDate, value, time.Local)
+			if err != nil {
+				return q, fmt.Errorf("until: expected a date like %s", searchDate)
+			}
+			q.Until = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		default:
+			q.Terms = append(q.Terms, searchTerms(token)...)
+		}
+	}
+
+	if len(q.Terms) == 0 && len(q.Phrases) == 0 && q.SenderID == "" && q.SenderName == "" {
+		return q, errEmptySearch
+	}
+	return q, nil
+}
+
+// searchTerms splits a word the same way stored messages are indexed.
+func searchTerms(word string) []string {
+	return strings.FieldsFunc(strings.ToLower(word), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func parseSearchTime(value string) (time.Time, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		var n int
+		if _, err := fmt.Sscanf(days, "%d", &n); err == nil && n >= 0 {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.ParseInLocation(searchDate, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a date like %s or an age like 12h or 7d", searchDate)
+	}
+	return t, nil
+}
+
+// showSearch lists the search results, newest first, in the search panel
+// titled as given.
+func (ui *UI) showSearch(title string, q storage.SearchQuery, records []storage.Record) {
+	if front, _ := ui.pages.GetFrontPage(); front != pageSearch {
+		ui.searchReturn = front
+	}
+	ui.searchList.Clear()
+	ui.searchList.SetTitle(fmt.Sprintf("%s (%d, Enter to jump, Esc to close)", tview.Escape(title), len(records)))
+	if len(records) == 0 {
+		ui.searchList.AddItem("no messages found", "", 0, nil)
+	}
+
+	needle := ""
+	if len(q.Phrases) > 0 {
+		needle = q.Phrases[0]
+	} else if len(q.Terms) > 0 {
+		needle = q.Terms[0]
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := records[i]
+		main := fmt.Sprintf("[%s]%s[-] [%s]<%s#%s>[-] in %s",
+			ui.theme.Timestamp, rec.CreatedAt.Format("2006-01-02 15:04"),
+			ui.theme.Peer, tview.Escape(rec.SenderName), fingerprint(rec.SenderID),
+			tview.Escape(conversationLabel(rec.Room)))
+		ui.searchList.AddItem(main, tview.Escape(snippet(rec.Message, needle)), 0, func() {
+			ui.jumpTo(rec)
+		})
+	}
+	ui.pages.SwitchToPage(pageSearch)
+	ui.TerminalApp.SetFocus(ui.searchList)
+}
+
+func (ui *UI) closeSearch() {
+	if ui.searchReturn == "" {
+		ui.searchReturn = pageRoom
+	}
+	ui.pages.SwitchToPage(ui.searchReturn)
+	ui.TerminalApp.SetFocus(ui.inputBox)
+}
+
+// jumpTo shows a search result in its conversation. Results from rooms that
+// are not joined are shown as stored, joining them is left to the user as
+// it announces them in the room.
+func (ui *UI) jumpTo(rec storage.Record) {
+	roomName, encrypted := strings.CutSuffix(rec.Room, encryptedLogSuffix)
+	joined := ui.findRoom(roomName, encrypted)
+	switch {
+	case strings.HasPrefix(rec.Room, directLogPrefix):
+		peerID, err := peer.Decode(strings.TrimPrefix(rec.Room, directLogPrefix))
+		if err != nil || ui.Direct == nil {
+			ui.closeSearch()
+			ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "direct messages are not available"})
+			return
+		}
+		ui.openDirect(peerID)
+		ui.highlight(ui.directBox, rec.ID)
+	case joined != nil:
+		ui.jump = rec.ChatMessage
+		ui.showRoom(joined)
+	default:
+		ui.closeSearch()
+		join := "/join " + roomName
+		if encrypted {
+			join += " --key <passphrase>"
+		}
+		ui.displayLogMessage(model.LogMessage{
+			Prefix: "system",
+			Message: fmt.Sprintf("%s <%s#%s> in %s: %s", rec.CreatedAt.Format("2006-01-02 15:04"),
+				rec.SenderName, fingerprint(rec.SenderID), conversationLabel(rec.Room), rec.Message),
+		})
+		ui.displayLogMessage(model.LogMessage{
+			Prefix:  "system",
+			Message: fmt.Sprintf("%s to see the message in its conversation", join),
+		})
+		return
+	}
+	ui.TerminalApp.SetFocus(ui.pages)
+}
+
+// highlight marks the message and keeps it in view until the user scrolls
+// to the end or sends a message.
+func (ui *UI) highlight(box *tview.TextView, id string) {
+	ui.pinned = true
+	box.Highlight(id).ScrollToHighlight()
+}
+
+func conversationLabel(logName string) string {
+	if id, ok := strings.CutPrefix(logName, directLogPrefix); ok {
+		return "direct-" + fingerprint(id)
+	}
+	if room, ok := strings.CutSuffix(logName, encryptedLogSuffix); ok {
+		return room + " (encrypted)"
+	}
+	return logName
+}
+
+// snippet returns the first line containing the needle, shortened around it.
+func snippet(text string, needle string) string {
+	lines := strings.Split(text, "\n")
+	line := lines[0]
+	pos := -1
+	for _, l := range lines {
+		lower := strings.ToLower(l)
+		if i := strings.Index(lower, strings.ToLower(needle)); needle != "" && i >= 0 {
+			line = l
+			// byte offsets only carry over when lower-casing kept the length
+			if len(lower) == len(l) {
+				pos = i
+			}
+			break
+		}
+	}
+	runes := []rune(line)
+	if len(runes) <= snippetLength {
+		return line
+	}
+	start := 0
+	if pos > 0 {
+		start = len([]rune(line[:pos])) - snippetLength/3
+		start = max(0, min(start, len(runes)-snippetLength))
+	}
+	result := string(runes[start : start+snippetLength])
+	if start > 0 {
+		result = "…" + result
+	}
+	if start+snippetLength < len(runes) {
+		result += "…"
+	}
+	return result
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
+	"github.com/rivo/tview"
+)
+
+const pageThread = "thread"
+
+// Thread returns the message followed by every reply to it or to one of its
+// replies, ordered by time.
+func (cr *ChatRoom) Thread(root model.ChatMessage) ([]model.ChatMessage, error) {
+	// replies from peers with a slow clock may be stamped before the root
+	later, err := cr.ReadHistory(storage.Query{Since: root.CreatedAt.Add(-historyClockSkew)})
+	if err != nil {
+		return nil, fmt.Errorf("read thread: %w", err)
+	}
+	ids := map[string]struct{}{root.ID: {}}
+	thread := []model.ChatMessage{root}
+	for _, msg := range later {
+		if msg.ReplyTo == nil {
+			continue
+		}
+		if _, ok := ids[msg.ReplyTo.ID]; ok {
+			ids[msg.ID] = struct{}{}
+			thread = append(thread, msg)
+		}
+	}
+	return thread, nil
+}
+
+// newReply references the message as the parent of a reply.
+func newReply(parent model.ChatMessage) *model.Reply {
+	return &model.Reply{
+		ID:         parent.ID,
+		SenderID:   parent.SenderID,
+		SenderName: parent.SenderName,
+		Quote:      snippet(parent.Message, ""),
+	}
+}
+
+// selectMessage moves the selection in the message box by step messages,
+// starting from the latest one.
+func (ui *UI) selectMessage(step int) {
+	if len(ui.scrollback) == 0 {
+		return
+	}
+	i := slices.IndexFunc(ui.scrollback, func(m model.ChatMessage) bool { return m.ID == ui.selected })
+	if i < 0 {
+		i = len(ui.scrollback)
+		if step > 0 {
+			i = -1
+		}
+	}
+	i = max(0, min(i+step, len(ui.scrollback)-1))
+	ui.selected = ui.scrollback[i].ID
+	ui.highlight(ui.messageBox, ui.selected)
+}
+
+// clearSelection drops the selection, for example when returning to the latest messages.
+func (ui *UI) clearSelection() {
+	ui.selected = ""
+	ui.messageBox.Highlight()
+}
+
+// selectedMessage returns the selected message, or the latest one from
+// another peer when none is selected.
+func (ui *UI) selectedMessage() (model.ChatMessage, bool) {
+	for i := len(ui.scrollback) - 1; i >= 0; i-- {
+		msg := ui.scrollback[i]
+		if ui.selected == "" && msg.SenderID != ui.ChatRoom.peerId.String() || ui.selected != "" && msg.ID == ui.selected {
+			return msg, true
+		}
+	}
+	return model.ChatMessage{}, false
+}
+
+// startReply makes the next message a reply to the selected one.
+func (ui *UI) startReply() {
+	parent, ok := ui.selectedMessage()
+	if !ok {
+		ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "no message to reply to"})
+		return
+	}
+	if ui.editing != nil {
+		ui.cancelEdit()
+	}
+	ui.replyTo = newReply(parent)
+	ui.inputBox.SetTitle(fmt.Sprintf("%s > reply to %s ", ui.UserName, tview.Escape(ui.quote(ui.replyTo))))
+	ui.TerminalApp.SetFocus(ui.inputBox)
+}
+
+// takeReply returns the parent of the message being sent and leaves reply mode.
+func (ui *UI) takeReply() *model.Reply {
+	reply := ui.replyTo
+	if reply != nil {
+		ui.cancelReply()
+	}
+	return reply
+}
+
+func (ui *UI) cancelReply() {
+	ui.replyTo = nil
+	ui.inputBox.SetTitle(ui.UserName + " > ")
+}
+
+// showThread lists the replies below the selected message on the thread page.
+func (ui *UI) showThread() {
+	root, ok := ui.selectedMessage()
+	if !ok {
+		ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "no message to show the thread of"})
+		return
+	}
+	cr := ui.ChatRoom
+	go func() {
+		thread, err := cr.Thread(root)
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			if err != nil {
+				ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "could not load the thread - " + err.Error()})
+				return
+			}
+			ui.threadBox.Clear()
+			ui.threadBox.SetTitle(fmt.Sprintf("Thread in %s (%d replies, Esc to close)", roomLabel(cr), len(thread)-1))
+			for _, msg := range thread {
+				color := ui.theme.Peer
+				if msg.SenderID == cr.peerId.String() {
+					color = ui.theme.Own
+				}
+				ui.writeMessage(ui.threadBox, msg, color)
+			}
+			ui.threadBox.ScrollToBeginning()
+			ui.pages.SwitchToPage(pageThread)
+			ui.TerminalApp.SetFocus(ui.threadBox)
+		})
+	}()
+}
+
+func (ui *UI) closeThread() {
+	ui.pages.SwitchToPage(pageRoom)
+	ui.TerminalApp.SetFocus(ui.pages)
+}
+
+// writeQuote prints the parent of a reply above it. The parent is taken
+// from the shown or stored messages, as the quote and the name of its author
+// are only the word of the peer replying. Without the parent the quote is
+// marked unverified and shown without a fingerprint.
+func (ui *UI) writeQuote(w io.Writer, reply *model.Reply, indent string) {
+	fmt.Fprintf(w, "%s[%s]↳ %s[-]\n", indent, ui.theme.Timestamp, tview.Escape(ui.quote(reply)))
+}
+
+func (ui *UI) quote(reply *model.Reply) string {
+	parent, ok := ui.findParent(reply.ID)
+	if !ok {
+		return fmt.Sprintf("<%s> (unverified): %s", reply.SenderName, strings.TrimSpace(reply.Quote))
+	}
+	quote := snippet(parent.Message, "")
+	if parent.Deleted {
+		quote = "(deleted)"
+	}
+	if parent.Synced {
+		return fmt.Sprintf("<%s> (unverified): %s", parent.SenderName, strings.TrimSpace(quote))
+	}
+	return fmt.Sprintf("<%s#%s>: %s", parent.SenderName, fingerprint(parent.SenderID), strings.TrimSpace(quote))
+}
+
+// findParent returns the message replied to from the shown messages, or
+// from the storage of the room.
+func (ui *UI) findParent(id string) (model.ChatMessage, bool) {
+	for i := len(ui.scrollback) - 1; i >= 0; i-- {
+		if msg := ui.scrollback[i]; msg.ID == id {
+			return msg, true
+		}
+	}
+	msg, err := ui.ChatRoom.storedMessage(id)
+	return msg, err == nil
+}
+
+// storedMessage returns the message with the ID from the room storage.
+// Rooms joined through a daemon keep none, their messages are not found.
+func (cr *ChatRoom) storedMessage(id string) (model.ChatMessage, error) {
+	if cr.remote != nil {
+		return model.ChatMessage{}, storage.ErrNotFound
+	}
+	return cr.storage.Get(id)
+}
@@ -1,145 +1,392 @@
 package service
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"runtime"
+	"io"
+	"maps"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Flicster/peerchat/internal/app/config"
 	"github.com/Flicster/peerchat/internal/app/model"
+	"github.com/Flicster/peerchat/internal/app/storage"
 	"github.com/gdamore/tcell/v2"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/rivo/tview"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	appVersion = "v1.0.0"
-	osLinux    = "linux"
+
+	pageRoom   = "room"
+	pageDirect = "direct"
+
+	// outgoingBuffer is how many typed messages may wait to be sent.
+	outgoingBuffer = 64
 )
 
 type uiCommand struct {
 	Type string
 	Arg  string
+	// Room is the room shown when the command was entered.
+	Room *ChatRoom
+}
+
+// outgoing is a typed message on its way to the room, or to the peer when
+// sent in a direct conversation.
+type outgoing struct {
+	cr  *ChatRoom
+	to  peer.ID
+	msg model.ChatMessage
 }
 
 type UI struct {
 	*ChatRoom
+	Direct      *Direct
+	Files       *Files
 	TerminalApp *tview.Application
-	MsgInputs   chan string
-	CmdInputs   chan uiCommand
 
-	peerBox    *tview.TextView
+	peerBox    *tview.List
+	peerDetail *tview.TextView
+	statusBox  *tview.TextView
+	roomBox    *tview.TextView
 	messageBox *tview.TextView
+	directBox  *tview.TextView
+	threadBox  *tview.TextView
+	pages      *tview.Pages
 	inputBox   *tview.TextArea
+	searchList *tview.List
+
+	// directPeer is the conversation shown in directBox, accessed from the draw loop only
+	directPeer peer.ID
+	// searchReturn is the page shown again when the search panel is closed,
+	// peerReturn when the peer details are
+	searchReturn string
+	peerReturn   string
+	// offers are the files offered by peers in the messages shown so far,
+	// lastOffer the ID of the latest. Both are accessed from the draw loop only.
+	offers    map[string]model.ChatMessage
+	lastOffer string
+	// members are the peers listed in peerBox, accessed from the draw loop only
+	members []Member
+	// pinned keeps the view in place when messages arrive, while a search
+	// result is highlighted or older pages are read
+	pinned bool
+	// jump is highlighted once the room it was found in is shown
+	jump model.ChatMessage
+	// scrollback holds the room messages in messageBox, newer is set when
+	// they do not reach the latest message and loading while a page is read.
+	// All three are accessed from the draw loop only.
+	scrollback []model.ChatMessage
+	newer      bool
+	loading    bool
+	// scrollLines caches the line count of scrollback at scrollWidth
+	scrollLines int
+	scrollWidth int
+	// selected is the ID of the message chosen in messageBox, replyTo the
+	// parent of the message being written and editing the own message whose
+	// text is in the input box. All three are accessed from the draw loop only.
+	selected string
+	replyTo  *model.Reply
+	editing  *model.ChatMessage
+
+	// outgoing holds the typed messages until sendLoop sends them.
+	outgoing chan outgoing
+	// Logs receives the notices of commands, shown in the open view. It
+	// shadows the Logs of the embedded ChatRoom, which is read off the draw loop.
+	Logs chan model.LogMessage
+	// rooms are the joined rooms in the order of the room list, ChatRoom
+	// is the one shown and changed on the draw loop only, like unread and
+	// mentioned. Commands run with the room they were entered in.
+	roomsMu   sync.Mutex
+	rooms     []*ChatRoom
+	unread    map[*ChatRoom]int
+	mentioned map[*ChatRoom]bool
+
+	// peerNames maps each peer to the latest name it gave itself,
+	// nameClaims the names to every peer that ever used them.
+	namesMu    sync.Mutex
+	peerNames  map[peer.ID]string
+	nameClaims map[string]map[peer.ID]struct{}
+	// contacts are the verified peers, loaded when the UI starts
+	contactsMu sync.Mutex
+	contacts   storage.Contacts
+	theme      config.Theme
+	notify     config.Notify
+	// screen is kept from the last draw to ring the bell
+	screen tcell.Screen
 }
 
-func NewUI(cr *ChatRoom) *UI {
+func NewUI(cr *ChatRoom, dm *Direct, files *Files, cfg config.UI) *UI {
 	app := tview.NewApplication()
+	// ui is assigned at the end, the callbacks below only run afterwards
+	var ui *UI
 
-	cmdchan := make(chan uiCommand)
-	msgchan := make(chan string)
+	borderColor := tcell.GetColor(cfg.Theme.Border)
+	titleColor := tcell.GetColor(cfg.Theme.Title)
+	sendKeys := parseKeys(cfg.Keys.Send)
+	focusKeys := parseKeys(cfg.Keys.Focus)
+	nextRoomKeys := parseKeys(cfg.Keys.NextRoom)
+	prevRoomKeys := parseKeys(cfg.Keys.PrevRoom)
+	selectPrevKeys := parseKeys(cfg.Keys.SelectPrev)
+	selectNextKeys := parseKeys(cfg.Keys.SelectNext)
+	replyKeys := parseKeys(cfg.Keys.Reply)
+	threadKeys := parseKeys(cfg.Keys.Thread)
+	editKeys := parseKeys(cfg.Keys.Edit)
+	reactKeys := parseKeys(cfg.Keys.React)
+	peersKeys := parseKeys(cfg.Keys.Peers)
 
 	titlebox := tview.NewTextView().
 		SetText(fmt.Sprintf("PeerChat. A P2P Chat Application. %s", appVersion)).
-		SetTextColor(tcell.ColorWhite).
+		SetTextColor(titleColor).
 		SetTextAlign(tview.AlignCenter)
 
 	titlebox.
 		SetBorder(true).
-		SetBorderColor(tcell.ColorGreen)
+		SetBorderColor(borderColor)
 
 	messagebox := tview.NewTextView()
 	messagebox.
 		SetDynamicColors(true).
+		SetRegions(true).
 		SetChangedFunc(func() {
 			app.QueueUpdateDraw(func() {
-				messagebox.ScrollToEnd()
+				if !ui.pinned {
+					messagebox.ScrollToEnd()
+				}
 			})
 		}).
 		SetBorder(true).
-		SetBorderColor(tcell.ColorGreen).
-		SetTitle(fmt.Sprintf("ChatRoom-%s", cr.RoomName)).
+		SetBorderColor(borderColor).
+		SetTitle(roomTitle(cr)).
 		SetTitleAlign(tview.AlignLeft).
-		SetTitleColor(tcell.ColorWhite).
+		SetTitleColor(titleColor).
 		SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+			switch {
+			case matchKeys(selectPrevKeys, event):
+				ui.selectMessage(-1)
+				return nil
+			case matchKeys(selectNextKeys, event):
+				ui.selectMessage(1)
+				return nil
+			case matchKeys(replyKeys, event):
+				ui.startReply()
+				return nil
+			case matchKeys(threadKeys, event):
+				ui.showThread()
+				return nil
+			case matchKeys(editKeys, event):
+				ui.startEdit()
+				return nil
+			case matchKeys(reactKeys, event):
+				ui.startReaction()
+				return nil
+			}
 			switch event.Key() {
 			case tcell.KeyUp:
 				row, _ := messagebox.GetScrollOffset()
 				if row > 0 {
 					messagebox.ScrollTo(row-1, 0)
+				} else {
+					ui.loadOlder(1, false)
 				}
 				return nil
 			case tcell.KeyDown:
+				if ui.newer && ui.atBottom() {
+					ui.loadNewer(1)
+					return nil
+				}
 				row, _ := messagebox.GetScrollOffset()
 				messagebox.ScrollTo(row+1, 0)
 				return nil
 			case tcell.KeyHome:
-				messagebox.ScrollToBeginning()
+				row, _ := messagebox.GetScrollOffset()
+				if row > 0 {
+					messagebox.ScrollToBeginning()
+				} else {
+					ui.loadOlder(0, true)
+				}
 				return nil
 			case tcell.KeyEnd:
+				ui.pinned = false
+				ui.clearSelection()
+				if ui.newer {
+					ui.loadLatest()
+				}
 				messagebox.ScrollToEnd()
 				return nil
 			case tcell.KeyPgUp:
 				row, _ := messagebox.GetScrollOffset()
-				if row > 10 {
-					messagebox.ScrollTo(row-10, 0)
-				} else {
+				if row > scrollStep {
+					messagebox.ScrollTo(row-scrollStep, 0)
+				} else if row > 0 {
 					messagebox.ScrollToBeginning()
+				} else {
+					ui.loadOlder(scrollStep, false)
 				}
 				return nil
 			case tcell.KeyPgDn:
+				if ui.newer && ui.atBottom() {
+					ui.loadNewer(scrollStep)
+					return nil
+				}
 				row, _ := messagebox.GetScrollOffset()
-				messagebox.ScrollTo(row+10, 0)
+				messagebox.ScrollTo(row+scrollStep, 0)
 				return nil
 			default:
 				return event
 			}
 		})
 
-	inputPlaceholder := "Write message here...(Alt+Enter to send)"
-	usageControlText := "[yellow]Alt+Enter[green] - send message | [yellow]Tab[green] - change focus to scroll messages and back"
-	if runtime.GOOS != osLinux {
-		usageControlText = "[yellow]Ctrl+S[green] - send message | [yellow]Tab[green] - change focus to scroll messages and back"
-		inputPlaceholder = "Write message here...(Ctrl+S to send)"
-	}
+	directbox := tview.NewTextView()
+	directbox.
+		SetDynamicColors(true).
+		SetRegions(true).
+		SetChangedFunc(func() {
+			app.QueueUpdateDraw(func() {
+				if !ui.pinned {
+					directbox.ScrollToEnd()
+				}
+			})
+		}).
+		SetBorder(true).
+		SetBorderColor(borderColor).
+		SetTitleAlign(tview.AlignLeft).
+		SetTitleColor(titleColor)
+
+	threadbox := tview.NewTextView()
+	threadbox.
+		SetDynamicColors(true).
+		SetRegions(true).
+		SetDoneFunc(func(tcell.Key) {
+			ui.closeThread()
+		}).
+		SetBorder(true).
+		SetBorderColor(borderColor).
+		SetTitleAlign(tview.AlignLeft).
+		SetTitleColor(titleColor)
+
+	searchlist := tview.NewList().
+		SetMainTextColor(titleColor).
+		SetSecondaryTextColor(tcell.GetColor(cfg.Theme.System)).
+		SetDoneFunc(func() {
+			ui.closeSearch()
+		})
+	searchlist.
+		SetBorder(true).
+		SetBorderColor(borderColor).
+		SetTitleAlign(tview.AlignLeft).
+		SetTitleColor(titleColor)
+
+	peerdetail := tview.NewTextView()
+	peerdetail.
+		SetDynamicColors(true).
+		SetDoneFunc(func(tcell.Key) {
+			ui.closePeer()
+		}).
+		SetBorder(true).
+		SetBorderColor(borderColor).
+		SetTitleAlign(tview.AlignLeft).
+		SetTitleColor(titleColor)
+
+	pages := tview.NewPages().
+		AddPage(pageRoom, messagebox, true, true).
+		AddPage(pageDirect, directbox, true, false).
+		AddPage(pageSearch, searchlist, true, false).
+		AddPage(pageThread, threadbox, true, false).
+		AddPage(pagePeer, peerdetail, true, false)
+
+	sendLabel := config.KeyLabel(cfg.Keys.Send[0])
+	focusLabel := config.KeyLabel(cfg.Keys.Focus[0])
+	inputPlaceholder := fmt.Sprintf("Write message here...(%s to send)", sendLabel)
+	usageControlText := fmt.Sprintf("[yellow]%s[green] - send message | [yellow]%s[green] - change focus to scroll messages and back", sendLabel, focusLabel)
 	usage := tview.NewTextView().
 		SetDynamicColors(true).
 		SetText(fmt.Sprintf(`%s
-[red]/quit[green] - quit the chat | [red]/room <roomname>[green] - change chat room | [red]/user <username>[green] - change user name | [red]/clear[green] - clear the chat`, usageControlText))
+[red]/quit[green] - quit the chat | [red]/room <roomname> [--key <passphrase>][green] - change chat room | [red]/user <username>[green] - change user name | [red]/clear[green] - clear the chat
+[red]/join <roomname> [--key <passphrase>][green] - join another room | [red]/part [roomname[][green] - leave a room | [yellow]%s[green]/[yellow]%s[green] - next/previous room
+[red]/msg <peer> [text][green] - direct message to a peer | [red]/back[green] - back to the chat room | [red]/away [message[][green] - set yourself away, or back when away
+[red]/search <words> ["phrase"] [from:<name>] [room:<name>] [since:<date>] [until:<date>][green] - search the history
+[red]/reply <text>[green] - reply to the selected message | [red]/thread[green] - show its replies | [yellow]%s[green]/[yellow]%s[green] - select a message, [yellow]%s[green] - reply, [yellow]%s[green] - thread
+[red]/edit <text>[green] - edit your selected or latest message | [red]/delete[green] - delete it | [yellow]%s[green] - edit the selected message
+[red]/react [id[] <emoji>[green] - toggle a reaction like :+1: on a message | [yellow]%s[green] - react to the selected message
+[red]/mentions[green] - list recent mentions of you | [yellow]@name[green] and [yellow]Tab[green] - complete a mention
+[red]/peer <peer>[green] - show peer details | [red]/verify <peer ID>[green], [red]/unverify <peer>[green] - mark a peer whose ID you compared with them | [red]/ignore[green], [red]/unignore <peer>[green] - hide a peer | [yellow]%s[green] - select a peer
+[red]/send <path>[green] - offer a file in the room or conversation | [red]/accept [id[][green] - download the latest or given offer
+[red]/claim[green] - own a room without owner | [red]/mod <peer>[green], [red]/unmod <peer>[green] - appoint moderators | [red]/kick[green], [red]/ban[green], [red]/mute <peer> [reason[][green] | [red]/unban[green], [red]/unmute <peer>[green] | [red]/policy[green] - show them | [red]/stats[green] - rejected messages`,
+			usageControlText, config.KeyLabel(cfg.Keys.NextRoom[0]), config.KeyLabel(cfg.Keys.PrevRoom[0]),
+			config.KeyLabel(cfg.Keys.SelectPrev[0]), config.KeyLabel(cfg.Keys.SelectNext[0]), config.KeyLabel(cfg.Keys.Reply[0]), config.KeyLabel(cfg.Keys.Thread[0]),
+			config.KeyLabel(cfg.Keys.Edit[0]), config.KeyLabel(cfg.Keys.React[0]), config.KeyLabel(cfg.Keys.Peers[0])))
 
 	usage.
 		SetTitle("Usage").
 		SetTitleAlign(tview.AlignLeft).
-		SetTitleColor(tcell.ColorWhite).
+		SetTitleColor(titleColor).
 		SetBorder(true).
-		SetBorderColor(tcell.ColorGreen).
+		SetBorderColor(borderColor).
 		SetBorderPadding(0, 0, 1, 0)
 
-	peerbox := tview.NewTextView().
-		SetChangedFunc(func() {
-			app.QueueUpdateDraw(func() {})
+	peerbox := tview.NewList().
+		SetMainTextColor(titleColor).
+		SetSecondaryTextColor(tcell.GetColor(cfg.Theme.Timestamp)).
+		SetSelectedFocusOnly(true).
+		SetSelectedFunc(func(i int, _ string, _ string, _ rune) {
+			if i < len(ui.members) {
+				ui.showPeer(ui.members[i].ID)
+			}
+		}).
+		SetDoneFunc(func() {
+			app.SetFocus(ui.inputBox)
 		})
 	peerbox.
 		SetBorder(true).
-		SetBorderColor(tcell.ColorGreen).
+		SetBorderColor(borderColor).
 		SetTitle("Peers").
 		SetTitleAlign(tview.AlignLeft).
-		SetTitleColor(tcell.ColorWhite)
+		SetTitleColor(titleColor)
+
+	roombox := tview.NewTextView().
+		SetDynamicColors(true).
+		SetChangedFunc(func() {
+			app.QueueUpdateDraw(func() {})
+		})
+	roombox.
+		SetBorder(true).
+		SetBorderColor(borderColor).
+		SetTitle("Rooms").
+		SetTitleAlign(tview.AlignLeft).
+		SetTitleColor(titleColor)
 
 	input := tview.NewTextArea()
 	input.SetText("", true).
 		SetPlaceholder(inputPlaceholder).
 		SetTitle(cr.UserName+" > ").
 		SetTitleAlign(tview.AlignLeft).
-		SetTitleColor(tcell.ColorWhite).
+		SetTitleColor(titleColor).
 		SetBorder(true).
-		SetBorderColor(tcell.ColorGreen).
+		SetBorderColor(borderColor).
 		SetBorderPadding(0, 0, 1, 0)
 
+	statusbox := tview.NewTextView().
+		SetDynamicColors(true).
+		SetTextColor(tcell.GetColor(cfg.Theme.Timestamp))
+	statusbox.SetBorderPadding(0, 0, 1, 0)
+
+	input.SetChangedFunc(func() {
+		text := input.GetText()
+		if text != "" && !strings.HasPrefix(text, "/") && ui.directPeer == "" {
+			go ui.ChatRoom.Typing()
+		}
+	})
+
 	input.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		switch {
-		case event.Key() == tcell.KeyCtrlS ||
-			event.Key() == tcell.KeyEnter && event.Modifiers() == tcell.ModAlt:
+		case matchKeys(sendKeys, event):
 			line := input.GetText()
 			if len(strings.TrimSpace(line)) == 0 {
 				input.SetText("", true)
@@ -151,13 +398,19 @@ func NewUI(cr *ChatRoom) *UI {
 				if len(cmdparts) == 1 {
 					cmdparts = append(cmdparts, "")
 				}
-				cmdchan <- uiCommand{Type: cmdparts[0], Arg: cmdparts[1]}
+				go ui.handleCommand(uiCommand{Type: cmdparts[0], Arg: cmdparts[1], Room: ui.ChatRoom})
 			} else {
-				msgchan <- line
+				ui.sendMessage(line)
 			}
 
 			input.SetText("", true)
 			return nil
+		case event.Key() == tcell.KeyEscape && ui.replyTo != nil:
+			ui.cancelReply()
+			return nil
+		case event.Key() == tcell.KeyEscape && ui.editing != nil:
+			ui.cancelEdit()
+			return nil
 		}
 		return event
 	})
@@ -165,82 +418,152 @@ func NewUI(cr *ChatRoom) *UI {
 	flex := tview.NewFlex().SetDirection(tview.FlexRow).
 		AddItem(titlebox, 3, 1, false).
 		AddItem(tview.NewFlex().SetDirection(tview.FlexColumn).
-			AddItem(messagebox, 0, 1, false).
+			AddItem(roombox, 20, 1, false).
+			AddItem(pages, 0, 1, false).
 			AddItem(peerbox, 20, 1, false),
 			0, 8, false).
+		AddItem(statusbox, 1, 0, false).
 		AddItem(input, 0, 2, true).
-		AddItem(usage, 4, 1, false)
+		AddItem(usage, 14, 1, false)
 
 	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		if event.Key() == tcell.KeyTab {
+		switch {
+		case event.Key() == tcell.KeyTab && input.HasFocus() && ui.completeMention():
+			return nil
+		case matchKeys(focusKeys, event):
 			if input.HasFocus() {
-				app.SetFocus(messagebox)
+				app.SetFocus(pages)
 			} else {
 				app.SetFocus(input)
 			}
 			return nil
+		case matchKeys(peersKeys, event):
+			app.SetFocus(peerbox)
+			return nil
+		case matchKeys(nextRoomKeys, event):
+			ui.cycleRoom(1)
+			return nil
+		case matchKeys(prevRoomKeys, event):
+			ui.cycleRoom(-1)
+			return nil
 		}
 		return event
 	})
 
+	app.SetBeforeDrawFunc(func(screen tcell.Screen) bool {
+		ui.screen = screen
+		return false
+	})
 	app.SetRoot(flex, true).SetFocus(input)
 
-	return &UI{
+	ui = &UI{
 		ChatRoom:    cr,
+		Direct:      dm,
+		Files:       files,
 		TerminalApp: app,
 		peerBox:     peerbox,
+		peerDetail:  peerdetail,
+		statusBox:   statusbox,
+		roomBox:     roombox,
 		messageBox:  messagebox,
+		directBox:   directbox,
+		threadBox:   threadbox,
+		pages:       pages,
 		inputBox:    input,
-		MsgInputs:   msgchan,
-		CmdInputs:   cmdchan,
+		searchList:  searchlist,
+		Logs:        make(chan model.LogMessage),
+		outgoing:    make(chan outgoing, outgoingBuffer),
+		rooms:       []*ChatRoom{cr},
+		unread:      make(map[*ChatRoom]int),
+		mentioned:   make(map[*ChatRoom]bool),
+		offers:      make(map[string]model.ChatMessage),
+		peerNames:   make(map[peer.ID]string),
+		nameClaims:  make(map[string]map[peer.ID]struct{}),
+		theme:       cfg.Theme,
+		notify:      setupNotify(cfg.Notify),
+	}
+	return ui
+}
+
+func parseKeys(specs []string) []config.Key {
+	keys := make([]config.Key, 0, len(specs))
+	for _, spec := range specs {
+		if key, err := config.ParseKey(spec); err == nil {
+			keys = append(keys, key)
+		}
 	}
+	return keys
+}
+
+func matchKeys(keys []config.Key, event *tcell.EventKey) bool {
+	for _, key := range keys {
+		if key.Match(event) {
+			return true
+		}
+	}
+	return false
 }
 
 func (ui *UI) Run() error {
+	ui.loadContacts()
 	ui.displayHistory()
+	ui.syncRoomBox()
+	go ui.watchRoom(ui.ChatRoom)
 	go ui.start()
+	go ui.sendLoop()
 
 	defer ui.Close()
 	return ui.TerminalApp.Run()
 }
 
 func (ui *UI) Close() {
-	ui.ChatRoom.cancel()
+	ui.roomsMu.Lock()
+	for _, cr := range ui.rooms {
+		cr.cancel()
+	}
+	ui.roomsMu.Unlock()
+	if ui.Direct != nil {
+		ui.Direct.Close()
+	}
+	if ui.Files != nil {
+		ui.Files.Close()
+	}
 }
 
 func (ui *UI) start() {
 	defer func() {
 		if r := recover(); r != nil {
-			logrus.Warn("ui start recovered from panic: %v\n", r)
+			logrus.Warnf("ui start recovered from panic: %v", r)
 		}
 	}()
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
+	// direct messages are not available when attached to a daemon,
+	// receiving from the nil channel blocks forever
+	var directInbound chan model.DirectMessage
+	if ui.Direct != nil {
+		directInbound = ui.Direct.Inbound
+	}
+	var filesFinished chan Transfer
+	if ui.Files != nil {
+		filesFinished = ui.Files.Finished
+	}
+
 	for {
 		select {
-		case msg := <-ui.MsgInputs:
-			m := model.ChatMessage{
-				Message:    msg,
-				SenderID:   ui.ChatRoom.peerId.String(),
-				SenderName: ui.ChatRoom.UserName,
-				CreatedAt:  time.Now(),
-			}
+		case log := <-ui.Logs:
 			ui.TerminalApp.QueueUpdateDraw(func() {
-				ui.displayMessage(m)
+				ui.displayLogMessage(log)
 			})
-			ui.Outbound <- m
-		case cmd := <-ui.CmdInputs:
-			go ui.handleCommand(cmd)
-		case msg := <-ui.ChatRoom.Inbound:
+		case msg := <-directInbound:
 			m := msg
 			ui.TerminalApp.QueueUpdateDraw(func() {
-				ui.displayMessage(m)
+				ui.displayDirectMessage(m)
 			})
-		case log := <-ui.ChatRoom.Logs:
-			l := log
+		case t := <-filesFinished:
 			ui.TerminalApp.QueueUpdateDraw(func() {
-				ui.displayLogMessage(l)
+				ui.displayTransfer(t)
 			})
 		case <-ticker.C:
 			ui.TerminalApp.QueueUpdateDraw(func() {
@@ -250,37 +573,335 @@ func (ui *UI) start() {
 	}
 }
 
+// sendMessage shows the typed text in the open direct conversation, or in
+// the room shown together with the message it edits or replies to, and
+// queues it for sendLoop. It runs on the draw loop and never waits.
+func (ui *UI) sendMessage(text string) {
+	o := outgoing{cr: ui.ChatRoom, to: ui.directPeer}
+	o.msg = model.ChatMessage{
+		ID:         model.NewMessageID(),
+		Message:    text,
+		SenderID:   o.cr.peerId.String(),
+		SenderName: o.cr.UserName,
+		CreatedAt:  time.Now(),
+	}
+	if o.to != "" {
+		ui.writeMessage(ui.directBox, o.msg, ui.theme.Own)
+	} else if edited, ok := ui.takeEdit(text); ok {
+		o.msg = edited
+		ui.updateMessage(o.msg)
+	} else {
+		o.msg.ReplyTo = ui.takeReply()
+		ui.pinned = false
+		if ui.newer {
+			ui.loadLatest(o.msg)
+		} else {
+			ui.displayMessage(o.msg)
+		}
+	}
+	select {
+	case ui.outgoing <- o:
+	default:
+		ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "too many messages waiting to be sent, this one was not sent"})
+	}
+}
+
+// sendLoop sends the typed messages in order. Direct messages are sent on
+// their own as their delivery waits for the acknowledgement of the peer.
+func (ui *UI) sendLoop() {
+	for o := range ui.outgoing {
+		if o.to != "" {
+			go func() {
+				if err := ui.Direct.Send(o.to, o.msg); err != nil {
+					ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("message was not delivered - %s", err)}
+				}
+			}()
+			continue
+		}
+		select {
+		case o.cr.Outbound <- o.msg:
+		case <-o.cr.ctx.Done():
+		}
+	}
+}
+
 func (ui *UI) handleCommand(cmd uiCommand) {
+	cr := cmd.Room
 	switch cmd.Type {
 	case "/quit":
 		ui.TerminalApp.Stop()
 		return
 	case "/clear":
-		err := ui.ChatRoom.ClearHistory()
+		err := cr.ClearHistory()
 		if err != nil {
 			ui.Logs <- model.LogMessage{Prefix: "system", Message: "failed to clear history: " + err.Error()}
 			return
 		}
 		ui.TerminalApp.QueueUpdateDraw(func() {
-			ui.messageBox.Clear()
+			if cr != ui.ChatRoom {
+				return
+			}
+			ui.scrollback = nil
+			ui.newer = false
+			ui.selected = ""
+			ui.renderScrollback()
 		})
 	case "/room":
-		if cmd.Arg == "" {
+		roomName, roomKey, _ := strings.Cut(cmd.Arg, " --key ")
+		roomName = strings.TrimSpace(roomName)
+		if roomName == "" {
 			ui.Logs <- model.LogMessage{Prefix: "system", Message: "missing room name for command"}
 			return
-		} else if cmd.Arg == ui.RoomName {
+		} else if roomName == cr.RoomName && roomKey == "" && !cr.Encrypted {
 			return
 		} else {
-			ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("joining new room <%s>...", cmd.Arg)}
-			ui.changeRoom(cmd.Arg)
+			ui.changeRoom(cr, roomName, roomKey)
+		}
+	case "/join":
+		roomName, roomKey, _ := strings.Cut(cmd.Arg, " --key ")
+		roomName = strings.TrimSpace(roomName)
+		if roomName == "" {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "missing room name for command"}
+			return
+		}
+		ui.joinRoom(cr, roomName, roomKey)
+	case "/part":
+		if roomName := strings.TrimSpace(cmd.Arg); roomName != "" {
+			if cr = ui.findRoom(roomName, false); cr == nil {
+				cr = ui.findRoom(roomName, true)
+			}
+			if cr == nil {
+				ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("not in room <%s>", roomName)}
+				return
+			}
+		}
+		ui.partRoom(cr)
+	case "/msg":
+		if ui.Direct == nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "direct messages are not available when attached to a daemon"}
+			return
 		}
+		target, text, _ := strings.Cut(strings.TrimSpace(cmd.Arg), " ")
+		if target == "" {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "missing peer for command"}
+			return
+		}
+		peerID, err := ui.resolvePeer(cr, target)
+		if err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: err.Error()}
+			return
+		}
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.openDirect(peerID)
+		})
+		if strings.TrimSpace(text) == "" {
+			return
+		}
+		m := model.ChatMessage{
+			ID:         model.NewMessageID(),
+			Message:    text,
+			SenderID:   cr.peerId.String(),
+			SenderName: cr.UserName,
+			CreatedAt:  time.Now(),
+		}
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.writeMessage(ui.directBox, m, ui.theme.Own)
+		})
+		if err = ui.Direct.Send(peerID, m); err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("message was not delivered - %s", err)}
+		}
+	case "/back":
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.directPeer = ""
+			ui.pinned = false
+			ui.pages.SwitchToPage(pageRoom)
+		})
+	case "/reply":
+		text := strings.TrimSpace(cmd.Arg)
+		if text == "" {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "missing text for command"}
+			return
+		}
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.startReply()
+			if ui.replyTo != nil {
+				ui.sendMessage(text)
+			}
+		})
+	case "/edit", "/delete":
+		text := strings.TrimSpace(cmd.Arg)
+		if cmd.Type == "/edit" && text == "" {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "missing text for command"}
+			return
+		}
+		type change struct {
+			cr  *ChatRoom
+			msg model.ChatMessage
+		}
+		changed := make(chan change, 1)
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			if m, ok := ui.changeOwn(text); ok {
+				changed <- change{cr: ui.ChatRoom, msg: m}
+			}
+			close(changed)
+		})
+		if c, ok := <-changed; ok {
+			c.cr.Outbound <- c.msg
+		}
+	case "/react":
+		args := strings.Fields(cmd.Arg)
+		if len(args) == 0 || len(args) > 2 {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "usage: /react [id] <emoji>"}
+			return
+		}
+		emoji, err := parseEmoji(args[len(args)-1])
+		if err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: err.Error()}
+			return
+		}
+		type target struct {
+			cr  *ChatRoom
+			msg model.ChatMessage
+		}
+		found := make(chan target, 1)
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			defer close(found)
+			msg, ok := ui.selectedMessage()
+			if len(args) == 2 {
+				var err error
+				if msg, err = ui.findMessage(args[0]); err != nil {
+					ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: err.Error()})
+					return
+				}
+			} else if !ok {
+				ui.displayLogMessage(model.LogMessage{Prefix: "system", Message: "no message to react to"})
+				return
+			}
+			found <- target{cr: ui.ChatRoom, msg: msg}
+		})
+		t, ok := <-found
+		if !ok {
+			return
+		}
+		msg, err := t.cr.React(t.msg.ID, emoji)
+		if err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "could not react - " + err.Error()}
+			return
+		}
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			if t.cr == ui.ChatRoom {
+				ui.updateMessage(msg)
+			}
+		})
+	case "/thread":
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.showThread()
+		})
+	case "/search":
+		q, err := parseSearch(cmd.Arg)
+		if err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "invalid search - " + err.Error()}
+			return
+		}
+		records, err := cr.Search(q)
+		if err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "search failed - " + err.Error()}
+			return
+		}
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.showSearch("Search: "+strings.TrimSpace(cmd.Arg), q, records)
+		})
+	case "/away":
+		message := strings.TrimSpace(cmd.Arg)
+		away, _ := cr.Away()
+		away = message != "" || !away
+		ui.roomsMu.Lock()
+		rooms := slices.Clone(ui.rooms)
+		ui.roomsMu.Unlock()
+		for _, cr := range rooms {
+			if err := cr.SetAway(away, message); err != nil {
+				ui.Logs <- model.LogMessage{Prefix: "system", Message: "could not publish presence - " + err.Error()}
+			}
+		}
+		status := "you are back"
+		if away {
+			status = "you are away"
+		}
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: status}
+	case "/verify", "/unverify":
+		target := strings.TrimSpace(cmd.Arg)
+		if target == "" {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "missing peer for command"}
+			return
+		}
+		verified := cmd.Type == "/verify"
+		var peerID peer.ID
+		var err error
+		if verified {
+			// only the full ID was compared with the peer
+			if peerID, err = peer.Decode(target); err != nil {
+				ui.Logs <- model.LogMessage{Prefix: "system", Message: "give the full ID of the peer to verify"}
+				return
+			}
+		} else if peerID, err = ui.resolvePeer(cr, target); err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: err.Error()}
+			return
+		}
+		if err = ui.setVerified(peerID, ui.peerName(peerID), verified); err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "could not save contacts - " + err.Error()}
+			return
+		}
+		status := "no longer verified"
+		if verified {
+			status = "verified"
+		}
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("%s is %s", peerID, status)}
+	case "/peer":
+		target := strings.TrimSpace(cmd.Arg)
+		if target == "" {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "missing peer for command"}
+			return
+		}
+		peerID, err := ui.resolvePeer(cr, target)
+		if err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: err.Error()}
+			return
+		}
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.showPeer(peerID)
+		})
+	case "/send":
+		ui.sendFile(cr, strings.TrimSpace(cmd.Arg))
+	case "/accept":
+		ui.acceptFile(strings.TrimSpace(cmd.Arg))
+	case "/claim", "/mod", "/unmod", "/kick", "/ban", "/unban", "/mute", "/unmute":
+		ui.moderate(cr, strings.TrimPrefix(cmd.Type, "/"), cmd.Arg)
+	case "/policy":
+		ui.showPolicy(cr)
+	case "/stats":
+		ui.showRejections(cr)
+	case "/ignore", "/unignore":
+		ui.ignore(cr, cmd.Type, strings.TrimSpace(cmd.Arg))
+	case "/mentions":
+		q, records, err := ui.searchMentions(cr)
+		if err != nil {
+			ui.Logs <- model.LogMessage{Prefix: "system", Message: "search failed - " + err.Error()}
+			return
+		}
+		ui.TerminalApp.QueueUpdateDraw(func() {
+			ui.showSearch("Mentions of @"+ui.UserName, q, records)
+		})
 	case "/user":
 		if cmd.Arg == "" {
 			ui.Logs <- model.LogMessage{Prefix: "system", Message: "missing user name for command"}
-		} else if cmd.Arg == ui.ChatRoom.UserName {
+		} else if cmd.Arg == cr.UserName {
 			return
 		} else {
-			ui.UpdateUser(cmd.Arg)
+			ui.roomsMu.Lock()
+			for _, cr := range ui.rooms {
+				cr.UpdateUser(cmd.Arg)
+			}
+			ui.roomsMu.Unlock()
 			ui.TerminalApp.QueueUpdateDraw(func() {
 				ui.inputBox.SetTitle(ui.UserName + " > ")
 			})
@@ -291,7 +912,8 @@ func (ui *UI) handleCommand(cmd uiCommand) {
 }
 
 func (ui *UI) displayMessage(msg model.ChatMessage) {
-	if msg.SenderName == ui.ChatRoom.UserName {
+	ui.rememberPeer(msg)
+	if ui.isOwn(msg) {
 		ui.displayOwnerMessage(msg)
 	} else {
 		ui.displayUserMessage(msg)
@@ -300,12 +922,26 @@ func (ui *UI) displayMessage(msg model.ChatMessage) {
 
 // displayChatMessage displays a message recieved from a peer
 func (ui *UI) displayUserMessage(msg model.ChatMessage) {
-	ui.printMessage(msg, "blue")
+	ui.appendScrollback(msg, ui.theme.Peer)
 }
 
 // displaySelfMessage displays a message recieved from self
 func (ui *UI) displayOwnerMessage(msg model.ChatMessage) {
-	ui.printMessage(msg, "green")
+	ui.appendScrollback(msg, ui.theme.Own)
+}
+
+// displayDirectMessage displays a direct message in its conversation view,
+// or a notice in the active view when another conversation is open
+func (ui *UI) displayDirectMessage(msg model.DirectMessage) {
+	ui.rememberPeer(msg.ChatMessage)
+	if ui.directPeer.String() == msg.PeerID {
+		ui.writeMessage(ui.directBox, msg.ChatMessage, ui.theme.Peer)
+		return
+	}
+	ui.displayLogMessage(model.LogMessage{
+		Prefix:  "system",
+		Message: fmt.Sprintf("direct message from %s#%s, /msg %s to open", msg.SenderName, fingerprint(msg.PeerID), msg.SenderName),
+	})
 }
 
 // displayLogMessage displays a log message
@@ -315,73 +951,174 @@ func (ui *UI) displayLogMessage(log model.LogMessage) {
 		SenderName: log.Prefix,
 		CreatedAt:  time.Now(),
 	}
-	ui.printMessage(msg, "yellow")
+	if ui.directPeer != "" {
+		ui.writeMessage(ui.directBox, msg, ui.theme.System)
+		return
+	}
+	ui.printMessage(msg, ui.theme.System)
 }
 
 func (ui *UI) printMessage(msg model.ChatMessage, color string) {
+	ui.writeMessage(ui.messageBox, msg, color)
+}
+
+// writeMessage prints the message as a region named after its ID,
+// so that search results can highlight it.
+func (ui *UI) writeMessage(box io.Writer, msg model.ChatMessage, color string) {
+	// peers choose the IDs, names and text of their messages, none of it
+	// may be taken for a region or style tag
+	if model.IsMessageID(msg.ID) {
+		fmt.Fprintf(box, `["%s"]`, msg.ID)
+		defer fmt.Fprint(box, `[""]`)
+	}
+	name := tview.Escape(msg.SenderName)
 	t := msg.CreatedAt.Format(time.TimeOnly)
+	if msg.ReplyTo != nil {
+		ui.writeQuote(box, msg.ReplyTo, strings.Repeat(" ", len(t)+1))
+	}
 	n := fmt.Sprintf("<%s>:", msg.SenderName)
-	prompt := fmt.Sprintf("[lightslategrey]%s[-] [%s]%s[-]", t, color, n)
-	lines := strings.Split(msg.Message, "\n")
+	prompt := fmt.Sprintf("[%s]%s[-] [%s]<%s>:[-]", ui.theme.Timestamp, t, color, name)
+	switch {
+	case msg.Synced:
+		// a peer's history may name anyone as the sender, so the fingerprint
+		// is left out until the message arrives signed
+		n = fmt.Sprintf("<%s> (unverified):", msg.SenderName)
+		prompt = fmt.Sprintf("[%s]%s[-] [%s]<%s>[-] [%s](unverified)[-][%s]:[-]", ui.theme.Timestamp, t, color, name, ui.theme.System, color)
+	case msg.SenderID != "":
+		fp := fingerprint(msg.SenderID)
+		n = fmt.Sprintf("<%s#%s>:", msg.SenderName, fp)
+		prompt = fmt.Sprintf("[%s]%s[-] [%s]<%s[-][%s]#%s[-][%s]>:[-]", ui.theme.Timestamp, t, color, name, ui.theme.Timestamp, fp, color)
+	}
+	text := msg.Message
+	switch {
+	case msg.Deleted:
+		text = fmt.Sprintf("[%s](deleted)[-]", ui.theme.System)
+	case !msg.EditedAt.IsZero():
+		text = ui.highlightMentions(text) + fmt.Sprintf(" [%s](edited)[-]", ui.theme.Timestamp)
+	default:
+		text = ui.highlightMentions(text)
+	}
+	if msg.File != nil && !msg.Deleted && ui.Files != nil && !ui.isOwn(msg) {
+		ui.recordOffer(msg)
+		text += fmt.Sprintf(" [%s](/accept %s)[-]", ui.theme.Timestamp, shortID(msg.ID))
+	}
+	text += ui.formatReactions(msg)
+	lines := strings.Split(text, "\n")
 	for i, line := range lines {
 		if i == 0 {
-			fmt.Fprintf(ui.messageBox, "%s %s\n", prompt, line)
+			fmt.Fprintf(box, "%s %s\n", prompt, line)
 		} else {
 			indent := strings.Repeat(" ", len(t)+len(n)+2)
-			fmt.Fprintf(ui.messageBox, "%s%s\n", indent, line)
+			fmt.Fprintf(box, "%s%s\n", indent, line)
 		}
 	}
 }
 
-func (ui *UI) printDate(t time.Time) {
-	indent := strings.Repeat(" ", len(t.Format(time.TimeOnly))+1)
-	fmt.Fprintf(ui.messageBox, "%s[lightslategrey]%s[-]\n", indent, t.Format("Mon, 02 Jan 2006"))
+// fingerprint returns a short, stable fingerprint of a peer ID
+// so users can tell apart peers sharing the same name. It is 64 bits long
+// so that no other key can be made to share it.
+func fingerprint(peerID string) string {
+	sum := sha256.Sum256([]byte(peerID))
+	return hex.EncodeToString(sum[:8])
 }
 
-func (ui *UI) syncPeerBox() {
-	peers := ui.PeerList()
-
-	ui.peerBox.Clear()
+func (ui *UI) printDate(w io.Writer, t time.Time) {
+	indent := strings.Repeat(" ", len(t.Format(time.TimeOnly))+1)
+	fmt.Fprintf(w, "%s[%s]%s[-]\n", indent, ui.theme.Timestamp, t.Format("Mon, 02 Jan 2006"))
+}
 
-	for _, p := range peers {
-		peerId := p.String()
-		if len(peerId) > 8 {
-			peerId = peerId[len(peerId)-8:]
+// openDirect shows the conversation with the peer, loading its history
+func (ui *UI) openDirect(peerID peer.ID) {
+	if ui.directPeer != peerID {
+		ui.directPeer = peerID
+		ui.directBox.Clear()
+		ui.directBox.SetTitle(fmt.Sprintf("Direct-%s", fingerprint(peerID.String())))
+		history, err := ui.Direct.History(peerID)
+		if err != nil {
+			ui.writeMessage(ui.directBox, model.ChatMessage{
+				Message:    "could not load conversation - " + err.Error(),
+				SenderName: "system",
+				CreatedAt:  time.Now(),
+			}, ui.theme.System)
+		}
+		for _, msg := range history {
+			if msg.SenderID == ui.ChatRoom.peerId.String() {
+				ui.writeMessage(ui.directBox, msg, ui.theme.Own)
+			} else {
+				ui.rememberPeer(msg)
+				ui.writeMessage(ui.directBox, msg, ui.theme.Peer)
+			}
 		}
-		fmt.Fprintln(ui.peerBox, peerId)
 	}
+	ui.pages.SwitchToPage(pageDirect)
 }
 
-func (ui *UI) changeRoom(roomName string) {
-	newChatRoom, err := NewChatRoom(ui.Host, ui.UserName, roomName)
-	if err != nil {
-		ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("could not change chat room - %s", err)}
+// rememberPeer records the sender name so it can be used to address the peer.
+// Synced messages may name anyone as their sender and are not used.
+func (ui *UI) rememberPeer(msg model.ChatMessage) {
+	if msg.SenderID == "" || msg.SenderName == "" || msg.Synced {
+		return
+	}
+	id, err := peer.Decode(msg.SenderID)
+	if err != nil || id == ui.ChatRoom.peerId {
 		return
 	}
-	oldChatRoom := ui.ChatRoom
-	ui.ChatRoom = newChatRoom
-	time.Sleep(time.Second * 1)
+	ui.learnName(id, msg.SenderName)
+}
 
-	ui.TerminalApp.QueueUpdateDraw(func() {
-		ui.messageBox.Clear()
-		ui.messageBox.SetTitle(fmt.Sprintf("ChatRoom-%s", ui.ChatRoom.RoomName))
-		ui.displayHistory()
-	})
+// learnName records the name the peer gave itself.
+func (ui *UI) learnName(id peer.ID, name string) {
+	ui.namesMu.Lock()
+	defer ui.namesMu.Unlock()
+	ui.peerNames[id] = name
+	if ui.nameClaims[name] == nil {
+		ui.nameClaims[name] = make(map[peer.ID]struct{})
+	}
+	ui.nameClaims[name][id] = struct{}{}
+}
 
-	oldChatRoom.Exit()
+// resolvePeer finds a peer by full ID, known name, ID suffix or fingerprint
+// among the peers known to the host of the room. Peers choose their names,
+// so a name must have been used by a single peer only, and a suffix or
+// fingerprint must match a single peer. Unless the full ID was given, the
+// user is told which peer was found.
+func (ui *UI) resolvePeer(cr *ChatRoom, target string) (peer.ID, error) {
+	return ui.resolvePeerAmong(cr, target, cr.knownPeers())
 }
 
-func (ui *UI) displayHistory() {
-	var prevDay time.Time
-	for _, msg := range ui.ChatRoom.History {
-		if prevDay.IsZero() || prevDay.Day() < msg.CreatedAt.Day() {
-			prevDay = msg.CreatedAt
-			ui.printDate(prevDay)
-		}
-		if msg.SenderName == ui.ChatRoom.UserName {
-			ui.displayOwnerMessage(msg)
-		} else {
-			ui.displayUserMessage(msg)
+// resolvePeerAmong finds a peer like resolvePeer, matching suffixes and
+// fingerprints among the given peers.
+func (ui *UI) resolvePeerAmong(cr *ChatRoom, target string, peers []peer.ID) (peer.ID, error) {
+	if id, err := peer.Decode(target); err == nil {
+		return id, nil
+	}
+	ui.namesMu.Lock()
+	found := slices.Collect(maps.Keys(ui.nameClaims[target]))
+	ui.namesMu.Unlock()
+	if len(found) > 1 {
+		return "", fmt.Errorf("%d peers have used the name %q, give their fingerprint or ID", len(found), target)
+	}
+	if len(found) == 0 {
+		for _, p := range peers {
+			if strings.HasSuffix(p.String(), target) || fingerprint(p.String()) == target {
+				found = append(found, p)
+			}
 		}
 	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("unknown peer %q", target)
+	case 1:
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: fmt.Sprintf("%s is %s", target, ui.describePeer(cr, found[0].String()))}
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("%q matches %d peers, give more of the ID", target, len(found))
+	}
+}
+
+func roomTitle(cr *ChatRoom) string {
+	if cr.Encrypted {
+		return fmt.Sprintf("ChatRoom-%s (encrypted)", cr.RoomName)
+	}
+	return fmt.Sprintf("ChatRoom-%s", cr.RoomName)
 }
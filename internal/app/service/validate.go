@@ -0,0 +1,276 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxRoomMessageSize bounds a room message including its encryption.
+	maxRoomMessageSize = 64 << 10
+	// maxMessageSkew is how far the time of a chat message or edit may be
+	// off the own clock.
+	maxMessageSkew = 5 * time.Minute
+	// roomRate and roomBurst are the token bucket of every peer: the
+	// messages it may publish per second over all rooms, and at once.
+	roomRate  = 2.0
+	roomBurst = 20.0
+	// maxRateBuckets bounds the peers tracked by the rate limiter, idle
+	// ones are forgotten first.
+	maxRateBuckets = 4096
+)
+
+// Rejection reasons counted by the topic validators.
+const (
+	rejectSize      = "size"
+	rejectRate      = "rate"
+	rejectMalformed = "malformed"
+	rejectForged    = "forged"
+	rejectSkew      = "skew"
+	rejectBanned    = "banned"
+	rejectMuted     = "muted"
+	rejectPolicy    = "policy"
+)
+
+// validation is the state the topic validators of all rooms share: the
+// token buckets of the peers and the count of rejections by reason.
+type validation struct {
+	mu       sync.Mutex
+	buckets  map[peer.ID]*tokenBucket
+	rejected map[string]uint64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newValidation() *validation {
+	return &validation{
+		buckets:  make(map[peer.ID]*tokenBucket),
+		rejected: make(map[string]uint64),
+	}
+}
+
+// allow takes a token from the bucket of the peer, refilled at roomRate
+// since it was last used.
+func (v *validation) allow(id peer.ID, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	b, ok := v.buckets[id]
+	if !ok {
+		if len(v.buckets) >= maxRateBuckets {
+			v.pruneBuckets(now)
+		}
+		b = &tokenBucket{tokens: roomBurst, last: now}
+		v.buckets[id] = b
+	}
+	b.tokens = min(roomBurst, b.tokens+now.Sub(b.last).Seconds()*roomRate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// pruneBuckets forgets the peers whose bucket has filled up again, or all
+// of them when every peer is busy. v.mu must be held.
+func (v *validation) pruneBuckets(now time.Time) {
+	full := time.Duration(roomBurst / roomRate * float64(time.Second))
+	for id, b := range v.buckets {
+		if now.Sub(b.last) >= full {
+			delete(v.buckets, id)
+		}
+	}
+	if len(v.buckets) >= maxRateBuckets {
+		clear(v.buckets)
+	}
+}
+
+func (v *validation) count(reason string) {
+	v.mu.Lock()
+	v.rejected[reason]++
+	v.mu.Unlock()
+}
+
+// Rejections returns how many room messages the topic validators rejected
+// or ignored since the host started, by reason.
+func (p *P2P) Rejections() map[string]uint64 {
+	p.validation.mu.Lock()
+	defer p.validation.mu.Unlock()
+	return maps.Clone(p.validation.rejected)
+}
+
+// peerScoreParams enables gossipsub peer scoring. Only invalid message
+// deliveries and router misbehaviour are scored: peers relaying messages
+// the validators reject lose score, are no longer gossiped with, then no
+// longer published to and in the end ignored, and are pruned from the mesh
+// as soon as their score is negative. IP colocation is not penalized, as
+// peers on a LAN commonly share an address.
+func peerScoreParams() (*pubsub.PeerScoreParams, *pubsub.PeerScoreThresholds) {
+	params := &pubsub.PeerScoreParams{
+		Topics:                    make(map[string]*pubsub.TopicScoreParams),
+		AppSpecificScore:          func(peer.ID) float64 { return 0 },
+		BehaviourPenaltyWeight:    -10,
+		BehaviourPenaltyThreshold: 6,
+		BehaviourPenaltyDecay:     pubsub.ScoreParameterDecay(10 * time.Minute),
+		DecayInterval:             pubsub.DefaultDecayInterval,
+		DecayToZero:               pubsub.DefaultDecayToZero,
+		RetainScore:               time.Hour,
+	}
+	thresholds := &pubsub.PeerScoreThresholds{
+		GossipThreshold:   -10,
+		PublishThreshold:  -50,
+		GraylistThreshold: -80,
+	}
+	return params, thresholds
+}
+
+// roomScoreParams scores the invalid messages delivered in a room topic,
+// the penalty grows with their square and fades over an hour.
+func roomScoreParams() *pubsub.TopicScoreParams {
+	return &pubsub.TopicScoreParams{
+		SkipAtomicValidation: true,
+		TopicWeight:          1,
+		// the time in the mesh is not scored, but gossipsub divides by its quantum
+		TimeInMeshQuantum:              time.Second,
+		InvalidMessageDeliveriesWeight: -10,
+		InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(time.Hour),
+	}
+}
+
+// validate is the topic validator of the room. It rejects oversized
+// messages, peers publishing faster than their token bucket allows,
+// messages that are not a well-formed envelope of a room kind or claim
+// another sender, and those of banned and muted peers. Chat messages and
+// edits whose time is too far off are ignored, as the clocks of honest
+// peers may be wrong too, and so is rate limited traffic relayed by
+// others. Honest peers do not forward what they reject, and gossipsub
+// lowers the score of the peers that delivered it. Kinds this client does
+// not know pass for newer clients.
+func (cr *ChatRoom) validate(_ context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	author := msg.GetFrom()
+	now := time.Now()
+	result, reason := cr.verdict(author, msg.Data, now)
+	if reason == rejectRate && from != author {
+		// relays see the messages a little earlier or later than we do, so
+		// only the flooding peer itself is penalized
+		result = pubsub.ValidationIgnore
+	}
+	if reason != "" {
+		cr.Host.validation.count(reason)
+		logrus.WithFields(logrus.Fields{"peer": author.String(), "reason": reason}).Trace("rejected room message")
+	}
+	return result
+}
+
+func (cr *ChatRoom) verdict(author peer.ID, data []byte, now time.Time) (pubsub.ValidationResult, string) {
+	if len(data) > maxRoomMessageSize {
+		return pubsub.ValidationReject, rejectSize
+	}
+	if cr.isBanned(author.String()) {
+		return pubsub.ValidationReject, rejectBanned
+	}
+	// the own messages are limited by the user only
+	if author != cr.peerId && !cr.Host.validation.allow(author, now) {
+		return pubsub.ValidationReject, rejectRate
+	}
+
+	if cr.crypt != nil {
+		var err error
+		// the topic of an encrypted room is derived from its key, so
+		// every honest peer can open what is published in it
+		if data, err = cr.crypt.Open(data); err != nil {
+			return pubsub.ValidationReject, rejectMalformed
+		}
+	}
+	env, err := model.Unwrap(data)
+	if errors.Is(err, model.ErrUnknownKind) {
+		return pubsub.ValidationAccept, ""
+	}
+	if err != nil {
+		return pubsub.ValidationReject, rejectMalformed
+	}
+	sender, at, err := inspect(env)
+	if err != nil {
+		return pubsub.ValidationReject, rejectMalformed
+	}
+	if sender != "" && sender != author.String() {
+		return pubsub.ValidationReject, rejectForged
+	}
+	if !at.IsZero() && (at.Before(now.Add(-maxMessageSkew)) || at.After(now.Add(maxMessageSkew))) {
+		return pubsub.ValidationIgnore, rejectSkew
+	}
+	return cr.moderationVerdict(author.String(), env)
+}
+
+// inspect decodes the payload of a room message and returns the sender it
+// claims and its time, both empty for kinds without. Kinds of the stream
+// protocols do not belong in a room.
+func inspect(env model.Envelope) (string, time.Time, error) {
+	switch env.Kind {
+	case model.KindChat:
+		msg, err := env.DecodeChat()
+		return msg.SenderID, msg.CreatedAt, err
+	case model.KindEdit, model.KindDelete:
+		var edit model.Edit
+		err := env.Decode(&edit)
+		return edit.SenderID, edit.EditedAt, err
+	case model.KindReact:
+		var reaction model.Reaction
+		err := env.Decode(&reaction)
+		return reaction.SenderID, time.Time{}, err
+	case model.KindPresence:
+		var p model.Presence
+		err := env.Decode(&p)
+		return p.SenderID, time.Time{}, err
+	case model.KindTyping:
+		var t model.Typing
+		err := env.Decode(&t)
+		return t.SenderID, time.Time{}, err
+	case model.KindPolicy:
+		// policies are signed on their own and republished by any peer
+		var s model.Signed
+		return "", time.Time{}, env.Decode(&s)
+	default:
+		return "", time.Time{}, model.ErrMalformed
+	}
+}
+
+// Rejections returns the rejection counts of the host, or the daemon's host.
+func (cr *ChatRoom) Rejections() (map[string]uint64, error) {
+	if cr.remote != nil {
+		return cr.remote.Stats()
+	}
+	return cr.Host.Rejections(), nil
+}
+
+// showRejections tells how many room messages were rejected by reason.
+func (ui *UI) showRejections(cr *ChatRoom) {
+	rejected, err := cr.Rejections()
+	if err != nil {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "could not read stats - " + err.Error()}
+		return
+	}
+	if len(rejected) == 0 {
+		ui.Logs <- model.LogMessage{Prefix: "system", Message: "no room messages rejected"}
+		return
+	}
+	parts := make([]string, 0, len(rejected))
+	for _, reason := range slices.Sorted(maps.Keys(rejected)) {
+		parts = append(parts, fmt.Sprintf("%s %d", reason, rejected[reason]))
+	}
+	ui.Logs <- model.LogMessage{Prefix: "system", Message: "rejected room messages: " + strings.Join(parts, ", ")}
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func decodeTestPeer(t *testing.T, p testPeer) peer.ID {
+	t.Helper()
+	id, err := peer.Decode(p.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func wrapTest(t *testing.T, kind model.Kind, payload any) []byte {
+	t.Helper()
+	data, err := model.Wrap(kind, model.NewMessageID(), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestVerdict(t *testing.T) {
+	self, author, other := newTestPeer(t), newTestPeer(t), newTestPeer(t)
+	banned, muted := newTestPeer(t), newTestPeer(t)
+	now := time.Now()
+	chat := func(sender testPeer, at time.Time) []byte {
+		return wrapTest(t, model.KindChat, model.ChatMessage{ID: model.NewMessageID(), SenderID: sender.id, Message: "hi", CreatedAt: at})
+	}
+
+	cr := &ChatRoom{Host: &P2P{validation: newValidation()}, peerId: decodeTestPeer(t, self)}
+	cr.moderation.current = &roomPolicy{policy: model.Policy{
+		Banned: []model.Sanction{{PeerID: banned.id}},
+		Muted:  []model.Sanction{{PeerID: muted.id}},
+	}}
+
+	tests := []struct {
+		desc   string
+		author testPeer
+		data   []byte
+		result pubsub.ValidationResult
+		reason string
+	}{
+		{"chat message", author, chat(author, now), pubsub.ValidationAccept, ""},
+		{"oversized", author, make([]byte, maxRoomMessageSize+1), pubsub.ValidationReject, rejectSize},
+		{"not an envelope", author, []byte("hello"), pubsub.ValidationReject, rejectMalformed},
+		{"unknown kind", author, wrapTest(t, model.Kind("future"), struct{}{}), pubsub.ValidationAccept, ""},
+		{"direct message kind", author, wrapTest(t, model.KindDirect, model.ChatMessage{SenderID: author.id}), pubsub.ValidationReject, rejectMalformed},
+		{"claiming another sender", author, chat(other, now), pubsub.ValidationReject, rejectForged},
+		{"too old", author, chat(author, now.Add(-2*maxMessageSkew)), pubsub.ValidationIgnore, rejectSkew},
+		{"edit from the future", author, wrapTest(t, model.KindEdit, model.Edit{SenderID: author.id, EditedAt: now.Add(2 * maxMessageSkew)}), pubsub.ValidationIgnore, rejectSkew},
+		{"typing", author, wrapTest(t, model.KindTyping, model.Typing{SenderID: author.id}), pubsub.ValidationAccept, ""},
+		{"banned peer", banned, chat(banned, now), pubsub.ValidationReject, rejectBanned},
+		{"muted peer", muted, chat(muted, now), pubsub.ValidationReject, rejectMuted},
+		{"presence of a muted peer", muted, wrapTest(t, model.KindPresence, model.Presence{SenderID: muted.id}), pubsub.ValidationAccept, ""},
+	}
+	for _, tt := range tests {
+		result, reason := cr.verdict(decodeTestPeer(t, tt.author), tt.data, now)
+		if result != tt.result || reason != tt.reason {
+			t.Errorf("%s: verdict = %v %q, want %v %q", tt.desc, result, reason, tt.result, tt.reason)
+		}
+	}
+
+	t.Run("own messages are not rate limited", func(t *testing.T) {
+		for i := range int(roomBurst) * 2 {
+			if _, reason := cr.verdict(cr.peerId, chat(self, now), now); reason != "" {
+				t.Fatalf("message %d: verdict reason = %q", i, reason)
+			}
+		}
+	})
+}
+
+func TestTokenBucket(t *testing.T) {
+	id := peer.ID("peer")
+	start := time.Now()
+	tests := []struct {
+		desc    string
+		elapsed time.Duration
+		allowed int
+	}{
+		{"at once", 0, 0},
+		{"half a second later", 500 * time.Millisecond, 1},
+		{"a second later", time.Second, 2},
+		{"refilled", 10 * time.Second, int(roomBurst)},
+		{"idle for long", time.Hour, int(roomBurst)},
+	}
+	for _, tt := range tests {
+		v := newValidation()
+		for range int(roomBurst) {
+			if !v.allow(id, start) {
+				t.Fatalf("%s: burst not allowed", tt.desc)
+			}
+		}
+		allowed := 0
+		for range int(roomBurst) + 1 {
+			if v.allow(id, start.Add(tt.elapsed)) {
+				allowed++
+			}
+		}
+		if allowed != tt.allowed {
+			t.Errorf("%s: allowed %d messages, want %d", tt.desc, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestPruneBuckets(t *testing.T) {
+	now := time.Now()
+	full := time.Duration(roomBurst / roomRate * float64(time.Second))
+	tests := []struct {
+		desc string
+		busy int
+		want int
+	}{
+		{"all idle", 0, 1},
+		{"half busy", maxRateBuckets / 2, maxRateBuckets/2 + 1},
+		{"all busy", maxRateBuckets, 1},
+	}
+	for _, tt := range tests {
+		v := newValidation()
+		for i := range maxRateBuckets {
+			last := now.Add(-full)
+			if i < tt.busy {
+				last = now
+			}
+			v.buckets[peer.ID(fmt.Sprint(i))] = &tokenBucket{tokens: roomBurst, last: last}
+		}
+		v.allow(peer.ID("new"), now)
+		if len(v.buckets) != tt.want {
+			t.Errorf("%s: %d buckets kept, want %d", tt.desc, len(v.buckets), tt.want)
+		}
+	}
+}
@@ -0,0 +1,565 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	dbFileName  = "peerchat.db"
+	dbOpenWait  = time.Second
+	keySep      = 0
+	timeKeySize = 8
+)
+
+var (
+	bucketRooms    = []byte("rooms")
+	bucketMessages = []byte("messages")
+	bucketByTime   = []byte("by_time")
+	bucketBySender = []byte("by_sender")
+	bucketByWord   = []byte("by_word")
+)
+
+// Bolt keeps the messages of every conversation in a single embedded
+// database with indexes by room, time and sender:
+//
+//	rooms      room                       -> empty
+//	messages   room 0 id                  -> message envelope
+//	by_time    room 0 time id             -> empty
+//	by_sender  sender 0 room 0 time id    -> empty
+//	by_word    word 0 room 0 id           -> empty
+//
+// where time is the big-endian creation time in nanoseconds, so keys of a
+// room or sender sort chronologically.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens the database in the application data directory. The
+// database is locked by a single process at a time.
+func OpenBolt() (*Bolt, error) {
+	appDir, err := AppDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(appDir, dbFileName)
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: dbOpenWait})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("open database %s: in use by another process", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		// databases created before the word index existed are indexed once
+		reindex := tx.Bucket(bucketByWord) == nil
+		for _, name := range [][]byte{bucketRooms, bucketMessages, bucketByTime, bucketBySender, bucketByWord} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if reindex {
+			return indexWords(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("create buckets: %w", err)
+	}
+	return &Bolt{db: db}, nil
+}
+
+// Room returns the store of the conversation. Messages of an existing
+// file log of the same name are imported the first time the room is used.
+func (b *Bolt) Room(name string) (*BoltRoom, error) {
+	if name == "" || bytes.IndexByte([]byte(name), keySep) >= 0 {
+		return nil, fmt.Errorf("invalid room name %q", name)
+	}
+	room := &BoltRoom{db: b.db, name: name}
+
+	exists := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(bucketRooms).Get([]byte(name)) != nil
+		return nil
+	})
+	if err != nil || exists {
+		return room, err
+	}
+
+	if err = room.importFile(); err != nil {
+		return nil, err
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRooms).Put([]byte(name), []byte{})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create room: %w", err)
+	}
+	return room, nil
+}
+
+// Query runs the query over the given rooms, or every room when none are given.
+func (b *Bolt) Query(q Query) ([]Record, error) {
+	result := make([]Record, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		rooms := q.Rooms
+		if len(rooms) == 0 {
+			err := tx.Bucket(bucketRooms).ForEach(func(k, _ []byte) error {
+				rooms = append(rooms, string(k))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, name := range rooms {
+			msgs, err := scanRoom(tx, name, q)
+			if err != nil {
+				return err
+			}
+			for _, msg := range msgs {
+				result = append(result, Record{Room: name, ChatMessage: msg})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query messages: %w", err)
+	}
+	slices.SortStableFunc(result, func(a, b Record) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return limited(result, q), nil
+}
+
+// Search looks up the longest term in the word index and checks the
+// candidates against the rest of the query. Without terms the rooms are
+// scanned by time.
+func (b *Bolt) Search(q SearchQuery) ([]Record, error) {
+	if len(q.Terms) == 0 {
+		all := q.Query
+		all.Limit = 0
+		records, err := b.Query(all)
+		if err != nil {
+			return nil, err
+		}
+		result := make([]Record, 0)
+		for _, rec := range records {
+			if q.matchesText(rec.ChatMessage) {
+				result = append(result, rec)
+			}
+		}
+		return limited(result, q.Query), nil
+	}
+
+	term := ""
+	for _, t := range q.Terms {
+		if len(t) > len(term) {
+			term = strings.ToLower(t)
+		}
+	}
+	result := make([]Record, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		messages := tx.Bucket(bucketMessages)
+		seen := make(map[string]struct{})
+		c := tx.Bucket(bucketByWord).Cursor()
+		for k, _ := c.Seek([]byte(term)); k != nil && bytes.HasPrefix(k, []byte(term)); k, _ = c.Next() {
+			parts := bytes.SplitN(k, []byte{keySep}, 3)
+			if len(parts) != 3 {
+				continue
+			}
+			room, id := string(parts[1]), string(parts[2])
+			if len(q.Rooms) > 0 && !slices.Contains(q.Rooms, room) {
+				continue
+			}
+			key := room + string(rune(keySep)) + id
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			data := messages.Get([]byte(key))
+			if data == nil {
+				continue
+			}
+			msg, err := decodeMessage(data)
+			if err != nil {
+				return err
+			}
+			if q.Query.matches(msg) && q.matchesText(msg) {
+				result = append(result, Record{Room: room, ChatMessage: msg})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("search messages: %w", err)
+	}
+	slices.SortStableFunc(result, func(a, b Record) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return limited(result, q.Query), nil
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// BoltRoom is the Store of a single conversation in the Bolt database.
+type BoltRoom struct {
+	db   *bolt.DB
+	name string
+}
+
+func (r *BoltRoom) SaveMessage(msg model.ChatMessage) (bool, error) {
+	added, err := r.Merge([]model.ChatMessage{msg})
+	return added > 0, err
+}
+
+func (r *BoltRoom) Merge(msgs []model.ChatMessage) (int, error) {
+	added := 0
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		messages := tx.Bucket(bucketMessages)
+		for _, msg := range msgs {
+			msg.ID = messageKey(msg)
+			key := r.messageKey(msg.ID)
+			if messages.Get(key) != nil {
+				continue
+			}
+			if err := r.put(tx, msg); err != nil {
+				return err
+			}
+			added++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("save messages: %w", err)
+	}
+	return added, nil
+}
+
+func (r *BoltRoom) LoadMessages() ([]model.ChatMessage, error) {
+	return r.Range(Query{})
+}
+
+func (r *BoltRoom) Range(q Query) ([]model.ChatMessage, error) {
+	var result []model.ChatMessage
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		result, err = scanRoom(tx, r.name, q)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query messages: %w", err)
+	}
+	return result, nil
+}
+
+func (r *BoltRoom) Get(id string) (model.ChatMessage, error) {
+	var msg model.ChatMessage
+	err := r.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketMessages).Get(r.messageKey(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		var err error
+		msg, err = decodeMessage(data)
+		return err
+	})
+	return msg, err
+}
+
+// Update replaces the stored message and its index entries.
+func (r *BoltRoom) Update(msg model.ChatMessage) error {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketMessages).Get(r.messageKey(msg.ID))
+		if data == nil {
+			return ErrNotFound
+		}
+		stored, err := decodeMessage(data)
+		if err != nil {
+			return err
+		}
+		if err = r.delete(tx, stored); err != nil {
+			return err
+		}
+		return r.put(tx, msg)
+	})
+	if err != nil {
+		return fmt.Errorf("update message: %w", err)
+	}
+	return nil
+}
+
+func (r *BoltRoom) Delete(id string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketMessages).Get(r.messageKey(id))
+		if data == nil {
+			return ErrNotFound
+		}
+		msg, err := decodeMessage(data)
+		if err != nil {
+			return err
+		}
+		return r.delete(tx, msg)
+	})
+}
+
+func (r *BoltRoom) Clear() error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		prefix := r.messageKey("")
+		var msgs []model.ChatMessage
+		c := tx.Bucket(bucketMessages).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			msg, err := decodeMessage(v)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+		}
+		for _, msg := range msgs {
+			if err := r.delete(tx, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close is a no-op, the database is closed with the package level Close.
+func (r *BoltRoom) Close() error {
+	return nil
+}
+
+func (r *BoltRoom) put(tx *bolt.Tx, msg model.ChatMessage) error {
+	data, err := encodeMessage(msg.ID, msg)
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket(bucketMessages).Put(r.messageKey(msg.ID), data); err != nil {
+		return err
+	}
+	if err = tx.Bucket(bucketByTime).Put(r.timeKey(msg), []byte{}); err != nil {
+		return err
+	}
+	if err = tx.Bucket(bucketBySender).Put(r.senderKey(msg), []byte{}); err != nil {
+		return err
+	}
+	for _, word := range tokenize(msg.Message) {
+		if err = tx.Bucket(bucketByWord).Put(wordKey(word, r.name, msg.ID), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *BoltRoom) delete(tx *bolt.Tx, msg model.ChatMessage) error {
+	if err := tx.Bucket(bucketMessages).Delete(r.messageKey(msg.ID)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketByTime).Delete(r.timeKey(msg)); err != nil {
+		return err
+	}
+	for _, word := range tokenize(msg.Message) {
+		if err := tx.Bucket(bucketByWord).Delete(wordKey(word, r.name, msg.ID)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(bucketBySender).Delete(r.senderKey(msg))
+}
+
+// importFile copies the messages of the file log with the same name.
+func (r *BoltRoom) importFile() error {
+	appDir, err := AppDir()
+	if err != nil {
+		return err
+	}
+	msgs, err := readLogFile(filepath.Join(appDir, r.name+fileExtension))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("import file log: %w", err)
+	}
+	_, err = r.Merge(msgs)
+	return err
+}
+
+func (r *BoltRoom) messageKey(id string) []byte {
+	return append(r.roomPrefix(), id...)
+}
+
+func (r *BoltRoom) timeKey(msg model.ChatMessage) []byte {
+	return append(append(r.roomPrefix(), timeKey(msg.CreatedAt)...), msg.ID...)
+}
+
+func (r *BoltRoom) senderKey(msg model.ChatMessage) []byte {
+	return append(append(senderPrefix(msg.SenderID, r.name), timeKey(msg.CreatedAt)...), msg.ID...)
+}
+
+func (r *BoltRoom) roomPrefix() []byte {
+	return append([]byte(r.name), keySep)
+}
+
+// scanRoom walks the time or sender index of the room backwards from
+// q.Until, so that a limited query stops after the latest messages.
+// With q.First it walks forwards from q.Since instead.
+func scanRoom(tx *bolt.Tx, room string, q Query) ([]model.ChatMessage, error) {
+	index, prefix := bucketByTime, append([]byte(room), keySep)
+	if q.SenderID != "" {
+		index, prefix = bucketBySender, senderPrefix(q.SenderID, room)
+	}
+	if q.First {
+		return scanRoomForward(tx, room, index, prefix, q)
+	}
+	upper := append(slices.Clone(prefix), bytes.Repeat([]byte{0xff}, timeKeySize)...)
+	if !q.Until.IsZero() {
+		upper = append(slices.Clone(prefix), timeKey(q.Until.Add(time.Nanosecond))...)
+	}
+	var since []byte
+	if !q.Since.IsZero() {
+		since = timeKey(q.Since)
+	}
+
+	messages := tx.Bucket(bucketMessages)
+	result := make([]model.ChatMessage, 0)
+	c := tx.Bucket(index).Cursor()
+	k, _ := c.Seek(upper)
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Prev() {
+		rest := k[len(prefix):]
+		if len(rest) < timeKeySize {
+			continue
+		}
+		if since != nil && bytes.Compare(rest[:timeKeySize], since) <= 0 {
+			break
+		}
+		data := messages.Get(append(append([]byte(room), keySep), rest[timeKeySize:]...))
+		if data == nil {
+			continue
+		}
+		msg, err := decodeMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, msg)
+		if q.Limit > 0 && len(result) == q.Limit {
+			break
+		}
+	}
+	slices.Reverse(result)
+	return result, nil
+}
+
+func scanRoomForward(tx *bolt.Tx, room string, index []byte, prefix []byte, q Query) ([]model.ChatMessage, error) {
+	lower := prefix
+	if !q.Since.IsZero() {
+		lower = append(slices.Clone(prefix), timeKey(q.Since.Add(time.Nanosecond))...)
+	}
+	var until []byte
+	if !q.Until.IsZero() {
+		until = timeKey(q.Until)
+	}
+
+	messages := tx.Bucket(bucketMessages)
+	result := make([]model.ChatMessage, 0)
+	c := tx.Bucket(index).Cursor()
+	for k, _ := c.Seek(lower); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		rest := k[len(prefix):]
+		if len(rest) < timeKeySize {
+			continue
+		}
+		if until != nil && bytes.Compare(rest[:timeKeySize], until) > 0 {
+			break
+		}
+		data := messages.Get(append(append([]byte(room), keySep), rest[timeKeySize:]...))
+		if data == nil {
+			continue
+		}
+		msg, err := decodeMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, msg)
+		if q.Limit > 0 && len(result) == q.Limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+// indexWords adds every stored message to the word index.
+func indexWords(tx *bolt.Tx) error {
+	words := tx.Bucket(bucketByWord)
+	return tx.Bucket(bucketMessages).ForEach(func(k, v []byte) error {
+		room, _, ok := bytes.Cut(k, []byte{keySep})
+		if !ok {
+			return nil
+		}
+		msg, err := decodeMessage(v)
+		if err != nil {
+			return nil
+		}
+		for _, word := range tokenize(msg.Message) {
+			if err = words.Put(wordKey(word, string(room), msg.ID), []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func wordKey(word string, room string, id string) []byte {
+	key := append([]byte(word), keySep)
+	key = append(key, room...)
+	key = append(key, keySep)
+	return append(key, id...)
+}
+
+func senderPrefix(sender string, room string) []byte {
+	key := append([]byte(sender), keySep)
+	key = append(key, room...)
+	return append(key, keySep)
+}
+
+// timeKey encodes the time so that byte order matches chronological order.
+func timeKey(t time.Time) []byte {
+	var nanos int64
+	switch {
+	case t.Before(time.Unix(0, 0)):
+		nanos = 0
+	case t.Year() >= 2262:
+		// UnixNano overflows after 2262
+		nanos = math.MaxInt64
+	default:
+		nanos = t.UnixNano()
+	}
+	key := make([]byte, timeKeySize)
+	binary.BigEndian.PutUint64(key, uint64(nanos))
+	return key
+}
+
+func decodeMessage(data []byte) (model.ChatMessage, error) {
+	env, err := model.Unwrap(data)
+	if err != nil {
+		return model.ChatMessage{}, err
+	}
+	return env.DecodeChat()
+}
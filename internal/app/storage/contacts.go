@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const contactsFileName = "contacts.json"
+
+// Contacts are the peers marked by the user, kept in contacts.json in the
+// data directory.
+type Contacts struct {
+	// Verified maps the IDs of peers whose ID the user compared with them
+	// to the name they had at the time.
+	Verified map[string]string `json:"verified,omitempty"`
+}
+
+// LoadContacts reads the contacts, empty ones when none were saved yet.
+func LoadContacts() (Contacts, error) {
+	appDir, err := AppDir()
+	if err != nil {
+		return Contacts{}, err
+	}
+	data, err := os.ReadFile(filepath.Join(appDir, contactsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return Contacts{}, nil
+	}
+	if err != nil {
+		return Contacts{}, fmt.Errorf("read contacts: %w", err)
+	}
+	var c Contacts
+	if err = json.Unmarshal(data, &c); err != nil {
+		return Contacts{}, fmt.Errorf("decode contacts: %w", err)
+	}
+	return c, nil
+}
+
+// SaveContacts replaces the stored contacts. The file is written next to
+// the old one first so that a crash never leaves it half written.
+func SaveContacts(c Contacts) error {
+	appDir, err := AppDir()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode contacts: %w", err)
+	}
+	contactsFile := filepath.Join(appDir, contactsFileName)
+	tmp := contactsFile + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write contacts: %w", err)
+	}
+	if err = os.Rename(tmp, contactsFile); err != nil {
+		return fmt.Errorf("write contacts: %w", err)
+	}
+	return nil
+}
@@ -2,16 +2,22 @@ package storage
 
 import (
 	"bufio"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/Flicster/peerchat/internal/app/model"
 )
 
 const (
+	appDirName    = ".peerchat"
 	fileExtension = ".msg.log"
 )
 
@@ -19,82 +25,355 @@ type File struct {
 	filename string
 	file     *os.File
 	writer   *bufio.Writer
+	seen     map[string]struct{}
 	mu       sync.Mutex
 }
 
+var dataDir string
+
+// SetDataDir overrides the default ~/.peerchat data directory.
+func SetDataDir(dir string) {
+	dataDir = dir
+}
+
+// AppDir returns the application data directory (~/.peerchat unless
+// overridden by SetDataDir), creating it if it does not exist yet. Only the
+// user may read it, as it holds the keys and histories.
+func AppDir() (string, error) {
+	appDir := dataDir
+	if appDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("use home dir: %w", err)
+		}
+		appDir = filepath.Join(homeDir, appDirName)
+	}
+	if err := os.MkdirAll(appDir, 0700); err != nil {
+		return "", fmt.Errorf("mkdir: %w", err)
+	}
+	return appDir, nil
+}
+
 func NewFile(filename string) (*File, error) {
-	homeDir, err := os.UserHomeDir()
+	appDir, err := AppDir()
 	if err != nil {
-		return nil, fmt.Errorf("use home dir: %w", err)
-	}
-	appDir := filepath.Join(homeDir, ".peerchat")
-	if err = os.MkdirAll(appDir, 0755); err != nil {
-		return nil, fmt.Errorf("mkdir: %w", err)
+		return nil, err
 	}
 	logFile := filepath.Join(appDir, filename+fileExtension)
-	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		return nil, fmt.Errorf("open file: %w", err)
 	}
 
-	return &File{
+	stor := &File{
 		filename: logFile,
 		file:     file,
 		writer:   bufio.NewWriter(file),
-	}, nil
+		seen:     make(map[string]struct{}),
+	}
+	existing, err := stor.readMessages()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	for _, msg := range existing {
+		stor.seen[messageKey(msg)] = struct{}{}
+	}
+	return stor, nil
 }
 
-func (s *File) SaveMessage(msg string) error {
+// SaveMessage appends the message to the log unless it has already been stored
+// and reports whether it was new. It is safe for concurrent use.
+func (s *File) SaveMessage(msg model.ChatMessage) (bool, error) {
+	added, err := s.Merge([]model.ChatMessage{msg})
+	return added > 0, err
+}
+
+// Merge appends the messages that have not been stored yet and
+// returns how many were added. It is safe for concurrent use.
+func (s *File) Merge(msgs []model.ChatMessage) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, err := s.writer.WriteString(msg + "\n"); err != nil {
-		return fmt.Errorf("write message: %w", err)
+	added := 0
+	for _, msg := range msgs {
+		key := messageKey(msg)
+		if _, ok := s.seen[key]; ok {
+			continue
+		}
+
+		data, err := encodeMessage(key, msg)
+		if err != nil {
+			return added, err
+		}
+
+		if _, err = s.writer.Write(append(data, '\n')); err != nil {
+			return added, fmt.Errorf("write message: %w", err)
+		}
+		s.seen[key] = struct{}{}
+		added++
 	}
 
 	if err := s.writer.Flush(); err != nil {
-		return fmt.Errorf("flush buffer: %w", err)
+		return added, fmt.Errorf("flush buffer: %w", err)
 	}
-
-	return nil
+	return added, nil
 }
 
 func (s *File) LoadMessages() ([]model.ChatMessage, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	file, err := os.Open(s.filename)
+	return s.readMessages()
+}
+
+// Range returns the messages matching the query. The whole log is read,
+// use the bolt backend for large histories. With a limit only twice as many
+// messages are held in memory while reading, as the log is not ordered by time.
+func (s *File) Range(q Query) ([]model.ChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]model.ChatMessage, 0)
+	err := scanLogFile(s.filename, func(msg model.ChatMessage) {
+		if !q.matches(msg) {
+			return
+		}
+		result = append(result, msg)
+		if q.Limit > 0 && len(result) >= 2*q.Limit {
+			sortByTime(result)
+			result = slices.Clone(limited(result, q))
+		}
+	})
 	if err != nil {
 		return nil, fmt.Errorf("open for reading: %w", err)
 	}
-	defer file.Close()
+	sortByTime(result)
+	return limited(result, q), nil
+}
+
+// Get reads the log only when a message with the ID is stored.
+func (s *File) Get(id string) (model.ChatMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
+	if _, ok := s.seen[id]; !ok {
+		return model.ChatMessage{}, ErrNotFound
+	}
+	msgs, err := s.readMessages()
+	if err != nil {
+		return model.ChatMessage{}, err
+	}
+	for _, msg := range msgs {
+		if msg.ID == id {
+			return msg, nil
+		}
+	}
+	return model.ChatMessage{}, ErrNotFound
+}
+
+// Update rewrites the log with the message in place of the stored one.
+func (s *File) Update(msg model.ChatMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.seen[msg.ID]; !ok {
+		return ErrNotFound
+	}
+	if _, err := encodeMessage(msg.ID, msg); err != nil {
+		return err
+	}
+	return s.rewrite(func(stored model.ChatMessage) (model.ChatMessage, bool) {
+		if stored.ID == msg.ID {
+			return msg, true
+		}
+		return stored, true
+	})
+}
+
+// Delete rewrites the log without the message.
+func (s *File) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.seen[id]; !ok {
+		return ErrNotFound
+	}
+	err := s.rewrite(func(msg model.ChatMessage) (model.ChatMessage, bool) {
+		return msg, msg.ID != id
+	})
+	if err != nil {
+		return err
+	}
+	delete(s.seen, id)
+	return nil
+}
+
+// rewrite replaces the log with the messages returned by fn, dropping those
+// it does not keep. s.mu must be held.
+func (s *File) rewrite(fn func(msg model.ChatMessage) (model.ChatMessage, bool)) error {
+	msgs, err := s.readMessages()
+	if err != nil {
+		return err
+	}
+
+	tmpName := s.filename + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, msg := range msgs {
+		msg, keep := fn(msg)
+		if !keep {
+			continue
+		}
+		data, err := encodeMessage(msg.ID, msg)
+		if err == nil {
+			_, err = writer.Write(append(data, '\n'))
+		}
+		if err != nil {
+			_ = tmp.Close()
+			return fmt.Errorf("write message: %w", err)
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("flush buffer: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("close file: %w", err)
+	}
+	if err = os.Rename(tmpName, s.filename); err != nil {
+		return fmt.Errorf("replace file: %w", err)
+	}
+
+	_ = s.file.Close()
+	s.file, err = os.OpenFile(s.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	s.writer = bufio.NewWriter(s.file)
+	return nil
+}
+
+func (s *File) readMessages() ([]model.ChatMessage, error) {
+	msgs, err := readLogFile(s.filename)
+	if err != nil {
+		return nil, fmt.Errorf("open for reading: %w", err)
+	}
+	return msgs, nil
+}
+
+// readLogFile reads the chat messages of a log, skipping lines it cannot decode.
+func readLogFile(filename string) ([]model.ChatMessage, error) {
 	result := make([]model.ChatMessage, 0)
+	err := scanLogFile(filename, func(msg model.ChatMessage) {
+		result = append(result, msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// scanLogFile calls fn with every chat message of a log in file order.
+func scanLogFile(filename string, fn func(msg model.ChatMessage)) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
 	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxMessageSize+1)
 	for scanner.Scan() {
 		line := scanner.Bytes()
 		if len(line) == 0 {
 			continue
 		}
-		var msg model.ChatMessage
-		if err := json.Unmarshal(line, &msg); err != nil {
+		env, err := model.Unwrap(line)
+		if err != nil || env.Kind != model.KindChat {
 			continue
 		}
-		result = append(result, msg)
+		msg, err := env.DecodeChat()
+		if err != nil {
+			continue
+		}
+		msg.ID = messageKey(msg)
+		fn(msg)
 	}
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("scan file: %w", err)
+		return fmt.Errorf("scan file: %w", err)
 	}
-	return result, nil
+	return nil
+}
+
+// queryFiles runs the query over every file log in the data directory.
+func queryFiles(q Query) ([]Record, error) {
+	appDir, err := AppDir()
+	if err != nil {
+		return nil, err
+	}
+	rooms := q.Rooms
+	if len(rooms) == 0 {
+		files, err := filepath.Glob(filepath.Join(appDir, "*"+fileExtension))
+		if err != nil {
+			return nil, fmt.Errorf("list logs: %w", err)
+		}
+		for _, f := range files {
+			rooms = append(rooms, strings.TrimSuffix(filepath.Base(f), fileExtension))
+		}
+	}
+
+	result := make([]Record, 0)
+	for _, room := range rooms {
+		msgs, err := readLogFile(filepath.Join(appDir, room+fileExtension))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", room, err)
+		}
+		for _, msg := range msgs {
+			if q.matches(msg) {
+				result = append(result, Record{Room: room, ChatMessage: msg})
+			}
+		}
+	}
+	slices.SortStableFunc(result, func(a, b Record) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return limited(result, q), nil
 }
 
 func (s *File) Clear() error {
-	return os.Truncate(s.filename, 0)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Truncate(s.filename, 0); err != nil {
+		return err
+	}
+	s.seen = make(map[string]struct{})
+	return nil
 }
 
 func (s *File) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if err := s.writer.Flush(); err != nil {
 		return err
 	}
 	return s.file.Close()
 }
+
+// messageKey identifies a message for deduplication. Messages written
+// before message IDs existed get a stable ID derived from their content.
+func messageKey(msg model.ChatMessage) string {
+	if msg.ID != "" {
+		return msg.ID
+	}
+	sum := sha256.Sum256([]byte(msg.SenderID + "\x00" + msg.CreatedAt.UTC().Format(time.RFC3339Nano) + "\x00" + msg.Message))
+	return hex.EncodeToString(sum[:])
+}
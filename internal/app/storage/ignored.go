@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const ignoredFileName = "ignored.json"
+
+// LoadIgnored reads the peers the user ignores, mapping their IDs to the
+// name they had when ignored. It is empty when none were saved yet.
+func LoadIgnored() (map[string]string, error) {
+	appDir, err := AppDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(appDir, ignoredFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read ignored peers: %w", err)
+	}
+	ignored := make(map[string]string)
+	if err = json.Unmarshal(data, &ignored); err != nil {
+		return nil, fmt.Errorf("decode ignored peers: %w", err)
+	}
+	return ignored, nil
+}
+
+// SaveIgnored replaces the stored ignored peers, written next to the old
+// file first like the contacts. They are kept apart from the contacts as
+// the node and an attached UI may run in different processes.
+func SaveIgnored(ignored map[string]string) error {
+	appDir, err := AppDir()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(ignored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode ignored peers: %w", err)
+	}
+	ignoredFile := filepath.Join(appDir, ignoredFileName)
+	tmp := ignoredFile + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write ignored peers: %w", err)
+	}
+	if err = os.Rename(tmp, ignoredFile); err != nil {
+		return fmt.Errorf("write ignored peers: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	keysDirName  = "keys"
+	keyExtension = ".key"
+
+	pemPlainKey     = "PEERCHAT PRIVATE KEY"
+	pemEncryptedKey = "PEERCHAT ENCRYPTED PRIVATE KEY"
+
+	rsaKeyBits = 2048
+
+	scryptN   = 1 << 15
+	scryptR   = 8
+	scryptP   = 1
+	saltSize  = 16
+	aesKeyLen = 32
+)
+
+var ErrPassphraseRequired = errors.New("identity key is encrypted, passphrase required")
+
+// ParseKeyType maps a key type name to the libp2p key type constant.
+func ParseKeyType(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "ed25519", "":
+		return crypto.Ed25519, nil
+	case "rsa":
+		return crypto.RSA, nil
+	default:
+		return 0, fmt.Errorf("unsupported key type %q", name)
+	}
+}
+
+// LoadOrCreateKey returns the identity key of the given profile. The key is
+// generated on first use and stored under ~/.peerchat/keys with owner-only
+// permissions. A non-empty passphrase encrypts a newly created key and is
+// required to decrypt an encrypted one.
+func LoadOrCreateKey(profile string, keyType int, passphrase string) (crypto.PrivKey, error) {
+	if profile == "" || strings.ContainsAny(profile, `/\`) || profile == "." || profile == ".." {
+		return nil, fmt.Errorf("invalid profile name %q", profile)
+	}
+	appDir, err := AppDir()
+	if err != nil {
+		return nil, err
+	}
+	keysDir := filepath.Join(appDir, keysDirName)
+	if err = os.MkdirAll(keysDir, 0700); err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+	keyFile := filepath.Join(keysDir, profile+keyExtension)
+
+	priv, err := loadKey(keyFile, passphrase)
+	if err == nil {
+		return priv, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return createKey(keyFile, keyType, passphrase)
+}
+
+// LoadSwarmKey reads a private network pre-shared key in the
+// /key/swarm/psk/1.0.0/ format used by IPFS.
+func LoadSwarmKey(keyFile string) (pnet.PSK, error) {
+	if err := checkKeyPerm(keyFile); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("open swarm key: %w", err)
+	}
+	defer file.Close()
+
+	psk, err := pnet.DecodeV1PSK(file)
+	if err != nil {
+		return nil, fmt.Errorf("decode swarm key: %w", err)
+	}
+	return psk, nil
+}
+
+// checkKeyPerm refuses key files readable by other users.
+func checkKeyPerm(keyFile string) error {
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("key %s is accessible by other users (mode %s), run chmod 600", keyFile, info.Mode().Perm())
+	}
+	return nil
+}
+
+func loadKey(keyFile string, passphrase string) (crypto.PrivKey, error) {
+	if err := checkKeyPerm(keyFile); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read identity key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("decode identity key: no PEM block in %s", keyFile)
+	}
+
+	raw := block.Bytes
+	switch block.Type {
+	case pemPlainKey:
+	case pemEncryptedKey:
+		if passphrase == "" {
+			return nil, ErrPassphraseRequired
+		}
+		raw, err = decryptKey(block, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("decode identity key: unexpected block type %q", block.Type)
+	}
+
+	priv, err := crypto.UnmarshalPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal identity key: %w", err)
+	}
+	return priv, nil
+}
+
+func createKey(keyFile string, keyType int, passphrase string) (crypto.PrivKey, error) {
+	priv, _, err := crypto.GenerateKeyPairWithReader(keyType, rsaKeyBits, rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate identity key: %w", err)
+	}
+	raw, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("marshal identity key: %w", err)
+	}
+
+	block := &pem.Block{Type: pemPlainKey, Bytes: raw}
+	if passphrase != "" {
+		block, err = encryptKey(raw, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(keyFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("create identity key: %w", err)
+	}
+	// a partial key would be taken for a broken one on the next start
+	if err = pem.Encode(file, block); err != nil {
+		_ = file.Close()
+		_ = os.Remove(keyFile)
+		return nil, fmt.Errorf("write identity key: %w", err)
+	}
+	if err = file.Close(); err != nil {
+		_ = os.Remove(keyFile)
+		return nil, fmt.Errorf("write identity key: %w", err)
+	}
+	return priv, nil
+}
+
+func encryptKey(raw []byte, passphrase string) (*pem.Block, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generate salt: %w", err)
+	}
+	aead, err := keyCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	return &pem.Block{
+		Type: pemEncryptedKey,
+		Headers: map[string]string{
+			"Kdf":   "scrypt",
+			"Salt":  hex.EncodeToString(salt),
+			"Nonce": hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, raw, nil),
+	}, nil
+}
+
+func decryptKey(block *pem.Block, passphrase string) ([]byte, error) {
+	if kdf := block.Headers["Kdf"]; kdf != "scrypt" {
+		return nil, fmt.Errorf("decrypt identity key: unsupported kdf %q", kdf)
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("decrypt identity key: bad salt: %w", err)
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("decrypt identity key: bad nonce: %w", err)
+	}
+	aead, err := keyCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("decrypt identity key: bad nonce size")
+	}
+	raw, err := aead.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, errors.New("decrypt identity key: wrong passphrase")
+	}
+	return raw, nil
+}
+
+func keyCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, aesKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
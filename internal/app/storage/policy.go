@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+)
+
+const policyFileSuffix = ".policy.json"
+
+// LoadPolicy reads the moderation policy last accepted for the room history
+// of the name, nil when the room has none.
+func LoadPolicy(name string) (*model.Signed, error) {
+	appDir, err := AppDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(appDir, name+policyFileSuffix))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read policy: %w", err)
+	}
+	var s model.Signed
+	if err = json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("decode policy: %w", err)
+	}
+	return &s, nil
+}
+
+// SavePolicy replaces the stored policy of the room, written next to the
+// old one first like the contacts.
+func SavePolicy(name string, s model.Signed) error {
+	appDir, err := AppDir()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("encode policy: %w", err)
+	}
+	policyFile := filepath.Join(appDir, name+policyFileSuffix)
+	tmp := policyFile + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write policy: %w", err)
+	}
+	if err = os.Rename(tmp, policyFile); err != nil {
+		return fmt.Errorf("write policy: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+)
+
+// SearchQuery selects the messages matching the Query filters that contain
+// every term and phrase.
+type SearchQuery struct {
+	Query
+	// Terms are matched against the beginning of words, ignoring case.
+	Terms []string
+	// Phrases must appear in the message as written, ignoring case.
+	Phrases []string
+	// SenderName matches the sender name ignoring case.
+	SenderName string
+}
+
+// Search runs a full-text search over every conversation, or those in
+// q.Rooms, and returns the latest q.Limit matches ordered by time. The bolt
+// backend looks terms up in its word index, the file backend reads every log.
+func Search(q SearchQuery) ([]Record, error) {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+
+	if backend == BackendFile {
+		all := q.Query
+		all.Limit = 0
+		records, err := queryFiles(all)
+		if err != nil {
+			return nil, err
+		}
+		result := make([]Record, 0)
+		for _, rec := range records {
+			if q.matchesText(rec.ChatMessage) {
+				result = append(result, rec)
+			}
+		}
+		return limited(result, q.Query), nil
+	}
+	if err := openDB(); err != nil {
+		return nil, err
+	}
+	return db.Search(q)
+}
+
+// matchesText reports whether the message is from SenderName and contains
+// every term and phrase, deleted messages never match. The Query filters
+// are checked separately.
+func (q SearchQuery) matchesText(msg model.ChatMessage) bool {
+	if msg.Deleted {
+		return false
+	}
+	if q.SenderName != "" && !strings.EqualFold(q.SenderName, msg.SenderName) {
+		return false
+	}
+	text := strings.ToLower(msg.Message)
+	for _, phrase := range q.Phrases {
+		if !strings.Contains(text, strings.ToLower(phrase)) {
+			return false
+		}
+	}
+	words := tokenize(msg.Message)
+	for _, term := range q.Terms {
+		term = strings.ToLower(term)
+		found := false
+		for _, w := range words {
+			if strings.HasPrefix(w, term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenize splits the text into distinct lower-cased words.
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := make(map[string]struct{}, len(fields))
+	words := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if _, ok := seen[f]; ok {
+			continue
+		}
+		seen[f] = struct{}{}
+		words = append(words, f)
+	}
+	return words
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+)
+
+const (
+	BackendFile = "file"
+	BackendBolt = "bolt"
+)
+
+// maxMessageSize bounds the encoding of a stored message, as the file
+// backend reads its logs line by line.
+const maxMessageSize = 1 << 20
+
+var (
+	ErrNotFound = errors.New("message not found")
+	ErrTooLarge = errors.New("message is too large to store")
+)
+
+// encodeMessage wraps the message under the ID for storage.
+func encodeMessage(id string, msg model.ChatMessage) ([]byte, error) {
+	data, err := model.Wrap(model.KindChat, id, msg)
+	if err != nil {
+		return nil, fmt.Errorf("wrap message: %w", err)
+	}
+	if len(data) > maxMessageSize {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
+// Store keeps the messages of one conversation, a room or a direct chat.
+// Implementations are safe for concurrent use.
+type Store interface {
+	// SaveMessage appends the message unless it has already been stored and
+	// reports whether it was new.
+	SaveMessage(msg model.ChatMessage) (bool, error)
+	// Merge appends the messages not stored yet and returns how many were added.
+	Merge(msgs []model.ChatMessage) (int, error)
+	// LoadMessages returns every stored message.
+	LoadMessages() ([]model.ChatMessage, error)
+	// Range returns the messages matching the query ordered by time.
+	Range(q Query) ([]model.ChatMessage, error)
+	Get(id string) (model.ChatMessage, error)
+	// Update replaces the stored message with the same ID.
+	Update(msg model.ChatMessage) error
+	Delete(id string) error
+	Clear() error
+	Close() error
+}
+
+// Query selects messages by time and sender. Zero values do not restrict the result.
+type Query struct {
+	// Rooms restricts a query over all conversations, see QueryAll.
+	// It is ignored by a Store, which only holds a single conversation.
+	Rooms    []string
+	SenderID string
+	// Since and Until bound the creation time, Since is exclusive and Until inclusive.
+	Since time.Time
+	Until time.Time
+	// Limit keeps only the latest messages, or the earliest when First is set.
+	Limit int
+	First bool
+}
+
+// Record is a stored message together with the conversation it belongs to.
+type Record struct {
+	Room string
+	model.ChatMessage
+}
+
+var (
+	backendMu sync.Mutex
+	backend   = BackendFile
+	db        *Bolt
+)
+
+// SetBackend selects the backend used by Open, BackendFile or BackendBolt.
+func SetBackend(name string) error {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+
+	switch name {
+	case BackendFile, BackendBolt:
+		backend = name
+		return nil
+	default:
+		return fmt.Errorf("unknown storage backend %q", name)
+	}
+}
+
+// Open returns the store of the named conversation in the selected backend.
+func Open(name string) (Store, error) {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+
+	if backend == BackendFile {
+		return NewFile(name)
+	}
+	if err := openDB(); err != nil {
+		return nil, err
+	}
+	return db.Room(name)
+}
+
+// QueryAll runs the query over every conversation, or those in q.Rooms.
+// The file backend reads every log in full.
+func QueryAll(q Query) ([]Record, error) {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+
+	if backend == BackendFile {
+		return queryFiles(q)
+	}
+	if err := openDB(); err != nil {
+		return nil, err
+	}
+	return db.Query(q)
+}
+
+// openDB opens the shared bolt database on first use, backendMu must be held.
+func openDB() error {
+	if db != nil {
+		return nil
+	}
+	var err error
+	db, err = OpenBolt()
+	return err
+}
+
+// Close releases the backend, stores opened before must not be used afterwards.
+func Close() error {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+
+	if db == nil {
+		return nil
+	}
+	err := db.Close()
+	db = nil
+	return err
+}
+
+// matches reports whether the message is selected by the query.
+func (q Query) matches(msg model.ChatMessage) bool {
+	if q.SenderID != "" && msg.SenderID != q.SenderID {
+		return false
+	}
+	if !q.Since.IsZero() && !msg.CreatedAt.After(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && msg.CreatedAt.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+func sortByTime(msgs []model.ChatMessage) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].CreatedAt.Before(msgs[j].CreatedAt)
+	})
+}
+
+// limited applies the query limit to items ordered by time.
+func limited[T any](items []T, q Query) []T {
+	if q.Limit <= 0 || len(items) <= q.Limit {
+		return items
+	}
+	if q.First {
+		return items[:q.Limit]
+	}
+	return items[len(items)-q.Limit:]
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Flicster/peerchat/internal/app/model"
+)
+
+// openTestStores returns a store of each backend in a fresh data directory.
+func openTestStores(t *testing.T) map[string]Store {
+	t.Helper()
+	SetDataDir(t.TempDir())
+	t.Cleanup(func() { SetDataDir("") })
+
+	file, err := NewFile("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = file.Close() })
+	b, err := OpenBolt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = b.Close() })
+	room, err := b.Room("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{BackendFile: file, BackendBolt: room}
+}
+
+func testMessage(id, sender string, at time.Time) model.ChatMessage {
+	return model.ChatMessage{ID: id, SenderID: sender, SenderName: sender, Message: "message " + id, CreatedAt: at}
+}
+
+func messageIDs(msgs []model.ChatMessage) []string {
+	ids := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+func TestStore(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	// stored out of order, Range orders them by time
+	msgs := []model.ChatMessage{
+		testMessage("c", "bob", at(3)),
+		testMessage("a", "alice", at(1)),
+		testMessage("b", "bob", at(2)),
+		testMessage("d", "alice", at(4)),
+	}
+
+	for name, s := range openTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if added, err := s.Merge(msgs[:3]); err != nil || added != 3 {
+				t.Fatalf("Merge = %d, %v, want 3 added", added, err)
+			}
+			if added, err := s.Merge(msgs[1:]); err != nil || added != 1 {
+				t.Fatalf("Merge of stored messages = %d, %v, want 1 added", added, err)
+			}
+			if added, err := s.SaveMessage(msgs[0]); err != nil || added {
+				t.Fatalf("SaveMessage of a stored message = %v, %v, want false", added, err)
+			}
+
+			ranges := []struct {
+				desc string
+				q    Query
+				want []string
+			}{
+				{"all", Query{}, []string{"a", "b", "c", "d"}},
+				{"latest", Query{Limit: 2}, []string{"c", "d"}},
+				{"earliest", Query{Limit: 2, First: true}, []string{"a", "b"}},
+				{"since", Query{Since: at(2)}, []string{"c", "d"}},
+				{"until", Query{Until: at(2)}, []string{"a", "b"}},
+				{"until with a limit", Query{Until: at(3), Limit: 1}, []string{"c"}},
+				{"sender", Query{SenderID: "bob"}, []string{"b", "c"}},
+				{"limit above the count", Query{Limit: 10}, []string{"a", "b", "c", "d"}},
+			}
+			for _, tt := range ranges {
+				got, err := s.Range(tt.q)
+				if err != nil {
+					t.Fatalf("%s: Range error = %v", tt.desc, err)
+				}
+				if ids := messageIDs(got); !slices.Equal(ids, tt.want) {
+					t.Errorf("%s: Range = %v, want %v", tt.desc, ids, tt.want)
+				}
+			}
+
+			if msg, err := s.Get("b"); err != nil || msg.Message != "message b" {
+				t.Errorf("Get = %q, %v, want %q", msg.Message, err, "message b")
+			}
+			if _, err := s.Get("x"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of an unknown message error = %v, want %v", err, ErrNotFound)
+			}
+
+			edited := msgs[2]
+			edited.Message = "edited"
+			if err := s.Update(edited); err != nil {
+				t.Fatalf("Update error = %v", err)
+			}
+			if msg, err := s.Get("b"); err != nil || msg.Message != "edited" {
+				t.Errorf("Get after Update = %q, %v, want %q", msg.Message, err, "edited")
+			}
+			if err := s.Update(testMessage("x", "bob", at(5))); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Update of an unknown message error = %v, want %v", err, ErrNotFound)
+			}
+			large := msgs[2]
+			large.Message = strings.Repeat("x", maxMessageSize)
+			if err := s.Update(large); !errors.Is(err, ErrTooLarge) {
+				t.Errorf("Update with a large message error = %v, want %v", err, ErrTooLarge)
+			}
+
+			if err := s.Delete("a"); err != nil {
+				t.Fatalf("Delete error = %v", err)
+			}
+			if _, err := s.Get("a"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get after Delete error = %v, want %v", err, ErrNotFound)
+			}
+			if err := s.Delete("a"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Delete of a deleted message error = %v, want %v", err, ErrNotFound)
+			}
+			got, err := s.LoadMessages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := messageIDs(got); len(ids) != 3 || slices.Contains(ids, "a") {
+				t.Errorf("LoadMessages after Delete = %v, want b, c and d", ids)
+			}
+		})
+	}
+}
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/Flicster/peerchat/internal/app/config"
 	"github.com/Flicster/peerchat/internal/app/service"
+	"github.com/Flicster/peerchat/internal/app/storage"
 	"github.com/sirupsen/logrus"
 )
 
+const passphraseEnv = "PEERCHAT_PASSPHRASE"
+
 const figlet = `
 
 W E L C O M E  T O
@@ -33,40 +41,130 @@ func init() {
 }
 
 func main() {
-	username := flag.String("user", "", "username to use in the chatroom.")
-	chatroom := flag.String("room", "", "chatroom to join.")
-	loglevel := flag.String("log", "", "level of logs to print.")
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "config" {
+		runConfig(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "daemon" {
+		runDaemon(args[1:])
+		return
+	}
+
+	cfg, err := config.Load("peerchat", args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	setLogLevel(cfg.Log)
+
+	if cfg.Daemon.Attach {
+		err = runAttached(cfg)
+	} else {
+		err = runChat(cfg)
+	}
+	// the runs return their error so that their deferred cleanup is done first
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// runChat runs the terminal UI on a node of its own.
+func runChat(cfg *config.Config) error {
+	fmt.Println(figlet)
+	fmt.Println()
+	fmt.Println("The PeerChat Application is starting.")
+	fmt.Println("This may take upto 30 seconds.")
+	fmt.Println()
+
+	if err := setupStorage(cfg); err != nil {
+		return err
+	}
+	defer storage.Close()
+	p2p, err := startP2P(cfg)
+	if err != nil {
+		return err
+	}
+	defer p2p.Close()
 
-	flag.Parse()
+	chat, err := service.NewChatRoom(p2p, cfg.User, cfg.Room, cfg.RoomKey)
+	if err != nil {
+		return err
+	}
+
+	dm := service.NewDirect(p2p)
 
-	switch *loglevel {
-	case "panic", "PANIC":
+	files := service.NewFiles(p2p, cfg.Downloads)
+
+	ui := service.NewUI(chat, dm, files, cfg.UI)
+	return ui.Run()
+}
+
+func setLogLevel(level string) {
+	switch strings.ToLower(level) {
+	case "panic":
 		logrus.SetLevel(logrus.PanicLevel)
-	case "fatal", "FATAL":
+	case "fatal":
 		logrus.SetLevel(logrus.FatalLevel)
-	case "error", "ERROR":
+	case "error":
 		logrus.SetLevel(logrus.ErrorLevel)
-	case "warn", "WARN":
+	case "warn":
 		logrus.SetLevel(logrus.WarnLevel)
-	case "info", "INFO":
+	case "info":
 		logrus.SetLevel(logrus.InfoLevel)
-	case "debug", "DEBUG":
+	case "debug":
 		logrus.SetLevel(logrus.DebugLevel)
-	case "trace", "TRACE":
+	case "trace":
 		logrus.SetLevel(logrus.TraceLevel)
 	default:
 		logrus.SetLevel(logrus.InfoLevel)
 	}
+}
 
-	fmt.Println(figlet)
-	fmt.Println()
-	fmt.Println("The PeerChat Application is starting.")
-	fmt.Println("This may take upto 30 seconds.")
-	fmt.Println()
+func setupStorage(cfg *config.Config) error {
+	storage.SetDataDir(cfg.DataDir)
+	return storage.SetBackend(cfg.Storage)
+}
 
-	p2p, err := service.NewP2P()
+// startP2P loads the identity and brings up the libp2p node.
+func startP2P(cfg *config.Config) (*service.P2P, error) {
+	keyType, err := storage.ParseKeyType(cfg.KeyType)
 	if err != nil {
-		logrus.Fatal(err)
+		return nil, err
+	}
+	priv, err := storage.LoadOrCreateKey(cfg.Profile, keyType, os.Getenv(passphraseEnv))
+	if err != nil {
+		return nil, err
+	}
+
+	p2pOpts := service.P2POptions{
+		Discovery:         cfg.Network.Discovery,
+		ServiceName:       cfg.Network.ServiceName,
+		ListenAddrs:       cfg.Network.ListenAddrs,
+		ConnLow:           cfg.Network.ConnLow,
+		ConnHigh:          cfg.Network.ConnHigh,
+		BootstrapPeers:    cfg.Network.Bootstrap,
+		NoPublicBootstrap: cfg.Network.NoPublicBootstrap,
+		BlockIgnored:      cfg.Network.BlockIgnored,
+		History: service.HistoryOptions{
+			Refuse:        !cfg.History.Share,
+			Limit:         cfg.History.Limit,
+			MaxAge:        cfg.History.MaxAge,
+			RatePerMinute: cfg.History.RatePerMinute,
+		},
+	}
+	if cfg.Network.SwarmKey != "" {
+		p2pOpts.PSK, err = storage.LoadSwarmKey(cfg.Network.SwarmKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p2p, err := service.NewP2P(priv, p2pOpts)
+	if err != nil {
+		return nil, err
 	}
 
 	fmt.Println("Completed P2P Setup.")
@@ -74,16 +172,97 @@ func main() {
 
 	err = p2p.AdvertiseConnect()
 	if err != nil {
-		logrus.Fatal(err)
+		_ = p2p.Close()
+		return nil, err
 	}
+	return p2p, nil
+}
 
-	chat, err := service.NewChatRoom(p2p, *username, *chatroom)
+// runDaemon handles the "daemon" subcommand: the node joins the configured
+// room without a terminal UI and serves the local API until interrupted.
+func runDaemon(args []string) {
+	cfg, err := config.Load("peerchat daemon", args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
 		logrus.Fatal(err)
 	}
+	setLogLevel(cfg.Log)
+
+	if err = serveDaemon(cfg); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// serveDaemon brings up the node and serves the API until interrupted or
+// the API fails.
+func serveDaemon(cfg *config.Config) error {
+	if err := setupStorage(cfg); err != nil {
+		return err
+	}
+	defer storage.Close()
+	p2p, err := startP2P(cfg)
+	if err != nil {
+		return err
+	}
+	defer p2p.Close()
 
-	ui := service.NewUI(chat)
-	if err = ui.Run(); err != nil {
+	daemon := service.NewDaemon(p2p, cfg.User)
+	if _, err = daemon.Join(cfg.Room, cfg.RoomKey); err != nil {
+		daemon.Close()
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- daemon.Serve(cfg.Daemon.Socket)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		logrus.WithField("signal", sig.String()).Info("shutting down")
+	case err = <-done:
+	}
+	daemon.Close()
+	return err
+}
+
+// runAttached runs the terminal UI against a running daemon.
+func runAttached(cfg *config.Config) error {
+	// the daemon keeps the history, only local files like the contacts are read here
+	storage.SetDataDir(cfg.DataDir)
+	client, err := service.DialDaemon(cfg.Daemon.Socket)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	chat, err := service.NewRemoteChatRoom(client, cfg.User, cfg.Room, cfg.RoomKey)
+	if err != nil {
+		return err
+	}
+
+	ui := service.NewUI(chat, nil, nil, cfg.UI)
+	return ui.Run()
+}
+
+// runConfig handles the "config" subcommand.
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: peerchat config print [flags]")
+		os.Exit(2)
+	}
+	cfg, err := config.Load("peerchat config print", args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if err = cfg.Print(os.Stdout); err != nil {
 		logrus.Fatal(err)
 	}
 }